@@ -0,0 +1,175 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	// ErrDevAddrNotInNetID is returned when a DevAddr is outside the range of the NetID
+	ErrDevAddrNotInNetID = errors.New("The DevAddr is not in the range of the NetID")
+
+	// ErrDuplicateABPSession is returned when another device has a session with
+	// the same DevAddr and network session key, so that their uplink messages
+	// can not be told apart
+	ErrDuplicateABPSession = errors.New("Another device has the same DevAddr and network session key")
+)
+
+/* ABPDevice Implementations */
+
+// ABPDevice contains the settings that are programmed in the firmware of a
+// device that is activated by personalization
+// See Section 6.1 of the LoRaWan Specification
+type ABPDevice struct {
+	DevEUI     uint64     `json:"dev_eui"`
+	DevAddr    DevAddr    `json:"dev_addr"`
+	MACVersion MACVersion `json:"mac_version"`
+
+	NwkSKey     []byte `json:"nwk_s_key"`       // LoRaWAN 1.0
+	FNwkSIntKey []byte `json:"f_nwk_s_int_key"` // LoRaWAN 1.1
+	SNwkSIntKey []byte `json:"s_nwk_s_int_key"` // LoRaWAN 1.1
+	NwkSEncKey  []byte `json:"nwk_s_enc_key"`   // LoRaWAN 1.1
+	AppSKey     []byte `json:"app_s_key"`
+
+	ChannelPlan *ChannelPlan `json:"channel_plan"` // Defaults to the DefaultChannelPlan of the region
+	RXDelay     uint8        `json:"rx_delay"`     // Seconds, zero means one second
+	RX1DROffset int          `json:"rx1_dr_offset"`
+	DataRate    int          `json:"data_rate"`
+	TXPower     int          `json:"tx_power"`
+	ADR         bool         `json:"adr"`
+
+	// FCntPolicy should be Relaxed for devices that reset their frame
+	// counters when they restart
+	FCntPolicy FCntPolicy `json:"f_cnt_policy"`
+}
+
+// validateKey checks that the key is an AES-128 key
+func validateKey(name string, key []byte) error {
+	if len(key) != 16 {
+		return fmt.Errorf("%s should be 16 bytes, not %d", name, len(key))
+	}
+	return nil
+}
+
+// Session validates the settings of the ABPDevice against the region and
+// returns the session of the device. The session uses the same keys for
+// the MIC and encryption as the firmware of the device.
+func (device *ABPDevice) Session(region *Region) (*DeviceSession, error) {
+	session := &DeviceSession{
+		DevAddr:     uint32(device.DevAddr),
+		DevEUI:      device.DevEUI,
+		MACVersion:  device.MACVersion,
+		AppSKey:     cloneBytes(device.AppSKey),
+		FCntPolicy:  device.FCntPolicy,
+		RXDelay:     device.RXDelay,
+		RX1DROffset: device.RX1DROffset,
+		ADR:         device.ADR,
+		DataRate:    device.DataRate,
+		TXPower:     device.TXPower,
+		NbTrans:     1,
+	}
+
+	if device.MACVersion.is11() {
+		if err := validateKey("FNwkSIntKey", device.FNwkSIntKey); err != nil {
+			return nil, err
+		}
+		if err := validateKey("SNwkSIntKey", device.SNwkSIntKey); err != nil {
+			return nil, err
+		}
+		if err := validateKey("NwkSEncKey", device.NwkSEncKey); err != nil {
+			return nil, err
+		}
+		session.FNwkSIntKey = cloneBytes(device.FNwkSIntKey)
+		session.SNwkSIntKey = cloneBytes(device.SNwkSIntKey)
+		session.NwkSEncKey = cloneBytes(device.NwkSEncKey)
+	} else {
+		if err := validateKey("NwkSKey", device.NwkSKey); err != nil {
+			return nil, err
+		}
+		session.FNwkSIntKey = cloneBytes(device.NwkSKey)
+		session.SNwkSIntKey = cloneBytes(device.NwkSKey)
+		session.NwkSEncKey = cloneBytes(device.NwkSKey)
+	}
+	if err := validateKey("AppSKey", device.AppSKey); err != nil {
+		return nil, err
+	}
+
+	channelPlan := device.ChannelPlan
+	if channelPlan == nil {
+		channelPlan = DefaultChannelPlan(region)
+	}
+	if err := channelPlan.Validate(region); err != nil {
+		return nil, err
+	}
+	session.RX2Frequency = channelPlan.RX2.Frequency
+	session.RX2DataRate = channelPlan.RX2.DataRate
+	session.ChannelMask = channelPlan.ChannelMask(region)
+
+	if device.RXDelay > 15 {
+		return nil, fmt.Errorf("RXDelay should be at most 15 seconds, not %d", device.RXDelay)
+	}
+	if _, err := region.RX1DataRate(device.DataRate, device.RX1DROffset); err != nil {
+		return nil, err
+	}
+	if _, err := region.TXPower(device.TXPower); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+/* ABPProvisioner Implementations */
+
+// ABPProvisionerConfig contains the configuration of an ABPProvisioner
+type ABPProvisionerConfig struct {
+	NetID    NetID
+	Region   *Region
+	Sessions DeviceSessionStore
+}
+
+// ABPProvisioner creates the sessions of ABP devices. It is safe for
+// concurrent use.
+type ABPProvisioner struct {
+	config ABPProvisionerConfig
+	mu     sync.Mutex // Serializes the duplicate checks
+}
+
+// NewABPProvisioner returns a new ABPProvisioner
+func NewABPProvisioner(config ABPProvisionerConfig) *ABPProvisioner {
+	return &ABPProvisioner{config: config}
+}
+
+// Provision validates the ABPDevice and stores its session. It returns
+// ErrSessionExists if the device already has a session.
+func (provisioner *ABPProvisioner) Provision(device *ABPDevice) (*DeviceSession, error) {
+	if !provisioner.config.NetID.Contains(device.DevAddr) {
+		return nil, ErrDevAddrNotInNetID
+	}
+	session, err := device.Session(provisioner.config.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	provisioner.mu.Lock()
+	defer provisioner.mu.Unlock()
+
+	sessions, err := provisioner.config.Sessions.GetByDevAddr(session.DevAddr)
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range sessions {
+		if other.DevEUI != session.DevEUI && bytes.Equal(other.FNwkSIntKey, session.FNwkSIntKey) {
+			return nil, ErrDuplicateABPSession
+		}
+	}
+	if err := provisioner.config.Sessions.Save(session, nil); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
@@ -0,0 +1,148 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+/* ABPDevice Tests */
+
+// testABPDevice returns the settings of the device of testSession
+func testABPDevice(version MACVersion) *ABPDevice {
+	session := testSession(version)
+	device := &ABPDevice{
+		DevEUI:     session.DevEUI,
+		DevAddr:    DevAddr(session.DevAddr),
+		MACVersion: version,
+		AppSKey:    session.AppSKey,
+		DataRate:   5,
+	}
+	if version.is11() {
+		device.FNwkSIntKey, device.SNwkSIntKey, device.NwkSEncKey = session.FNwkSIntKey, session.SNwkSIntKey, session.NwkSEncKey
+	} else {
+		device.NwkSKey = session.FNwkSIntKey
+	}
+	return device
+}
+
+func TestABPDeviceSession(t *testing.T) {
+	eu868, _ := GetRegion("EU868", RP002_1_0_3)
+	for _, version := range []MACVersion{LoRaWAN1_0_2, LoRaWAN1_1} {
+		session, err := testABPDevice(version).Session(eu868)
+		if err != nil {
+			t.Fatalf("%s: Session failed: %s", version, err)
+		}
+		device := testSession(version)
+		for _, key := range [][2][]byte{
+			{session.FNwkSIntKey, device.FNwkSIntKey},
+			{session.SNwkSIntKey, device.SNwkSIntKey},
+			{session.NwkSEncKey, device.NwkSEncKey},
+			{session.AppSKey, device.AppSKey},
+		} {
+			if !bytes.Equal(key[0], key[1]) {
+				t.Errorf("%s: session key\n   got: %x\n  want: %x", version, key[0], key[1])
+			}
+		}
+		if session.RX2Frequency != eu868.RX2Frequency || session.RX2DataRate != eu868.RX2DataRate || session.DataRate != 5 {
+			t.Errorf("%s: radio settings\n   got: %#v", version, session)
+		}
+		if want := []bool{true, true, true}; !reflect.DeepEqual(session.ChannelMask, want) {
+			t.Errorf("%s: ChannelMask\n   got: %v\n  want: %v", version, session.ChannelMask, want)
+		}
+
+		// The session decodes the messages of the firmware
+		phyPayload, _ := ParsePHYPayload(testUplink(device, 0, false, 1, []byte("hello")))
+		uplink, err := session.DecodeUplink(phyPayload, testTXParams)
+		if err != nil {
+			t.Fatalf("%s: DecodeUplink failed: %s", version, err)
+		}
+		if string(uplink.FRMPayload) != "hello" {
+			t.Errorf("%s: FRMPayload\n   got: %q\n  want: %q", version, uplink.FRMPayload, "hello")
+		}
+	}
+
+	us915, _ := GetRegion("US915", RP002_1_0_3)
+	device := testABPDevice(LoRaWAN1_0_2)
+	device.DataRate = 0
+	device.ChannelPlan = &ChannelPlan{Region: "US915", Version: RP002_1_0_3, RX2: ChannelPlanRX2{Frequency: us915.RX2Frequency, DataRate: us915.RX2DataRate}, SubBands: []int{2}}
+	session, err := device.Session(us915)
+	if err != nil {
+		t.Fatalf("Session in US915 failed: %s", err)
+	}
+	var enabled []int
+	for i, on := range session.ChannelMask {
+		if on {
+			enabled = append(enabled, i)
+		}
+	}
+	if want := []int{8, 9, 10, 11, 12, 13, 14, 15, 65}; !reflect.DeepEqual(enabled, want) {
+		t.Errorf("US915 enabled channels\n   got: %v\n  want: %v", enabled, want)
+	}
+}
+
+func TestABPDeviceSessionInvalid(t *testing.T) {
+	eu868, _ := GetRegion("EU868", RP002_1_0_3)
+	tests := []struct {
+		name   string
+		modify func(device *ABPDevice)
+	}{
+		{"short NwkSKey", func(device *ABPDevice) { device.NwkSKey = device.NwkSKey[:8] }},
+		{"missing AppSKey", func(device *ABPDevice) { device.AppSKey = nil }},
+		{"LoRaWAN 1.1 without FNwkSIntKey", func(device *ABPDevice) { device.MACVersion = LoRaWAN1_1 }},
+		{"invalid data rate", func(device *ABPDevice) { device.DataRate = 12 }},
+		{"invalid RX1DROffset", func(device *ABPDevice) { device.RX1DROffset = 6 }},
+		{"invalid TXPower", func(device *ABPDevice) { device.TXPower = 16 }},
+		{"invalid RXDelay", func(device *ABPDevice) { device.RXDelay = 16 }},
+		{"channel plan of another region", func(device *ABPDevice) { device.ChannelPlan = &ChannelPlan{Region: "US915"} }},
+	}
+	for _, tt := range tests {
+		device := testABPDevice(LoRaWAN1_0_2)
+		tt.modify(device)
+		if _, err := device.Session(eu868); err == nil {
+			t.Errorf("Session should error on %s", tt.name)
+		}
+	}
+}
+
+/* ABPProvisioner Tests */
+
+func TestABPProvisioner(t *testing.T) {
+	eu868, _ := GetRegion("EU868", RP002_1_0_3)
+	sessions := NewMemorySessionStore()
+	provisioner := NewABPProvisioner(ABPProvisionerConfig{NetID: 0x000013, Region: eu868, Sessions: sessions})
+
+	device := testABPDevice(LoRaWAN1_0_2)
+	session, err := provisioner.Provision(device)
+	if err != nil {
+		t.Fatalf("Provision failed: %s", err)
+	}
+	if stored, _ := sessions.GetByDevEUI(device.DevEUI); !reflect.DeepEqual(stored, session) {
+		t.Errorf("stored session\n   got: %#v\n  want: %#v", stored, session)
+	}
+	if _, err := provisioner.Provision(device); err != ErrSessionExists {
+		t.Errorf("Provision of the same device\n   got: %v\n  want: %v", err, ErrSessionExists)
+	}
+
+	// Another device with the same DevAddr and NwkSKey
+	other := testABPDevice(LoRaWAN1_0_2)
+	other.DevEUI++
+	if _, err := provisioner.Provision(other); err != ErrDuplicateABPSession {
+		t.Errorf("Provision with a duplicate DevAddr and key\n   got: %v\n  want: %v", err, ErrDuplicateABPSession)
+	}
+	// The same DevAddr with another NwkSKey can be resolved
+	other.NwkSKey = sessionAppSKey
+	if _, err := provisioner.Provision(other); err != nil {
+		t.Errorf("Provision with a shared DevAddr failed: %s", err)
+	}
+
+	other.DevEUI++
+	other.DevAddr = 0x28011234
+	if _, err := provisioner.Provision(other); err != ErrDevAddrNotInNetID {
+		t.Errorf("Provision outside the NetID\n   got: %v\n  want: %v", err, ErrDevAddrNotInNetID)
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+// Defaults of the ClassicADRAlgorithm
+const (
+	DefaultADRHistoryLength      = 20
+	DefaultADRInstallationMargin = 15 // dB
+)
+
+// adrStep is the SNR margin per data rate or TX power step in dB
+const adrStep = 3
+
+// requiredSNR is the SNR in dB that is required to demodulate a LoRa
+// transmission, indexed by spreading factor
+var requiredSNR = map[int]float64{
+	7:  -7.5,
+	8:  -10,
+	9:  -12.5,
+	10: -15,
+	11: -17.5,
+	12: -20,
+}
+
+// ADRHistoryEntry contains the link quality of an uplink message
+type ADRHistoryEntry struct {
+	FCnt       uint32  `json:"f_cnt"`
+	MaxSNR     float64 `json:"max_snr"` // The best SNR of all gateways in dB
+	Gateways   int     `json:"gateways"`
+	NbTrans    int     `json:"nb_trans"`   // The NbTrans of the device when it sent the message
+	Receptions int     `json:"receptions"` // The number of received transmissions, including retransmissions
+}
+
+// recordRetransmission counts a received retransmission of the last uplink
+// message in the ADR history. It returns false if the message is not in the
+// history.
+func (session *DeviceSession) recordRetransmission(fCnt uint32) bool {
+	if len(session.ADRHistory) == 0 {
+		return false
+	}
+	last := &session.ADRHistory[len(session.ADRHistory)-1]
+	if last.FCnt != fCnt {
+		return false
+	}
+	last.Receptions++
+	return true
+}
+
+// ADRSettings contains the transmission settings that ADR controls
+type ADRSettings struct {
+	DataRate int `json:"data_rate"`
+	TXPower  int `json:"tx_power"`
+	NbTrans  int `json:"nb_trans"`
+}
+
+// ADRAlgorithm decides on the transmission settings of a device
+type ADRAlgorithm interface {
+	// HistoryLength returns the number of uplink messages to keep in the
+	// ADRHistory of the session
+	HistoryLength() int
+
+	// Adapt returns the settings that the device should use
+	Adapt(region *Region, session *DeviceSession) (ADRSettings, error)
+}
+
+// currentADRSettings returns the settings that the device uses
+func currentADRSettings(session *DeviceSession) ADRSettings {
+	settings := ADRSettings{DataRate: session.DataRate, TXPower: session.TXPower, NbTrans: session.NbTrans}
+	if settings.NbTrans == 0 {
+		settings.NbTrans = 1
+	}
+	return settings
+}
+
+// maxADRDataRate returns the highest LoRa data rate with the same bandwidth as
+// the data rate that the device uses, that is allowed on the uplink channels
+func maxADRDataRate(region *Region, current DataRate) int {
+	maxDR := 0
+	for _, channel := range region.UplinkChannels {
+		for dr := channel.MinDR; dr <= channel.MaxDR; dr++ {
+			dataRate, err := region.DataRate(dr)
+			if err != nil || dataRate.Modulation != ModulationLoRa || dataRate.Bandwidth != current.Bandwidth {
+				continue
+			}
+			if dr > maxDR {
+				maxDR = dr
+			}
+		}
+	}
+	return maxDR
+}
+
+/* ClassicADRAlgorithm Implementations */
+
+// ClassicADRAlgorithm is the ADRAlgorithm that is recommended by Semtech. It
+// compares the best SNR of the recent uplink messages with the SNR that the
+// data rate requires, and uses every 3 dB of margin to increase the data
+// rate or, at the highest data rate, to decrease the TX power. A negative
+// margin increases the TX power.
+type ClassicADRAlgorithm struct {
+	History            int     // Defaults to DefaultADRHistoryLength
+	InstallationMargin float64 // dB, defaults to DefaultADRInstallationMargin
+}
+
+// HistoryLength implements ADRAlgorithm
+func (algorithm *ClassicADRAlgorithm) HistoryLength() int {
+	if algorithm.History == 0 {
+		return DefaultADRHistoryLength
+	}
+	return algorithm.History
+}
+
+// installationMargin returns the configured or the default installation margin
+func (algorithm *ClassicADRAlgorithm) installationMargin() float64 {
+	if algorithm.InstallationMargin == 0 {
+		return DefaultADRInstallationMargin
+	}
+	return algorithm.InstallationMargin
+}
+
+// Adapt implements ADRAlgorithm
+func (algorithm *ClassicADRAlgorithm) Adapt(region *Region, session *DeviceSession) (ADRSettings, error) {
+	settings := currentADRSettings(session)
+
+	history := session.ADRHistory
+	if len(history) < algorithm.HistoryLength() {
+		return settings, nil
+	}
+	history = history[len(history)-algorithm.HistoryLength():]
+
+	dataRate, err := region.DataRate(settings.DataRate)
+	if err != nil {
+		return settings, err
+	}
+	required, ok := requiredSNR[dataRate.SpreadingFactor]
+	if dataRate.Modulation != ModulationLoRa || !ok {
+		return settings, nil
+	}
+
+	maxSNR := history[0].MaxSNR
+	for _, entry := range history[1:] {
+		if entry.MaxSNR > maxSNR {
+			maxSNR = entry.MaxSNR
+		}
+	}
+	steps := int((maxSNR - required - algorithm.installationMargin()) / adrStep)
+
+	maxDR := maxADRDataRate(region, dataRate)
+	maxTXPower := len(region.TXPowerOffsets) - 1
+	for steps > 0 && settings.DataRate < maxDR {
+		settings.DataRate++
+		steps--
+	}
+	for steps > 0 && settings.TXPower < maxTXPower {
+		settings.TXPower++
+		steps--
+	}
+	for steps < 0 && settings.TXPower > 0 {
+		settings.TXPower--
+		steps++
+	}
+	return settings, nil
+}
+
+/* ADREngine Implementations */
+
+// ADREngine is an ADRHandler that keeps the link quality history of devices
+// and sends LinkADRReqs with the settings of an ADRAlgorithm. The settings are
+// applied to the session when the device acknowledges them.
+type ADREngine struct {
+	Region    *Region
+	Algorithm ADRAlgorithm // Defaults to a ClassicADRAlgorithm
+
+	// ADRParamSetup is sent to LoRaWAN 1.1 devices that do not use its
+	// ADR_ACK_LIMIT and ADR_ACK_DELAY yet
+	ADRParamSetup *ADRParamSetupReq
+}
+
+// algorithm returns the configured or the default ADRAlgorithm
+func (engine *ADREngine) algorithm() ADRAlgorithm {
+	if engine.Algorithm == nil {
+		return &ClassicADRAlgorithm{}
+	}
+	return engine.Algorithm
+}
+
+// handleAnswers handles the LinkADRAns and ADRParamSetupAns of the device.
+// The pending settings are applied if the device acknowledged them. The device
+// answers in the first uplink message after the LinkADRReq, so pending
+// settings are dropped if the answer is missing.
+func (engine *ADREngine) handleAnswers(ctx *UplinkContext) error {
+	session := ctx.Session
+	macCommands, err := ctx.Uplink.MACCommands()
+	if err != nil {
+		return err
+	}
+
+	pending := session.PendingADR
+	session.PendingADR = nil
+	answered, acknowledged := false, true
+	for _, macCommand := range macCommands {
+		switch macCommand.CID {
+		case CIDLinkADR:
+			ans, err := ParseLinkADRAns(macCommand)
+			if err != nil {
+				return err
+			}
+			answered = true
+			acknowledged = acknowledged && ans.ACK()
+		case CIDADRParamSetup:
+			if engine.ADRParamSetup != nil {
+				session.ADRAckLimit, session.ADRAckDelay = int(engine.ADRParamSetup.Limit()), int(engine.ADRParamSetup.Delay())
+			}
+		}
+	}
+	if pending != nil && answered && acknowledged {
+		session.DataRate, session.TXPower, session.NbTrans = pending.DataRate, pending.TXPower, pending.NbTrans
+	}
+	return nil
+}
+
+// record adds the link quality of the uplink message to the history
+func (engine *ADREngine) record(ctx *UplinkContext) {
+	session := ctx.Session
+	if len(ctx.RXInfo) == 0 {
+		return
+	}
+	entry := ADRHistoryEntry{
+		FCnt:       ctx.Uplink.FCnt,
+		MaxSNR:     ctx.RXInfo[0].SNR,
+		Gateways:   len(ctx.RXInfo),
+		NbTrans:    currentADRSettings(session).NbTrans,
+		Receptions: 1,
+	}
+	for _, rxInfo := range ctx.RXInfo[1:] {
+		if rxInfo.SNR > entry.MaxSNR {
+			entry.MaxSNR = rxInfo.SNR
+		}
+	}
+	session.DataRate = ctx.RXInfo[0].DataRate
+	session.ADRHistory = append(session.ADRHistory, entry)
+	if excess := len(session.ADRHistory) - engine.algorithm().HistoryLength(); excess > 0 {
+		session.ADRHistory = append([]ADRHistoryEntry{}, session.ADRHistory[excess:]...)
+	}
+}
+
+// HandleADR implements ADRHandler
+func (engine *ADREngine) HandleADR(ctx *UplinkContext) ([]MACCommand, error) {
+	if err := engine.handleAnswers(ctx); err != nil {
+		return nil, err
+	}
+	engine.record(ctx)
+
+	session := ctx.Session
+	var macCommands []MACCommand
+	if setup := engine.ADRParamSetup; setup != nil && session.MACVersion.is11() {
+		if limit, delay := session.ADRAckParams(engine.Region); limit != int(setup.Limit()) || delay != int(setup.Delay()) {
+			macCommands = append(macCommands, setup.MACCommand())
+		}
+	}
+
+	settings, err := engine.algorithm().Adapt(engine.Region, session)
+	if err != nil {
+		return nil, err
+	}
+	if settings != currentADRSettings(session) {
+		session.PendingADR = &settings
+		macCommands = append(macCommands, LinkADRReqs(engine.Region, session, settings)...)
+	}
+	return macCommands, nil
+}
+
+// LinkADRReqs returns the LinkADRReq MAC commands that set the channel mask of
+// the session and the settings. Channel masks of more than 16 channels are
+// sent in consecutive blocks, of which the device applies the settings of the
+// last one.
+func LinkADRReqs(region *Region, session *DeviceSession, settings ADRSettings) []MACCommand {
+	channelMask := session.ChannelMask
+	if channelMask == nil {
+		channelMask = make([]bool, len(region.UplinkChannels))
+		for i := range channelMask {
+			channelMask[i] = true
+		}
+	}
+
+	var macCommands []MACCommand
+	for block := 0; block == 0 || block*16 < len(channelMask); block++ {
+		req := &LinkADRReq{
+			DataRate:   uint8(settings.DataRate),
+			TXPower:    uint8(settings.TXPower),
+			ChMaskCntl: uint8(block),
+			NbTrans:    uint8(settings.NbTrans),
+		}
+		for i := 0; i < 16 && block*16+i < len(channelMask); i++ {
+			if channelMask[block*16+i] {
+				req.ChMask |= 1 << uint(i)
+			}
+		}
+		macCommands = append(macCommands, req.MACCommand())
+	}
+	return macCommands
+}
@@ -0,0 +1,97 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+// ADRAckParams returns the ADR_ACK_LIMIT and ADR_ACK_DELAY of the session,
+// which are the defaults of the region unless they were changed with an
+// ADRParamSetupReq
+func (session *DeviceSession) ADRAckParams(region *Region) (limit int, delay int) {
+	limit, delay = region.ADRAckLimit, region.ADRAckDelay
+	if session.ADRAckLimit > 0 {
+		limit = session.ADRAckLimit
+	}
+	if session.ADRAckDelay > 0 {
+		delay = session.ADRAckDelay
+	}
+	return limit, delay
+}
+
+// minUplinkDataRate returns the lowest data rate of the uplink channels
+func minUplinkDataRate(region *Region) int {
+	minDR := -1
+	for _, channel := range region.UplinkChannels {
+		if minDR == -1 || channel.MinDR < minDR {
+			minDR = channel.MinDR
+		}
+	}
+	if minDR == -1 {
+		return 0
+	}
+	return minDR
+}
+
+/* ADRBackoff Implementations */
+
+// ADRBackoff implements the ADR backoff of a device. When the device receives
+// no downlink message for ADR_ACK_LIMIT uplink messages, it sets ADRACKReq.
+// Every ADR_ACK_DELAY uplink messages without answer after that, it takes a
+// step to regain connectivity: first it uses the default TX power, then it
+// lowers the data rate, and finally it enables the default channels again.
+// See Section 4.3.1.1 of the LoRaWan Specification
+type ADRBackoff struct {
+	Counter int `json:"adr_ack_cnt"` // ADR_ACK_CNT
+}
+
+// atDefaults returns true if the device can not back off any further
+func (backoff *ADRBackoff) atDefaults(region *Region, session *DeviceSession) bool {
+	if session.TXPower > 0 || session.DataRate > minUplinkDataRate(region) {
+		return false
+	}
+	for i := 0; i < len(region.UplinkChannels) && i < len(session.ChannelMask); i++ {
+		if !session.ChannelMask[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// step takes the next step to regain connectivity
+func (backoff *ADRBackoff) step(region *Region, session *DeviceSession) {
+	switch {
+	case session.TXPower > 0:
+		session.TXPower = 0
+	case session.DataRate > minUplinkDataRate(region):
+		session.DataRate--
+	default:
+		for i := 0; i < len(region.UplinkChannels) && i < len(session.ChannelMask); i++ {
+			session.ChannelMask[i] = true
+		}
+		session.NbTrans = 1
+	}
+}
+
+// Uplink is called before every uplink message of the device. It applies
+// the backoff to the session and returns whether the uplink message should
+// set ADRACKReq.
+func (backoff *ADRBackoff) Uplink(region *Region, session *DeviceSession) bool {
+	if !session.ADR {
+		return false
+	}
+	limit, delay := session.ADRAckParams(region)
+	count := backoff.Counter
+	backoff.Counter++
+	if count < limit {
+		return false
+	}
+	if over := count - limit; over > 0 && delay > 0 && over%delay == 0 {
+		backoff.step(region, session)
+	}
+	return !backoff.atDefaults(region, session)
+}
+
+// Downlink is called when the device receives a downlink message
+func (backoff *ADRBackoff) Downlink() {
+	backoff.Counter = 0
+}
@@ -0,0 +1,81 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import "testing"
+
+/* ADRBackoff Tests */
+
+func TestADRBackoff(t *testing.T) {
+	region, _ := GetRegion("EU868", RP002_1_0_3)
+	session := testSession(LoRaWAN1_0_2)
+	session.ADR = true
+	session.DataRate = 5
+	session.TXPower = 3
+	session.ChannelMask = []bool{true, false, true, true}
+
+	backoff := &ADRBackoff{}
+	var adrAckReqs []int
+	for i := 0; i < 400; i++ {
+		if backoff.Uplink(region, session) {
+			adrAckReqs = append(adrAckReqs, i)
+		}
+		switch i {
+		case 95:
+			if session.TXPower != 3 || session.DataRate != 5 {
+				t.Errorf("Backoff before ADR_ACK_LIMIT + ADR_ACK_DELAY\n   got: %#v", session)
+			}
+		case 96:
+			if session.TXPower != 0 || session.DataRate != 5 {
+				t.Errorf("Backoff should first use the default TX power\n   got: TXPower %d, DataRate %d", session.TXPower, session.DataRate)
+			}
+		case 128:
+			if session.DataRate != 4 {
+				t.Errorf("Backoff should then lower the data rate\n   got: %d\n  want: 4", session.DataRate)
+			}
+		case 256:
+			if session.DataRate != 0 || session.ChannelMask[1] {
+				t.Errorf("Backoff at the lowest data rate\n   got: %#v", session)
+			}
+		case 288:
+			if !session.ChannelMask[1] || !session.ChannelMask[3] {
+				t.Errorf("Backoff should finally enable the default channels\n   got: %#v", session.ChannelMask)
+			}
+		}
+	}
+	if len(adrAckReqs) != 288-64 || adrAckReqs[0] != 64 {
+		t.Errorf("ADRACKReq should be set from ADR_ACK_LIMIT until the defaults are used\n   got: %d times from %d", len(adrAckReqs), adrAckReqs[0])
+	}
+
+	// A downlink message resets ADR_ACK_CNT
+	session.DataRate = 5
+	backoff.Downlink()
+	if backoff.Uplink(region, session) || backoff.Counter != 1 {
+		t.Errorf("ADRACKReq after a downlink message")
+	}
+}
+
+func TestDeviceSessionADRAckParams(t *testing.T) {
+	region, _ := GetRegion("EU868", RP002_1_0_3)
+	session := testSession(LoRaWAN1_1)
+	if limit, delay := session.ADRAckParams(region); limit != 64 || delay != 32 {
+		t.Errorf("ADRAckParams of the region\n   got: %d, %d\n  want: 64, 32", limit, delay)
+	}
+
+	engine := &ADREngine{Region: region, ADRParamSetup: &ADRParamSetupReq{LimitExp: 4, DelayExp: 3}}
+	ctx := &UplinkContext{Session: session, Uplink: &Uplink{ADR: true}}
+	macCommands, _ := engine.HandleADR(ctx)
+	if len(macCommands) != 1 || macCommands[0].CID != CIDADRParamSetup {
+		t.Fatalf("HandleADR should send ADRParamSetupReq\n   got: %#v", macCommands)
+	}
+
+	ctx.Uplink.FOpts = []byte{CIDADRParamSetup}
+	if macCommands, _ := engine.HandleADR(ctx); len(macCommands) != 0 {
+		t.Errorf("HandleADR after ADRParamSetupAns\n   got: %#v", macCommands)
+	}
+	if limit, delay := session.ADRAckParams(region); limit != 16 || delay != 8 {
+		t.Errorf("ADRAckParams after ADRParamSetupAns\n   got: %d, %d\n  want: 16, 8", limit, delay)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import "math"
+
+// Defaults of the LossADRAlgorithm
+const (
+	DefaultLossADRHistoryLength = 32
+	DefaultADRTargetLoss        = 0.05
+	DefaultADRMaxNbTrans        = 3
+)
+
+// PacketLoss returns the estimated fraction of transmissions that the network
+// did not receive, from the gaps in the frame counters and the received
+// retransmissions in the history. Only the most recent entries with the same
+// NbTrans are used, ok is false if there are less than minEntries of them.
+func PacketLoss(history []ADRHistoryEntry, minEntries int) (loss float64, ok bool) {
+	if len(history) == 0 {
+		return 0, false
+	}
+	last := history[len(history)-1]
+	first := len(history) - 1
+	for first > 0 && history[first-1].NbTrans == last.NbTrans {
+		first--
+	}
+	history = history[first:]
+	if len(history) < minEntries || len(history) == 0 {
+		return 0, false
+	}
+
+	nbTrans := last.NbTrans
+	if nbTrans < 1 {
+		nbTrans = 1
+	}
+	frames := float64(last.FCnt-history[0].FCnt) + 1
+	var receptions int
+	for _, entry := range history {
+		receptions += entry.Receptions
+	}
+	loss = 1 - float64(receptions)/(frames*float64(nbTrans))
+	return math.Max(0, math.Min(1, loss)), true
+}
+
+/* LossADRAlgorithm Implementations */
+
+// LossADRAlgorithm is an ADRAlgorithm for links that suffer from interference
+// that the SNR does not show. It uses the ClassicADRAlgorithm for the data
+// rate and TX power, and estimates the packet loss to choose the lowest
+// NbTrans with which the expected loss of a frame is within the target. While
+// the frame loss is above the target even with the maximum NbTrans, it does
+// not make the link less robust by increasing the data rate or decreasing the
+// TX power.
+type LossADRAlgorithm struct {
+	ClassicADRAlgorithm
+
+	TargetLoss float64 // The acceptable fraction of lost frames, defaults to DefaultADRTargetLoss
+	MaxNbTrans int     // Defaults to DefaultADRMaxNbTrans
+}
+
+// HistoryLength implements ADRAlgorithm
+func (algorithm *LossADRAlgorithm) HistoryLength() int {
+	if algorithm.History == 0 {
+		return DefaultLossADRHistoryLength
+	}
+	return algorithm.History
+}
+
+// targetLoss returns the configured or the default target loss
+func (algorithm *LossADRAlgorithm) targetLoss() float64 {
+	if algorithm.TargetLoss == 0 {
+		return DefaultADRTargetLoss
+	}
+	return algorithm.TargetLoss
+}
+
+// maxNbTrans returns the configured or the default maximum NbTrans
+func (algorithm *LossADRAlgorithm) maxNbTrans() int {
+	if algorithm.MaxNbTrans == 0 {
+		return DefaultADRMaxNbTrans
+	}
+	return algorithm.MaxNbTrans
+}
+
+// nbTrans returns the NbTrans for the packet loss. A lower NbTrans than the
+// current one is only chosen when it reaches half the target loss, to avoid
+// changing back and forth because of estimation noise.
+func (algorithm *LossADRAlgorithm) nbTrans(loss float64, current int) int {
+	target := algorithm.targetLoss()
+	for nbTrans := 1; nbTrans < algorithm.maxNbTrans(); nbTrans++ {
+		frameLoss := math.Pow(loss, float64(nbTrans))
+		if frameLoss <= target && (nbTrans >= current || frameLoss <= target/2) {
+			return nbTrans
+		}
+	}
+	return algorithm.maxNbTrans()
+}
+
+// Adapt implements ADRAlgorithm
+func (algorithm *LossADRAlgorithm) Adapt(region *Region, session *DeviceSession) (ADRSettings, error) {
+	current := currentADRSettings(session)
+	loss, ok := PacketLoss(session.ADRHistory, algorithm.HistoryLength())
+	if !ok {
+		return current, nil
+	}
+
+	classic := algorithm.ClassicADRAlgorithm
+	classic.History = algorithm.HistoryLength()
+	settings, err := classic.Adapt(region, session)
+	if err != nil {
+		return current, err
+	}
+
+	settings.NbTrans = algorithm.nbTrans(loss, current.NbTrans)
+	if math.Pow(loss, float64(settings.NbTrans)) > algorithm.targetLoss() {
+		if settings.DataRate > current.DataRate {
+			settings.DataRate = current.DataRate
+		}
+		if settings.TXPower > current.TXPower {
+			settings.TXPower = current.TXPower
+		}
+	}
+	return settings, nil
+}
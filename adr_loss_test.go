@@ -0,0 +1,105 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+/* LossADRAlgorithm Tests */
+
+func TestPacketLoss(t *testing.T) {
+	history := []ADRHistoryEntry{
+		{FCnt: 0, NbTrans: 1, Receptions: 1},
+		{FCnt: 1, NbTrans: 2, Receptions: 2},
+		{FCnt: 2, NbTrans: 2, Receptions: 1},
+		{FCnt: 5, NbTrans: 2, Receptions: 1},
+	}
+	// 10 transmissions of frames 1 to 5 with NbTrans 2, 4 received
+	if loss, ok := PacketLoss(history, 3); !ok || math.Abs(loss-0.6) > 1e-9 {
+		t.Errorf("PacketLoss\n   got: %f, %v\n  want: 0.6, true", loss, ok)
+	}
+	if _, ok := PacketLoss(history, 4); ok {
+		t.Errorf("PacketLoss should ignore entries with another NbTrans")
+	}
+}
+
+// simulateLossADR simulates a device that sends frames over a link with the
+// packet loss and the SNR, with an ADREngine on the network side. It returns
+// the NbTrans of the session after every received frame.
+func simulateLossADR(region *Region, engine *ADREngine, loss float64, snr float64, frames int, rng *rand.Rand) (*DeviceSession, []int) {
+	session := testSession(LoRaWAN1_0_2)
+	session.ADR = true
+	device := currentADRSettings(session)
+
+	var answer []byte // The device answers the LinkADRReq until it is received
+	var nbTrans []int
+	for fCnt := uint32(0); fCnt < uint32(frames); fCnt++ {
+		received := 0
+		for i := 0; i < device.NbTrans; i++ {
+			if rng.Float64() >= loss {
+				received++
+			}
+		}
+		if received == 0 {
+			continue
+		}
+
+		ctx := &UplinkContext{
+			Session: session,
+			Uplink:  &Uplink{FCnt: fCnt, ADR: true, FOpts: answer},
+			RXInfo:  []RXInfo{{SNR: snr, DataRate: device.DataRate}},
+		}
+		macCommands, _ := engine.HandleADR(ctx)
+		for i := 1; i < received; i++ {
+			session.recordRetransmission(fCnt)
+		}
+
+		answer = nil
+		if len(macCommands) > 0 {
+			req, _ := ParseLinkADRReq(macCommands[len(macCommands)-1])
+			device = ADRSettings{DataRate: int(req.DataRate), TXPower: int(req.TXPower), NbTrans: int(req.NbTrans)}
+			ans := (&LinkADRAns{true, true, true}).MACCommand()
+			answer = ans.Bytes()
+		}
+		nbTrans = append(nbTrans, session.NbTrans)
+	}
+	return session, nbTrans
+}
+
+func TestLossADRAlgorithmConvergence(t *testing.T) {
+	region, _ := GetRegion("EU868", RP002_1_0_3)
+	tests := []struct {
+		loss     float64
+		nbTrans  int
+		dataRate int
+	}{
+		{0, 1, 5},
+		{0.12, 2, 5},
+		{0.3, 3, 5},
+		{0.6, 3, 0}, // The target can not be reached, the data rate is not increased
+	}
+	for _, test := range tests {
+		engine := &ADREngine{Region: region, Algorithm: &LossADRAlgorithm{}}
+		session, nbTrans := simulateLossADR(region, engine, test.loss, 10, 4000, rand.New(rand.NewSource(42)))
+
+		// After convergence the NbTrans should be stable
+		var converged int
+		recent := nbTrans[len(nbTrans)/2:]
+		for _, n := range recent {
+			if n == test.nbTrans {
+				converged++
+			}
+		}
+		if float64(converged) < 0.9*float64(len(recent)) {
+			t.Errorf("NbTrans at %.0f%% loss\n   got: %d of %d uplinks at NbTrans %d", test.loss*100, converged, len(recent), test.nbTrans)
+		}
+		if session.DataRate != test.dataRate {
+			t.Errorf("DataRate at %.0f%% loss\n   got: %d\n  want: %d", test.loss*100, session.DataRate, test.dataRate)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testADRHistory returns a history of n uplink messages with the SNR
+func testADRHistory(n int, snr float64) []ADRHistoryEntry {
+	history := make([]ADRHistoryEntry, n)
+	for i := range history {
+		history[i] = ADRHistoryEntry{FCnt: uint32(i), MaxSNR: snr, Gateways: 1}
+	}
+	return history
+}
+
+/* ClassicADRAlgorithm Tests */
+
+func TestClassicADRAlgorithm(t *testing.T) {
+	eu868, _ := GetRegion("EU868", RP002_1_0_3)
+	us915, _ := GetRegion("US915", RP002_1_0_3)
+	algorithm := &ClassicADRAlgorithm{}
+
+	tests := []struct {
+		region   *Region
+		current  ADRSettings
+		history  []ADRHistoryEntry
+		expected ADRSettings
+	}{
+		// Not enough history
+		{eu868, ADRSettings{0, 0, 1}, testADRHistory(19, 5), ADRSettings{0, 0, 1}},
+		// 5 - -20 - 15 = 10 dB margin, 3 steps
+		{eu868, ADRSettings{0, 0, 1}, testADRHistory(20, 5), ADRSettings{3, 0, 1}},
+		// 20 - -7.5 - 15 = 12.5 dB margin at the highest data rate, 4 steps
+		{eu868, ADRSettings{5, 0, 1}, testADRHistory(20, 20), ADRSettings{5, 4, 1}},
+		// Negative margin increases the TX power
+		{eu868, ADRSettings{0, 3, 1}, testADRHistory(20, -30), ADRSettings{0, 0, 1}},
+		// US915 DR0 is SF10, 20 - -15 - 15 = 20 dB margin, without stepping from 125 kHz to 500 kHz
+		{us915, ADRSettings{0, 0, 1}, testADRHistory(20, 20), ADRSettings{3, 3, 1}},
+	}
+	for _, test := range tests {
+		session := &DeviceSession{DataRate: test.current.DataRate, TXPower: test.current.TXPower, NbTrans: test.current.NbTrans, ADRHistory: test.history}
+		settings, err := algorithm.Adapt(test.region, session)
+		if err != nil {
+			t.Fatalf("Adapt failed: %s", err)
+		}
+		if settings != test.expected {
+			t.Errorf("%s Adapt(%#v) with %d uplinks at %.1f dB\n   got: %#v\n  want: %#v", test.region.Name, test.current, len(test.history), test.history[0].MaxSNR, settings, test.expected)
+		}
+	}
+}
+
+/* ADREngine Tests */
+
+func TestADREngine(t *testing.T) {
+	region, _ := GetRegion("EU868", RP002_1_0_3)
+	engine := &ADREngine{Region: region, Algorithm: &ClassicADRAlgorithm{History: 2}}
+	session := testSession(LoRaWAN1_0_2)
+
+	ctx := &UplinkContext{Session: session, Uplink: &Uplink{FCnt: 1, ADR: true}, RXInfo: []RXInfo{{SNR: 3, DataRate: 0}, {SNR: 5, DataRate: 0}}}
+	if macCommands, _ := engine.HandleADR(ctx); macCommands != nil {
+		t.Errorf("HandleADR without enough history\n   got: %#v", macCommands)
+	}
+
+	ctx.Uplink.FCnt = 2
+	macCommands, err := engine.HandleADR(ctx)
+	if err != nil {
+		t.Fatalf("HandleADR failed: %s", err)
+	}
+	want := []MACCommand{(&LinkADRReq{DataRate: 3, TXPower: 0, ChMask: 0x0007, NbTrans: 1}).MACCommand()}
+	if !reflect.DeepEqual(macCommands, want) {
+		t.Errorf("HandleADR\n   got: %#v\n  want: %#v", macCommands, want)
+	}
+	if len(session.ADRHistory) != 2 || session.ADRHistory[1].MaxSNR != 5 || session.ADRHistory[1].Gateways != 2 {
+		t.Errorf("ADRHistory\n   got: %#v", session.ADRHistory)
+	}
+	if session.PendingADR == nil || session.DataRate != 0 {
+		t.Errorf("HandleADR should keep the settings pending until the device acknowledges them")
+	}
+
+	// The device acknowledges the LinkADRReq
+	ans := (&LinkADRAns{true, true, true}).MACCommand()
+	ctx.Uplink = &Uplink{FCnt: 3, ADR: true, FOpts: ans.Bytes()}
+	ctx.RXInfo = []RXInfo{{SNR: 5, DataRate: 3}}
+	if macCommands, _ := engine.HandleADR(ctx); macCommands != nil {
+		t.Errorf("HandleADR after the acknowledgement\n   got: %#v", macCommands)
+	}
+	if session.DataRate != 3 || session.PendingADR != nil || len(session.ADRHistory) != 2 {
+		t.Errorf("Session after the acknowledgement\n   got: %#v", session)
+	}
+}
+
+func TestLinkADRReqs(t *testing.T) {
+	region, _ := GetRegion("US915", RP002_1_0_3)
+	session := testSession(LoRaWAN1_0_2)
+	session.ChannelMask = make([]bool, 72)
+	for i := 8; i < 16; i++ {
+		session.ChannelMask[i] = true
+	}
+	session.ChannelMask[65] = true
+
+	macCommands := LinkADRReqs(region, session, ADRSettings{DataRate: 3, TXPower: 2, NbTrans: 1})
+	if len(macCommands) != 5 {
+		t.Fatalf("LinkADRReqs for 72 channels\n   got: %d\n  want: 5", len(macCommands))
+	}
+	first, _ := ParseLinkADRReq(macCommands[0])
+	last, _ := ParseLinkADRReq(macCommands[4])
+	if first.ChMask != 0xFF00 || first.ChMaskCntl != 0 || last.ChMask != 0x0002 || last.ChMaskCntl != 4 || last.DataRate != 3 {
+		t.Errorf("LinkADRReqs\n   got: %#v, %#v", first, last)
+	}
+}
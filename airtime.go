@@ -0,0 +1,148 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+/* LoRa Implementations */
+
+// LoRaAirtimeParams contains the radio settings that determine the time on
+// air of a LoRa frame
+type LoRaAirtimeParams struct {
+	SpreadingFactor     int
+	Bandwidth           int // Hz
+	CodingRate          int // 1 (4/5) to 4 (4/8)
+	PreambleLength      int // Symbols
+	ExplicitHeader      bool
+	CRC                 bool
+	LowDataRateOptimize bool
+}
+
+// LoRaWANAirtimeParams returns the LoRaAirtimeParams that LoRaWAN uses for
+// the given spreading factor and bandwidth. Uplink frames have a CRC,
+// downlink frames don't.
+func LoRaWANAirtimeParams(sf int, bandwidth int, uplink bool) LoRaAirtimeParams {
+	symbolTime := math.Pow(2, float64(sf)) / float64(bandwidth)
+	return LoRaAirtimeParams{
+		SpreadingFactor:     sf,
+		Bandwidth:           bandwidth,
+		CodingRate:          1,
+		PreambleLength:      8,
+		ExplicitHeader:      true,
+		CRC:                 uplink,
+		LowDataRateOptimize: symbolTime >= 0.016,
+	}
+}
+
+// LoRaTimeOnAir returns the time on air of a LoRa frame with a PHYPayload of
+// payloadSize bytes
+// See Section 4.1.1.7 of the SX1276 datasheet
+func LoRaTimeOnAir(payloadSize int, params LoRaAirtimeParams) (time.Duration, error) {
+	if params.SpreadingFactor < 6 || params.SpreadingFactor > 12 {
+		return 0, fmt.Errorf("Spreading factor %d not supported", params.SpreadingFactor)
+	}
+	if params.Bandwidth <= 0 {
+		return 0, fmt.Errorf("Bandwidth %d not supported", params.Bandwidth)
+	}
+	if params.CodingRate < 1 || params.CodingRate > 4 {
+		return 0, fmt.Errorf("Coding rate 4/%d not supported", params.CodingRate+4)
+	}
+
+	sf := float64(params.SpreadingFactor)
+	symbolTime := math.Pow(2, sf) / float64(params.Bandwidth)
+	preambleTime := (float64(params.PreambleLength) + 4.25) * symbolTime
+
+	numerator := 8*float64(payloadSize) - 4*sf + 28
+	if params.CRC {
+		numerator += 16
+	}
+	if !params.ExplicitHeader {
+		numerator -= 20
+	}
+	denominator := 4 * sf
+	if params.LowDataRateOptimize {
+		denominator -= 8
+	}
+	payloadSymbols := 8 + math.Max(math.Ceil(numerator/denominator)*float64(params.CodingRate+4), 0)
+	payloadTime := payloadSymbols * symbolTime
+
+	return secondsToDuration(preambleTime + payloadTime), nil
+}
+
+/* FSK Implementations */
+
+// FSKTimeOnAir returns the time on air of a LoRaWAN FSK frame with a
+// PHYPayload of payloadSize bytes. LoRaWAN uses a preamble of 5 bytes, a sync
+// word of 3 bytes, a length byte and a CRC of 2 bytes.
+// See Section 4 of the LoRaWAN Regional Parameters
+func FSKTimeOnAir(payloadSize int, bitRate int) (time.Duration, error) {
+	if bitRate <= 0 {
+		return 0, fmt.Errorf("Bit rate %d not supported", bitRate)
+	}
+	bits := float64(5+3+1+payloadSize+2) * 8
+	return secondsToDuration(bits / float64(bitRate)), nil
+}
+
+/* LR-FHSS Implementations */
+
+// Durations of the parts of a LR-FHSS frame
+const (
+	lrFHSSHeaderDuration   = 233472 * time.Microsecond
+	lrFHSSFragmentDuration = 102400 * time.Microsecond
+)
+
+// LRFHSSTimeOnAir returns the time on air of a LR-FHSS frame with a
+// PHYPayload of payloadSize bytes. The frame starts with 3 (coding rate 1/3)
+// or 2 (coding rate 2/3) header replicas, followed by the payload, a CRC of 2
+// bytes and a tail byte, hopping in fragments of 48 coded bits.
+func LRFHSSTimeOnAir(payloadSize int, codingRate string) (time.Duration, error) {
+	var headers, bytesPerFragment int
+	switch codingRate {
+	case "1/3":
+		headers, bytesPerFragment = 3, 2
+	case "2/3":
+		headers, bytesPerFragment = 2, 4
+	default:
+		return 0, fmt.Errorf("Coding rate %s not supported", codingRate)
+	}
+	fragments := (payloadSize + 3 + bytesPerFragment - 1) / bytesPerFragment
+	return time.Duration(headers)*lrFHSSHeaderDuration + time.Duration(fragments)*lrFHSSFragmentDuration, nil
+}
+
+/* Region Implementations */
+
+// TimeOnAir returns the time on air of a PHYPayload of payloadSize bytes at
+// the data rate index
+func (region *Region) TimeOnAir(dr int, payloadSize int, uplink bool) (time.Duration, error) {
+	dataRate, err := region.DataRate(dr)
+	if err != nil {
+		return 0, err
+	}
+	switch dataRate.Modulation {
+	case ModulationLoRa:
+		return LoRaTimeOnAir(payloadSize, LoRaWANAirtimeParams(dataRate.SpreadingFactor, dataRate.Bandwidth, uplink))
+	case ModulationFSK:
+		return FSKTimeOnAir(payloadSize, dataRate.BitRate)
+	case ModulationLRFHSS:
+		return LRFHSSTimeOnAir(payloadSize, dataRate.CodingRate)
+	default:
+		return 0, fmt.Errorf("Modulation %s not supported", dataRate.Modulation)
+	}
+}
+
+/* PHYPayload Implementations */
+
+// TimeOnAir returns the time on air of the PHYPayload at the data rate index
+func (phyPayload *PHYPayload) TimeOnAir(region *Region, dr int) (time.Duration, error) {
+	return region.TimeOnAir(dr, len(phyPayload.Bytes()), phyPayload.MHDR.uplink())
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(math.Round(seconds * float64(time.Second)))
+}
@@ -0,0 +1,101 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"testing"
+	"time"
+)
+
+/* LoRa Tests */
+
+type LoRaTimeOnAirTest struct {
+	payloadSize int
+	params      LoRaAirtimeParams
+	want        time.Duration
+}
+
+var (
+	loRaTimeOnAirs = []LoRaTimeOnAirTest{
+		{20, LoRaWANAirtimeParams(7, 125000, true), 56576 * time.Microsecond},
+		{51, LoRaWANAirtimeParams(12, 125000, true), 2465792 * time.Microsecond},
+		{13, LoRaWANAirtimeParams(10, 125000, false), 288768 * time.Microsecond},
+		{13, LoRaAirtimeParams{SpreadingFactor: 9, Bandwidth: 125000, CodingRate: 4, PreambleLength: 8}, 181248 * time.Microsecond},
+	}
+)
+
+func TestLoRaTimeOnAir(t *testing.T) {
+	for _, c := range loRaTimeOnAirs {
+		got, err := LoRaTimeOnAir(c.payloadSize, c.params)
+		if err != nil {
+			t.Errorf("LoRaTimeOnAir(%d, %#v) failed: %s", c.payloadSize, c.params, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("LoRaTimeOnAir(%d, %#v)\n   got: %s\n  want: %s", c.payloadSize, c.params, got, c.want)
+		}
+	}
+
+	_, err := LoRaTimeOnAir(20, LoRaAirtimeParams{SpreadingFactor: 13, Bandwidth: 125000, CodingRate: 1})
+	if err == nil {
+		t.Errorf("LoRaTimeOnAir should error on invalid spreading factors")
+	}
+}
+
+/* FSK Tests */
+
+func TestFSKTimeOnAir(t *testing.T) {
+	got, _ := FSKTimeOnAir(20, 50000)
+	if want := 4960 * time.Microsecond; got != want {
+		t.Errorf("FSKTimeOnAir(20, 50000)\n   got: %s\n  want: %s", got, want)
+	}
+}
+
+/* LR-FHSS Tests */
+
+func TestLRFHSSTimeOnAir(t *testing.T) {
+	got, _ := LRFHSSTimeOnAir(21, "1/3")
+	if want := 3*233472*time.Microsecond + 12*102400*time.Microsecond; got != want {
+		t.Errorf("LRFHSSTimeOnAir(21, 1/3)\n   got: %s\n  want: %s", got, want)
+	}
+
+	got, _ = LRFHSSTimeOnAir(21, "2/3")
+	if want := 2*233472*time.Microsecond + 6*102400*time.Microsecond; got != want {
+		t.Errorf("LRFHSSTimeOnAir(21, 2/3)\n   got: %s\n  want: %s", got, want)
+	}
+
+	if _, err := LRFHSSTimeOnAir(21, "4/5"); err == nil {
+		t.Errorf("LRFHSSTimeOnAir should error on invalid coding rates")
+	}
+
+	region, _ := GetRegion("US915", RP002_1_0_3)
+	got, err := region.TimeOnAir(6, 21, true)
+	if err != nil {
+		t.Fatalf("US915.TimeOnAir(6) failed: %s", err)
+	}
+	if want := 2*233472*time.Microsecond + 6*102400*time.Microsecond; got != want {
+		t.Errorf("US915.TimeOnAir(6, 21)\n   got: %s\n  want: %s", got, want)
+	}
+}
+
+/* PHYPayload Tests */
+
+func TestPHYPayloadTimeOnAir(t *testing.T) {
+	region, _ := GetRegion("EU868", RP002_1_0_3)
+	phyPayload := phyPayloads[0].structure
+
+	// 16 bytes downlink, without CRC
+	got, err := phyPayload.TimeOnAir(region, 5)
+	if err != nil {
+		t.Fatalf("TimeOnAir failed: %s", err)
+	}
+	if want := 46336 * time.Microsecond; got != want {
+		t.Errorf("PHYPayload.TimeOnAir(EU868, 5)\n   got: %s\n  want: %s", got, want)
+	}
+
+	if _, err := phyPayload.TimeOnAir(region, 12); err == nil {
+		t.Errorf("PHYPayload.TimeOnAir should error on undefined data rates")
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// maxChannels is the maximum number of channels in dynamic channel plans
+const maxChannels = 16
+
+/* ChannelPlan Implementations */
+
+// ChannelPlanRX2 contains the RX2 settings of a ChannelPlan
+type ChannelPlanRX2 struct {
+	Frequency uint32 `json:"frequency"` // Hz
+	DataRate  int    `json:"data_rate"`
+}
+
+// ChannelPlan contains the channels that devices and gateways use in a region.
+//
+// In regions with a dynamic channel plan (CFListFrequencies), Channels starts
+// with the default channels of the region, followed by the extra channels.
+// In regions with a fixed channel plan (CFListChannelMask), SubBands contains
+// the enabled sub-bands of 8 channels, starting from 1.
+type ChannelPlan struct {
+	Region   string                    `json:"region"`
+	Version  RegionalParametersVersion `json:"regional_parameters_version"`
+	Channels []Channel                 `json:"channels,omitempty"`
+	RX2      ChannelPlanRX2            `json:"rx2"`
+	SubBands []int                     `json:"sub_bands,omitempty"`
+}
+
+// LoadChannelPlan parses a ChannelPlan from JSON and validates it against the
+// limits of its region
+func LoadChannelPlan(data []byte) (*ChannelPlan, *Region, error) {
+	channelPlan := &ChannelPlan{}
+	if err := json.Unmarshal(data, channelPlan); err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse channel plan: %s", err.Error())
+	}
+
+	region, err := GetRegion(channelPlan.Region, channelPlan.Version)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := channelPlan.Validate(region); err != nil {
+		return nil, nil, err
+	}
+
+	return channelPlan, region, nil
+}
+
+// DefaultChannelPlan returns the ChannelPlan of a region without extra channels
+func DefaultChannelPlan(region *Region) *ChannelPlan {
+	channelPlan := &ChannelPlan{
+		Region:  region.Name,
+		Version: region.Version,
+		RX2: ChannelPlanRX2{
+			Frequency: region.RX2Frequency,
+			DataRate:  region.RX2DataRate,
+		},
+	}
+	if region.CFListType == CFListChannelMask {
+		for subBand := 1; subBand <= len(region.UplinkChannels)/9; subBand++ {
+			channelPlan.SubBands = append(channelPlan.SubBands, subBand)
+		}
+	} else {
+		channelPlan.Channels = append([]Channel{}, region.UplinkChannels...)
+	}
+	return channelPlan
+}
+
+// Validate checks the ChannelPlan against the limits of the region
+func (channelPlan *ChannelPlan) Validate(region *Region) error {
+	if regionName(channelPlan.Region) != region.Name {
+		return fmt.Errorf("Channel plan is for %s, not for %s", channelPlan.Region, region.Name)
+	}
+
+	if _, err := region.DataRate(channelPlan.RX2.DataRate); err != nil {
+		return fmt.Errorf("Invalid RX2 data rate: %s", err.Error())
+	}
+	if _, ok := region.SubBand(channelPlan.RX2.Frequency); !ok {
+		return fmt.Errorf("RX2 frequency %d is outside the bands of %s", channelPlan.RX2.Frequency, region.Name)
+	}
+
+	if region.CFListType == CFListChannelMask {
+		if len(channelPlan.Channels) != 0 {
+			return fmt.Errorf("Channels can not be changed in %s, use sub-bands instead", region.Name)
+		}
+		if len(channelPlan.SubBands) == 0 {
+			return fmt.Errorf("Channel plan should enable at least one sub-band")
+		}
+		numSubBands := len(region.UplinkChannels) / 9
+		for _, subBand := range channelPlan.SubBands {
+			if subBand < 1 || subBand > numSubBands {
+				return fmt.Errorf("Sub-band %d not defined in %s", subBand, region.Name)
+			}
+		}
+		return nil
+	}
+
+	if len(channelPlan.SubBands) != 0 {
+		return fmt.Errorf("Sub-bands can not be enabled in %s, use channels instead", region.Name)
+	}
+	if len(channelPlan.Channels) > maxChannels {
+		return fmt.Errorf("Channel plan should have at most %d channels", maxChannels)
+	}
+	if len(channelPlan.Channels) < len(region.UplinkChannels) {
+		return fmt.Errorf("Channel plan should contain the %d default channels of %s", len(region.UplinkChannels), region.Name)
+	}
+	for i, channel := range region.UplinkChannels {
+		if channelPlan.Channels[i] != channel {
+			return fmt.Errorf("Channel %d should be the default channel %d", i, channel.Frequency)
+		}
+	}
+
+	frequencies := make(map[uint32]bool)
+	for i, channel := range channelPlan.Channels {
+		if frequencies[channel.Frequency] {
+			return fmt.Errorf("Channel %d has duplicate frequency %d", i, channel.Frequency)
+		}
+		frequencies[channel.Frequency] = true
+		if _, ok := region.SubBand(channel.Frequency); !ok {
+			return fmt.Errorf("Channel %d has frequency %d outside the bands of %s", i, channel.Frequency, region.Name)
+		}
+		if channel.MinDR > channel.MaxDR {
+			return fmt.Errorf("Channel %d has a minimum data rate above its maximum", i)
+		}
+		for _, dr := range []int{channel.MinDR, channel.MaxDR} {
+			if _, err := region.DataRate(dr); err != nil {
+				return fmt.Errorf("Channel %d has an invalid data rate: %s", i, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// ChannelMask returns which uplink channels of the region are enabled in the
+// ChannelPlan
+func (channelPlan *ChannelPlan) ChannelMask(region *Region) []bool {
+	if region.CFListType != CFListChannelMask {
+		mask := make([]bool, len(channelPlan.Channels))
+		for i := range mask {
+			mask[i] = true
+		}
+		return mask
+	}
+
+	mask := make([]bool, len(region.UplinkChannels))
+	numSubBands := len(region.UplinkChannels) / 9
+	for _, subBand := range channelPlan.SubBands {
+		for i := 0; i < 8; i++ {
+			mask[(subBand-1)*8+i] = true
+		}
+		mask[numSubBands*8+subBand-1] = true
+	}
+	return mask
+}
+
+// CFList returns the CFList for join accept messages
+// See Section 7 of the LoRaWAN Regional Parameters
+func (channelPlan *ChannelPlan) CFList(region *Region) ([]byte, error) {
+	cfList := make([]byte, 16)
+	cfList[15] = byte(region.CFListType)
+
+	if region.CFListType == CFListChannelMask {
+		for i, enabled := range channelPlan.ChannelMask(region) {
+			if enabled {
+				cfList[i/8] |= 1 << uint(i%8)
+			}
+		}
+		return cfList, nil
+	}
+
+	extraChannels := channelPlan.Channels[len(region.UplinkChannels):]
+	if len(extraChannels) > 5 {
+		return nil, fmt.Errorf("CFList can contain at most 5 extra channels, not %d", len(extraChannels))
+	}
+	for i, channel := range extraChannels {
+		freq := channel.Frequency / 100
+		cfList[i*3] = byte(freq)
+		cfList[i*3+1] = byte(freq >> 8)
+		cfList[i*3+2] = byte(freq >> 16)
+	}
+	return cfList, nil
+}
+
+// NewChannelReqs returns the NewChannelReqs that change the current channels
+// of a device into the channels of the ChannelPlan. Default channels are
+// never changed.
+func (channelPlan *ChannelPlan) NewChannelReqs(region *Region, current []Channel) ([]NewChannelReq, error) {
+	if region.CFListType == CFListChannelMask {
+		return nil, fmt.Errorf("NewChannelReq is not supported in %s", region.Name)
+	}
+
+	var reqs []NewChannelReq
+	for i := len(region.UplinkChannels); i < maxChannels; i++ {
+		var want, have Channel
+		if i < len(channelPlan.Channels) {
+			want = channelPlan.Channels[i]
+		}
+		if i < len(current) {
+			have = current[i]
+		}
+		if want == have {
+			continue
+		}
+		reqs = append(reqs, NewChannelReq{
+			ChIndex:   uint8(i),
+			Frequency: want.Frequency,
+			MinDR:     uint8(want.MinDR),
+			MaxDR:     uint8(want.MaxDR),
+		})
+	}
+	return reqs, nil
+}
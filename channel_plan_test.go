@@ -0,0 +1,136 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+/* ChannelPlan Tests */
+
+var (
+	eu868ChannelPlanJSON = []byte(`{
+		"region": "EU868",
+		"regional_parameters_version": "RP002-1.0.3",
+		"channels": [
+			{"frequency": 868100000, "min_dr": 0, "max_dr": 5},
+			{"frequency": 868300000, "min_dr": 0, "max_dr": 5},
+			{"frequency": 868500000, "min_dr": 0, "max_dr": 5},
+			{"frequency": 867100000, "min_dr": 0, "max_dr": 5},
+			{"frequency": 867300000, "min_dr": 0, "max_dr": 5}
+		],
+		"rx2": {"frequency": 869525000, "data_rate": 3}
+	}`)
+	invalidChannelPlansJSON = [][]byte{
+		[]byte(`{"region": "EU868", "regional_parameters_version": "RP002-1.0.3", "rx2": {"frequency": 869525000, "data_rate": 0}}`),
+		[]byte(`{"region": "EU868", "regional_parameters_version": "RP002-1.0.3", "channels": [
+			{"frequency": 868100000, "min_dr": 0, "max_dr": 5},
+			{"frequency": 868300000, "min_dr": 0, "max_dr": 5},
+			{"frequency": 868500000, "min_dr": 0, "max_dr": 5},
+			{"frequency": 915000000, "min_dr": 0, "max_dr": 5}
+		], "rx2": {"frequency": 869525000, "data_rate": 0}}`),
+		[]byte(`{"region": "EU868", "regional_parameters_version": "RP002-1.0.3", "channels": [
+			{"frequency": 868100000, "min_dr": 0, "max_dr": 5},
+			{"frequency": 868300000, "min_dr": 0, "max_dr": 5},
+			{"frequency": 868500000, "min_dr": 0, "max_dr": 5},
+			{"frequency": 867100000, "min_dr": 0, "max_dr": 12}
+		], "rx2": {"frequency": 869525000, "data_rate": 0}}`),
+		[]byte(`{"region": "US915", "regional_parameters_version": "RP002-1.0.3", "sub_bands": [9], "rx2": {"frequency": 923300000, "data_rate": 8}}`),
+		[]byte(`{"region": "US915", "regional_parameters_version": "1.0.1", "sub_bands": [2], "rx2": {"frequency": 923300000, "data_rate": 8}}`),
+	}
+)
+
+func TestLoadChannelPlan(t *testing.T) {
+	channelPlan, region, err := LoadChannelPlan(eu868ChannelPlanJSON)
+	if err != nil {
+		t.Fatalf("LoadChannelPlan failed: %s", err)
+	}
+	if region.Name != "EU868" || region.Version != RP002_1_0_3 {
+		t.Errorf("LoadChannelPlan region\n   got: %s %s\n  want: EU868 RP002-1.0.3", region.Name, region.Version)
+	}
+	if len(channelPlan.Channels) != 5 {
+		t.Errorf("LoadChannelPlan channels\n   got: %d\n  want: %d", len(channelPlan.Channels), 5)
+	}
+
+	data, err := json.Marshal(channelPlan)
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %s", err)
+	}
+	reloaded, _, err := LoadChannelPlan(data)
+	if err != nil {
+		t.Fatalf("LoadChannelPlan(json.Marshal(channelPlan)) failed: %s", err)
+	}
+	if !reflect.DeepEqual(reloaded, channelPlan) {
+		t.Errorf("LoadChannelPlan(json.Marshal(channelPlan))\n   got: %#v\n  want: %#v", reloaded, channelPlan)
+	}
+
+	// Aliases of regions are resolved
+	channelPlan, region, err = LoadChannelPlan([]byte(`{"region": "AS923", "regional_parameters_version": "RP002-1.0.3", "channels": [
+		{"frequency": 923200000, "min_dr": 0, "max_dr": 5},
+		{"frequency": 923400000, "min_dr": 0, "max_dr": 5}
+	], "rx2": {"frequency": 923200000, "data_rate": 2}}`))
+	if err != nil {
+		t.Fatalf("LoadChannelPlan of AS923 failed: %s", err)
+	}
+	if region.Name != "AS923-1" || channelPlan.Region != "AS923" {
+		t.Errorf("LoadChannelPlan of AS923\n   got: %s for %s\n  want: AS923-1 for AS923", region.Name, channelPlan.Region)
+	}
+
+	for _, data := range invalidChannelPlansJSON {
+		if _, _, err := LoadChannelPlan(data); err == nil {
+			t.Errorf("LoadChannelPlan should error on %s", data)
+		}
+	}
+}
+
+func TestChannelPlanCFList(t *testing.T) {
+	channelPlan, region, _ := LoadChannelPlan(eu868ChannelPlanJSON)
+	got, err := channelPlan.CFList(region)
+	if err != nil {
+		t.Fatalf("CFList failed: %s", err)
+	}
+	want := []byte{0x18, 0x4F, 0x84, 0xE8, 0x56, 0x84, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(got, want) {
+		t.Errorf("EU868 CFList\n   got: %#v\n  want: %#v", got, want)
+	}
+
+	us915, _ := GetRegion("US915", RP002_1_0_3)
+	usChannelPlan := DefaultChannelPlan(us915)
+	usChannelPlan.SubBands = []int{2}
+	if err := usChannelPlan.Validate(us915); err != nil {
+		t.Fatalf("Validate failed: %s", err)
+	}
+	got, _ = usChannelPlan.CFList(us915)
+	want = []byte{0x00, 0xFF, 0, 0, 0, 0, 0, 0, 0x02, 0, 0, 0, 0, 0, 0, 0x01}
+	if !bytes.Equal(got, want) {
+		t.Errorf("US915 CFList\n   got: %#v\n  want: %#v", got, want)
+	}
+}
+
+func TestChannelPlanNewChannelReqs(t *testing.T) {
+	channelPlan, region, _ := LoadChannelPlan(eu868ChannelPlanJSON)
+	current := []Channel{
+		region.UplinkChannels[0],
+		region.UplinkChannels[1],
+		region.UplinkChannels[2],
+		{Frequency: 867100000, MinDR: 0, MaxDR: 5},
+		{Frequency: 867500000, MinDR: 0, MaxDR: 5},
+		{Frequency: 867700000, MinDR: 0, MaxDR: 5},
+	}
+	got, err := channelPlan.NewChannelReqs(region, current)
+	if err != nil {
+		t.Fatalf("NewChannelReqs failed: %s", err)
+	}
+	want := []NewChannelReq{
+		{ChIndex: 4, Frequency: 867300000, MinDR: 0, MaxDR: 5},
+		{ChIndex: 5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NewChannelReqs\n   got: %#v\n  want: %#v", got, want)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of the timing-dependent subsystems, such as the
+// deduplication window and the scheduling of downlink messages. The
+// subsystems that take an explicit time, such as the DownlinkScheduler and
+// the DutyCycleTracker, get it from the Clock of their caller.
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+
+	// AfterFunc calls f in its own goroutine after the duration elapsed
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a func that is scheduled by AfterFunc of a Clock
+type Timer interface {
+	// Stop prevents the Timer from firing. It returns false if the Timer
+	// already fired or was stopped.
+	Stop() bool
+}
+
+/* RealClock Implementations */
+
+// RealClock is a Clock that uses the system time
+type RealClock struct{}
+
+// Now implements Clock
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// AfterFunc implements Clock
+func (RealClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+/* FakeClock Implementations */
+
+// fakeTimer is a Timer of a FakeClock
+type fakeTimer struct {
+	clock *FakeClock
+	at    time.Time
+	seq   uint64 // Orders timers that fire at the same time
+	f     func()
+}
+
+// Stop implements Timer
+func (timer *fakeTimer) Stop() bool {
+	clock := timer.clock
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	for i, pending := range clock.timers {
+		if pending == timer {
+			clock.timers = append(clock.timers[:i], clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// FakeClock is a Clock of which the time only moves when it is advanced. The
+// timers fire synchronously in Advance, in the order of their deadlines, so
+// that tests can run scenarios of hours in milliseconds and with the same
+// result every time. It is safe for concurrent use.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	seq    uint64
+	timers []*fakeTimer // Ordered by deadline
+}
+
+// NewFakeClock returns a new FakeClock that starts at the given time
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+// Now implements Clock
+func (clock *FakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+// AfterFunc implements Clock. Unlike the RealClock, f is called from the
+// goroutine that advances the clock past its deadline. A timer with a duration
+// of zero or less fires at the next Advance.
+func (clock *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	clock.seq++
+	timer := &fakeTimer{clock: clock, at: clock.now.Add(d), seq: clock.seq, f: f}
+	index := sort.Search(len(clock.timers), func(i int) bool {
+		return clock.timers[i].at.After(timer.at)
+	})
+	clock.timers = append(clock.timers, nil)
+	copy(clock.timers[index+1:], clock.timers[index:])
+	clock.timers[index] = timer
+	return timer
+}
+
+// Advance moves the time forward by d and fires the timers of which the
+// deadline passed. While a timer fires, Now returns its deadline, and timers
+// that it starts fire in the same Advance if their deadline passed too.
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.mu.Lock()
+	end := clock.now.Add(d)
+	for len(clock.timers) > 0 && !clock.timers[0].at.After(end) {
+		timer := clock.timers[0]
+		clock.timers = clock.timers[1:]
+		if timer.at.After(clock.now) {
+			clock.now = timer.at
+		}
+		clock.mu.Unlock()
+		timer.f()
+		clock.mu.Lock()
+	}
+	clock.now = end
+	clock.mu.Unlock()
+}
+
+// Timers returns the number of timers that did not fire yet
+func (clock *FakeClock) Timers() int {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return len(clock.timers)
+}
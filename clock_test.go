@@ -0,0 +1,82 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+/* RealClock Tests */
+
+func TestRealClock(t *testing.T) {
+	var clock Clock = RealClock{}
+	if since := time.Since(clock.Now()); since < 0 || since > time.Second {
+		t.Errorf("Now of the RealClock differs %s from the system time", since)
+	}
+	fired := make(chan struct{})
+	clock.AfterFunc(time.Millisecond, func() { close(fired) })
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatalf("The timer of the RealClock did not fire")
+	}
+}
+
+/* FakeClock Tests */
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	var fired []string
+	var firedAt []time.Duration
+	record := func(name string) func() {
+		return func() {
+			fired = append(fired, name)
+			firedAt = append(firedAt, clock.Now().Sub(start))
+		}
+	}
+	clock.AfterFunc(2*time.Hour, record("b"))
+	clock.AfterFunc(time.Hour, func() {
+		record("a")()
+		clock.AfterFunc(30*time.Minute, record("nested"))
+	})
+	clock.AfterFunc(2*time.Hour, record("c"))
+	stopped := clock.AfterFunc(90*time.Minute, record("stopped"))
+	clock.AfterFunc(3*time.Hour, record("later"))
+
+	if !stopped.Stop() {
+		t.Errorf("Stop of a pending timer should return true")
+	}
+	if stopped.Stop() {
+		t.Errorf("Stop of a stopped timer should return false")
+	}
+	if clock.Timers() != 4 {
+		t.Errorf("Timers\n   got: %d\n  want: %d", clock.Timers(), 4)
+	}
+
+	clock.Advance(59 * time.Minute)
+	if len(fired) != 0 {
+		t.Errorf("Timers fired before their deadline\n   got: %v", fired)
+	}
+	clock.Advance(2 * time.Hour)
+
+	want := []string{"a", "nested", "b", "c"}
+	if !reflect.DeepEqual(fired, want) {
+		t.Errorf("Order of the timers\n   got: %v\n  want: %v", fired, want)
+	}
+	wantAt := []time.Duration{time.Hour, 90 * time.Minute, 2 * time.Hour, 2 * time.Hour}
+	if !reflect.DeepEqual(firedAt, wantAt) {
+		t.Errorf("Time of the timers\n   got: %v\n  want: %v", firedAt, wantAt)
+	}
+	if now := clock.Now().Sub(start); now != 179*time.Minute {
+		t.Errorf("Now after Advance\n   got: %s\n  want: %s", now, 179*time.Minute)
+	}
+	if clock.Timers() != 1 {
+		t.Errorf("Timers after Advance\n   got: %d\n  want: %d", clock.Timers(), 1)
+	}
+}
@@ -26,12 +26,15 @@ type DataPayload struct {
 	RawFRMPayload []byte
 }
 
-// Bytes returns the binary representation of the DataPayload
+// Bytes returns the binary representation of the DataPayload. The FPort is
+// left out if RawFRMPayload is nil, as it is in parsed messages without port.
 func (dataPayload *DataPayload) Bytes() []byte {
 	dataPayloadbuf := new(bytes.Buffer)
 	dataPayloadbuf.Write(dataPayload.FHDR.Bytes())
-	binary.Write(dataPayloadbuf, binary.LittleEndian, dataPayload.FPort)
-	dataPayloadbuf.Write(dataPayload.RawFRMPayload)
+	if dataPayload.RawFRMPayload != nil {
+		binary.Write(dataPayloadbuf, binary.LittleEndian, dataPayload.FPort)
+		dataPayloadbuf.Write(dataPayload.RawFRMPayload)
+	}
 	return dataPayloadbuf.Bytes()
 }
 
@@ -148,6 +151,13 @@ func ParseFCtrl(data byte) *FCtrl {
 // CryptData encrypts or decrypts the Frame Payload for data messages
 // See Section 4.3.3 of the LoRaWan Specification
 func CryptData(key []byte, data []byte, downlink bool, devAddr uint32, fCnt uint16) ([]byte, error) {
+	return CryptData32(key, data, downlink, devAddr, uint32(fCnt))
+}
+
+// CryptData32 is CryptData with the full 32-bit frame counter, of which the
+// FHDR only contains the 16 least significant bits
+// See Section 4.3.3 of the LoRaWan Specification
+func CryptData32(key []byte, data []byte, downlink bool, devAddr uint32, fCnt uint32) ([]byte, error) {
 	numBlocks := int(math.Ceil(float64(len(data)) / 16)) // really?
 
 	block, err := aes.NewCipher(key)
@@ -161,7 +171,7 @@ func CryptData(key []byte, data []byte, downlink bool, devAddr uint32, fCnt uint
 		ai.Write([]byte{0x01, 0x00, 0x00, 0x00, 0x00})
 		ai.WriteByte(boolToByte(downlink))
 		binary.Write(ai, binary.LittleEndian, devAddr)
-		binary.Write(ai, binary.LittleEndian, uint32(fCnt))
+		binary.Write(ai, binary.LittleEndian, fCnt)
 		ai.WriteByte(0x0)
 		ai.WriteByte(byte(i + 1))
 
@@ -192,49 +202,73 @@ func (dataPayload *DataPayload) Crypt(key []byte, downlink bool) ([]byte, error)
 // CalculateMIC calculates the Message Integrity Code for a data message
 // See Section 4.4 of the LoRaWan Specification
 func (dataPayload *DataPayload) CalculateMIC(mhdr *MHDR, nwkSKey []byte) ([]byte, error) {
+	return dataPayload.CalculateMICWithFCnt(mhdr, nwkSKey, uint32(dataPayload.FHDR.FCnt))
+}
+
+// CalculateMICWithFCnt calculates the Message Integrity Code for a data
+// message with the full 32-bit frame counter, of which FHDR.FCnt contains the
+// 16 least significant bits
+func (dataPayload *DataPayload) CalculateMICWithFCnt(mhdr *MHDR, nwkSKey []byte, fCnt uint32) ([]byte, error) {
 	// msg = MHDR | FHDR | FPORT | FRMPayload
 	msgbuf := new(bytes.Buffer)
 	msgbuf.WriteByte(mhdr.Byte())
 	msgbuf.Write(dataPayload.RawFHDR)
-	msgbuf.WriteByte(dataPayload.FPort)
-	msgbuf.Write(dataPayload.RawFRMPayload)
+	if dataPayload.RawFRMPayload != nil {
+		msgbuf.WriteByte(dataPayload.FPort)
+		msgbuf.Write(dataPayload.RawFRMPayload)
+	}
 	msg := msgbuf.Bytes()
 
-	blocksbuf := new(bytes.Buffer)
-
-	// B0 =  0x49 | 4x 0x00 | Dir (uplink=0x00/downlink=0x01) | DevAddr | FCnt (4 bytes!) | 0x00 | len(msg)
-	blocksbuf.Write([]byte{0x49, 0x0, 0x0, 0x0, 0x0})
-
+	var downlink bool
 	switch mhdr.MType {
 	case macMTypeUnconfirmedDataUp,
 		macMTypeConfirmedDataUp:
-		blocksbuf.WriteByte(0x00)
+		downlink = false
 	case macMTypeUnconfirmedDataDown,
 		macMTypeConfirmedDataDown:
-		blocksbuf.WriteByte(0x01)
+		downlink = true
 	default:
 		return nil, fmt.Errorf("Message direction %#v not is neither up, nor down.", mhdr.MType)
 	}
 
-	binary.Write(blocksbuf, binary.LittleEndian, dataPayload.FHDR.DevAddr)
-	binary.Write(blocksbuf, binary.LittleEndian, uint32(dataPayload.FHDR.FCnt))
-	blocksbuf.WriteByte(0x0)
-	blocksbuf.WriteByte(byte(len(msg)))
-
-	// Append msg to B0
-	blocksbuf.Write(msg)
+	b0 := dataMICBlock(0, 0, 0, downlink, dataPayload.FHDR.DevAddr, fCnt, len(msg))
+	cmac, err := calculateCMAC(nwkSKey, b0, msg)
+	if err != nil {
+		return nil, err
+	}
+	return cmac[0:4], nil
+}
 
-	blocks := blocksbuf.Bytes()
+// dataMICBlock returns the B0 (or B1) block that is prepended to a data message
+// for calculating the MIC. LoRaWAN 1.0 uses zero confFCnt, txDR and txCh.
+// See Section 4.4 of the LoRaWan Specification
+func dataMICBlock(confFCnt uint16, txDR uint8, txCh uint8, downlink bool, devAddr uint32, fCnt uint32, msgLen int) []byte {
+	// B0 =  0x49 | ConfFCnt (2) | TxDr | TxCh | Dir (uplink=0x00/downlink=0x01) | DevAddr | FCnt (4 bytes!) | 0x00 | len(msg)
+	blockbuf := new(bytes.Buffer)
+	blockbuf.WriteByte(0x49)
+	binary.Write(blockbuf, binary.LittleEndian, confFCnt)
+	blockbuf.WriteByte(txDR)
+	blockbuf.WriteByte(txCh)
+	blockbuf.WriteByte(boolToByte(downlink))
+	binary.Write(blockbuf, binary.LittleEndian, devAddr)
+	binary.Write(blockbuf, binary.LittleEndian, fCnt)
+	blockbuf.WriteByte(0x0)
+	blockbuf.WriteByte(byte(msgLen))
+	return blockbuf.Bytes()
+}
 
-	hash, err := cmac.New(nwkSKey)
+// calculateCMAC calculates the AES-CMAC of the concatenation of the blocks
+func calculateCMAC(key []byte, blocks ...[]byte) ([]byte, error) {
+	hash, err := cmac.New(key)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to initialize CMAC: %s", err.Error())
 	}
 
-	_, err = hash.Write(blocks)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to hash data: %s", err.Error())
+	for _, block := range blocks {
+		if _, err := hash.Write(block); err != nil {
+			return nil, fmt.Errorf("Failed to hash data: %s", err.Error())
+		}
 	}
 
-	return hash.Sum([]byte{})[0:4], nil
+	return hash.Sum([]byte{}), nil
 }
@@ -181,6 +181,17 @@ func TestCryptData(t *testing.T) {
 	}
 }
 
+func TestCryptData32(t *testing.T) {
+	plaintext := []byte("hello")
+	low, _ := CryptData(key, plaintext, false, 2882400018, 43981)
+	if same, _ := CryptData32(key, plaintext, false, 2882400018, 43981); !bytes.Equal(same, low) {
+		t.Errorf("CryptData32 should match CryptData for 16-bit counters\n   got: %#v\n  want: %#v", same, low)
+	}
+	if high, _ := CryptData32(key, plaintext, false, 2882400018, 0x10000+43981); bytes.Equal(high, low) {
+		t.Errorf("CryptData32 should use the 16 most significant bits of the counter")
+	}
+}
+
 func TestDataPayloadCrypt(t *testing.T) {
 	plaintext, _ := base64.StdEncoding.DecodeString("WW91IGxvb2sgZ29vZCwgTG9yYQ==")
 	ciphertext, _ := base64.StdEncoding.DecodeString("OWvMQw/Hk9bgJctqyXYhyVIJ9Q==")
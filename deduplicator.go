@@ -0,0 +1,165 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrDeduplicatorFull is returned when the Deduplicator already collects the
+// maximum number of uplink messages
+var ErrDeduplicatorFull = errors.New("The deduplicator is full")
+
+// maxRXInfo is the maximum number of gateways that is collected per uplink message
+const maxRXInfo = 64
+
+// RXInfo contains the metadata of an uplink message received by a gateway
+type RXInfo struct {
+	GatewayID uint64    `json:"gateway_id"`
+	RSSI      int       `json:"rssi"`      // dBm
+	SNR       float64   `json:"snr"`       // dB
+	Timestamp uint32    `json:"timestamp"` // Internal counter of the concentrator in microseconds
+	Time      time.Time `json:"time"`
+	Frequency uint32    `json:"frequency"` // Hz
+	Channel   int       `json:"channel"`   // Index of the uplink channel of the device
+	DataRate  int       `json:"data_rate"`
+}
+
+// DeduplicatedUplink contains an uplink message with the metadata of all
+// gateways that received it, ordered from the best to the worst SNR
+type DeduplicatedUplink struct {
+	PHYPayload []byte   `json:"phy_payload"`
+	RXInfo     []RXInfo `json:"rx_info"`
+}
+
+// TXParams returns the data rate and channel of the uplink message, or nil if
+// no gateway received it
+func (uplink *DeduplicatedUplink) TXParams() *UplinkTXParams {
+	if len(uplink.RXInfo) == 0 {
+		return nil
+	}
+	return &UplinkTXParams{DataRate: uint8(uplink.RXInfo[0].DataRate), Channel: uint8(uplink.RXInfo[0].Channel)}
+}
+
+/* Deduplicator Implementations */
+
+// Deduplicator combines the copies of an uplink message that are received by
+// multiple gateways. The first copy opens a window, after which the combined
+// uplink message is emitted. Copies that arrive within another window after
+// that, such as those of a slow gateway, are dropped instead of emitting the
+// uplink message again. The Deduplicator is safe for concurrent use.
+type Deduplicator struct {
+	clock      Clock
+	window     time.Duration
+	maxPending int
+	emit       func(*DeduplicatedUplink)
+
+	mu      sync.Mutex
+	pending map[string]*DeduplicatedUplink
+	flushed map[string]struct{} // Emitted uplink messages, during the holdoff
+	late    int
+}
+
+// NewDeduplicator returns a new Deduplicator that collects at most maxPending
+// uplink messages at a time, and calls emit from its own goroutine when the
+// window of an uplink message closes
+func NewDeduplicator(window time.Duration, maxPending int, emit func(*DeduplicatedUplink)) *Deduplicator {
+	return NewDeduplicatorWithClock(RealClock{}, window, maxPending, emit)
+}
+
+// NewDeduplicatorWithClock returns a new Deduplicator of which the windows are
+// timed by the clock
+func NewDeduplicatorWithClock(clock Clock, window time.Duration, maxPending int, emit func(*DeduplicatedUplink)) *Deduplicator {
+	return &Deduplicator{
+		clock:      clock,
+		window:     window,
+		maxPending: maxPending,
+		emit:       emit,
+		pending:    make(map[string]*DeduplicatedUplink),
+		flushed:    make(map[string]struct{}),
+	}
+}
+
+// Add adds a copy of an uplink message that was received by a gateway. Copies
+// from a gateway that already received the message, and copies that arrive
+// after the message was emitted, are ignored.
+func (d *Deduplicator) Add(phyPayload []byte, rxInfo RXInfo) error {
+	key := string(phyPayload)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.flushed[key]; ok {
+		d.late++
+		return nil
+	}
+
+	uplink, ok := d.pending[key]
+	if !ok {
+		if len(d.pending) >= d.maxPending {
+			return ErrDeduplicatorFull
+		}
+		uplink = &DeduplicatedUplink{PHYPayload: cloneBytes(phyPayload)}
+		d.pending[key] = uplink
+		d.clock.AfterFunc(d.window, func() { d.flush(key) })
+	}
+
+	if len(uplink.RXInfo) >= maxRXInfo {
+		return nil
+	}
+	for _, existing := range uplink.RXInfo {
+		if existing.GatewayID == rxInfo.GatewayID {
+			return nil
+		}
+	}
+	uplink.RXInfo = append(uplink.RXInfo, rxInfo)
+	return nil
+}
+
+// Pending returns the number of uplink messages of which the window is open
+func (d *Deduplicator) Pending() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.pending)
+}
+
+// Late returns the number of copies that were dropped because they arrived
+// after their uplink message was emitted
+func (d *Deduplicator) Late() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.late
+}
+
+// flush emits the uplink message when its window closes, and holds off late
+// copies for the duration of another window
+func (d *Deduplicator) flush(key string) {
+	d.mu.Lock()
+	uplink := d.pending[key]
+	delete(d.pending, key)
+	if uplink != nil {
+		d.flushed[key] = struct{}{}
+		d.clock.AfterFunc(d.window, func() {
+			d.mu.Lock()
+			delete(d.flushed, key)
+			d.mu.Unlock()
+		})
+	}
+	d.mu.Unlock()
+
+	if uplink == nil {
+		return
+	}
+	sort.SliceStable(uplink.RXInfo, func(i, j int) bool {
+		if uplink.RXInfo[i].SNR != uplink.RXInfo[j].SNR {
+			return uplink.RXInfo[i].SNR > uplink.RXInfo[j].SNR
+		}
+		return uplink.RXInfo[i].RSSI > uplink.RXInfo[j].RSSI
+	})
+	d.emit(uplink)
+}
@@ -0,0 +1,110 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* Deduplicator Tests */
+
+func TestDeduplicator(t *testing.T) {
+	emitted := make(chan *DeduplicatedUplink, 10)
+	d := NewDeduplicator(50*time.Millisecond, 2, func(uplink *DeduplicatedUplink) { emitted <- uplink })
+
+	a := []byte{0x40, 0x01, 0x02}
+	b := []byte{0x40, 0x03, 0x04}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			d.Add(a, RXInfo{GatewayID: uint64(i % 3), SNR: float64(i % 3), RSSI: -100})
+		}(i)
+	}
+	wg.Wait()
+	d.Add(b, RXInfo{GatewayID: 1})
+
+	if err := d.Add([]byte{0x40, 0x05, 0x06}, RXInfo{GatewayID: 1}); err != ErrDeduplicatorFull {
+		t.Errorf("Add to a full deduplicator\n   got: %v\n  want: %v", err, ErrDeduplicatorFull)
+	}
+
+	got := map[string]*DeduplicatedUplink{}
+	for i := 0; i < 2; i++ {
+		select {
+		case uplink := <-emitted:
+			got[string(uplink.PHYPayload)] = uplink
+		case <-time.After(time.Second):
+			t.Fatalf("Deduplicator did not emit the uplink messages")
+		}
+	}
+
+	uplink := got[string(a)]
+	if uplink == nil || !bytes.Equal(uplink.PHYPayload, a) {
+		t.Fatalf("Deduplicator did not emit %x", a)
+	}
+	if len(uplink.RXInfo) != 3 {
+		t.Fatalf("Deduplicator should combine the gateways\n   got: %d\n  want: 3", len(uplink.RXInfo))
+	}
+	if uplink.RXInfo[0].GatewayID != 2 || uplink.RXInfo[2].GatewayID != 0 {
+		t.Errorf("Deduplicator should order the gateways by SNR\n   got: %#v", uplink.RXInfo)
+	}
+	if len(got[string(b)].RXInfo) != 1 {
+		t.Errorf("Deduplicator should emit every uplink message once")
+	}
+	if d.Pending() != 0 {
+		t.Errorf("Pending after the window\n   got: %d\n  want: 0", d.Pending())
+	}
+}
+
+func TestDeduplicatorFakeClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	var emitted []*DeduplicatedUplink
+	d := NewDeduplicatorWithClock(clock, 200*time.Millisecond, 10, func(uplink *DeduplicatedUplink) { emitted = append(emitted, uplink) })
+
+	d.Add([]byte{0x40, 0x01}, RXInfo{GatewayID: 1})
+	clock.Advance(100 * time.Millisecond)
+	d.Add([]byte{0x40, 0x01}, RXInfo{GatewayID: 2})
+	d.Add([]byte{0x40, 0x02}, RXInfo{GatewayID: 1})
+
+	clock.Advance(100 * time.Millisecond)
+	if len(emitted) != 1 || len(emitted[0].RXInfo) != 2 {
+		t.Fatalf("Emitted after the first window\n   got: %#v", emitted)
+	}
+	if d.Pending() != 1 {
+		t.Errorf("Pending after the first window\n   got: %d\n  want: 1", d.Pending())
+	}
+	clock.Advance(time.Hour)
+	if len(emitted) != 2 || d.Pending() != 0 {
+		t.Errorf("Emitted after the second window\n   got: %#v", emitted)
+	}
+}
+
+func TestDeduplicatorLateCopies(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	var emitted []*DeduplicatedUplink
+	d := NewDeduplicatorWithClock(clock, 200*time.Millisecond, 10, func(uplink *DeduplicatedUplink) { emitted = append(emitted, uplink) })
+
+	d.Add([]byte{0x40, 0x01}, RXInfo{GatewayID: 1})
+	clock.Advance(250 * time.Millisecond)
+
+	// A slow gateway delivers its copy after the window closed
+	d.Add([]byte{0x40, 0x01}, RXInfo{GatewayID: 2})
+	clock.Advance(250 * time.Millisecond)
+	if len(emitted) != 1 || d.Late() != 1 || d.Pending() != 0 {
+		t.Errorf("Late copy\n   got: %d emitted, %d late, %d pending\n  want: 1 emitted, 1 late, 0 pending", len(emitted), d.Late(), d.Pending())
+	}
+
+	// After the holdoff the message is new again, such as a retransmission
+	d.Add([]byte{0x40, 0x01}, RXInfo{GatewayID: 1})
+	clock.Advance(250 * time.Millisecond)
+	if len(emitted) != 2 {
+		t.Errorf("Emitted after the holdoff\n   got: %d\n  want: 2", len(emitted))
+	}
+}
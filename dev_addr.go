@@ -0,0 +1,101 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import "fmt"
+
+// nwkIDBits is the length of the NwkID for each NetID type
+// See Section 13 of the LoRaWAN Backend Interfaces Specification
+var nwkIDBits = [8]uint{6, 6, 9, 11, 12, 13, 15, 17}
+
+// nwkAddrBits returns the length of the NwkAddr for the NetID type, after
+// the prefix and the NwkID
+func nwkAddrBits(netIDType uint8) uint {
+	return 32 - (uint(netIDType) + 1) - nwkIDBits[netIDType]
+}
+
+/* NetID Implementations */
+
+// NetID is the 24-bit identifier of a network. Its 3 most significant bits
+// are the NetID type, its least significant bits are the NwkID that prefixes
+// the DevAddrs of the network.
+type NetID uint32
+
+// Type returns the NetID type
+func (netID NetID) Type() uint8 {
+	return uint8(netID>>21) & 0x7
+}
+
+// NwkID returns the NwkID of the NetID
+func (netID NetID) NwkID() uint32 {
+	return uint32(netID) & (1<<nwkIDBits[netID.Type()] - 1)
+}
+
+// NwkAddrBits returns the number of bits of the DevAddrs of the NetID that
+// are available for devices
+func (netID NetID) NwkAddrBits() uint {
+	return nwkAddrBits(netID.Type())
+}
+
+// DevAddr returns the DevAddr with the NwkAddr in the range of the NetID
+func (netID NetID) DevAddr(nwkAddr uint32) (DevAddr, error) {
+	bits := netID.NwkAddrBits()
+	if nwkAddr >= 1<<bits {
+		return 0, fmt.Errorf("NwkAddr %X does not fit in %d bits", nwkAddr, bits)
+	}
+	prefix := uint32(0xFF) << (8 - netID.Type()) & 0xFF // Type ones followed by a zero
+	return DevAddr(prefix<<24 | netID.NwkID()<<bits | nwkAddr), nil
+}
+
+// Contains returns true if the DevAddr is in the range of the NetID
+func (netID NetID) Contains(devAddr DevAddr) bool {
+	netIDType, ok := devAddr.NetIDType()
+	return ok && netIDType == netID.Type() && devAddr.NwkID() == netID.NwkID()
+}
+
+// String implements fmt.Stringer
+func (netID NetID) String() string {
+	return fmt.Sprintf("%06X", uint32(netID))
+}
+
+/* DevAddr Implementations */
+
+// DevAddr is the 32-bit address of a device in a network. Its most significant
+// bits are a prefix of the NetID type, followed by the NwkID and the NwkAddr.
+type DevAddr uint32
+
+// NetIDType returns the NetID type of the DevAddr, which is the number of
+// leading ones. It returns false if the prefix is invalid.
+func (devAddr DevAddr) NetIDType() (uint8, bool) {
+	for netIDType := uint8(0); netIDType < 8; netIDType++ {
+		if devAddr&(1<<(31-netIDType)) == 0 {
+			return netIDType, true
+		}
+	}
+	return 0, false
+}
+
+// NwkID returns the NwkID of the DevAddr, or 0 if its prefix is invalid
+func (devAddr DevAddr) NwkID() uint32 {
+	netIDType, ok := devAddr.NetIDType()
+	if !ok {
+		return 0
+	}
+	return uint32(devAddr) >> nwkAddrBits(netIDType) & (1<<nwkIDBits[netIDType] - 1)
+}
+
+// NwkAddr returns the NwkAddr of the DevAddr, or 0 if its prefix is invalid
+func (devAddr DevAddr) NwkAddr() uint32 {
+	netIDType, ok := devAddr.NetIDType()
+	if !ok {
+		return 0
+	}
+	return uint32(devAddr) & (1<<nwkAddrBits(netIDType) - 1)
+}
+
+// String implements fmt.Stringer
+func (devAddr DevAddr) String() string {
+	return fmt.Sprintf("%08X", uint32(devAddr))
+}
@@ -0,0 +1,95 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DefaultDevAddrAttempts is the number of random DevAddrs that are tried
+// before allocation fails
+const DefaultDevAddrAttempts = 16
+
+// ErrDevAddrExhausted is returned when no free DevAddr is found
+var ErrDevAddrExhausted = errors.New("No free DevAddr is available")
+
+// DevAddrAllocatorConfig contains the configuration of a DevAddrAllocator
+type DevAddrAllocatorConfig struct {
+	NetID    NetID
+	Sessions DeviceSessionStore
+
+	// Sequential allocates the next free DevAddr instead of a random one
+	Sequential  bool
+	MaxAttempts int        // Defaults to DefaultDevAddrAttempts, only for random allocation
+	Rand        *rand.Rand // Defaults to a source that is seeded with the current time
+}
+
+// DevAddrAllocator allocates DevAddrs in the range of a NetID that are not
+// used by the sessions of other devices. It is safe for concurrent use.
+type DevAddrAllocator struct {
+	config DevAddrAllocatorConfig
+	mu     sync.Mutex
+	next   uint32 // The next NwkAddr for sequential allocation
+}
+
+// NewDevAddrAllocator returns a new DevAddrAllocator
+func NewDevAddrAllocator(config DevAddrAllocatorConfig) *DevAddrAllocator {
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = DefaultDevAddrAttempts
+	}
+	if config.Rand == nil {
+		config.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return &DevAddrAllocator{config: config}
+}
+
+// Allocate returns a free DevAddr for the device. The DevAddr of the current
+// session of the device is free for the device itself. It can be used as the
+// AllocateDevAddr of a JoinServerConfig.
+func (allocator *DevAddrAllocator) Allocate(devEUI uint64) (DevAddr, error) {
+	allocator.mu.Lock()
+	defer allocator.mu.Unlock()
+
+	size := uint64(1) << allocator.config.NetID.NwkAddrBits()
+	if allocator.config.Sequential {
+		for i := uint64(0); i < size; i++ {
+			nwkAddr := allocator.next
+			allocator.next = uint32((uint64(nwkAddr) + 1) % size)
+			if devAddr, free, err := allocator.try(nwkAddr, devEUI); err != nil || free {
+				return devAddr, err
+			}
+		}
+		return 0, ErrDevAddrExhausted
+	}
+
+	for i := 0; i < allocator.config.MaxAttempts; i++ {
+		nwkAddr := uint32(allocator.config.Rand.Int63n(int64(size)))
+		if devAddr, free, err := allocator.try(nwkAddr, devEUI); err != nil || free {
+			return devAddr, err
+		}
+	}
+	return 0, ErrDevAddrExhausted
+}
+
+// try returns the DevAddr of the NwkAddr and whether it is free for the device
+func (allocator *DevAddrAllocator) try(nwkAddr uint32, devEUI uint64) (DevAddr, bool, error) {
+	devAddr, err := allocator.config.NetID.DevAddr(nwkAddr)
+	if err != nil {
+		return 0, false, err
+	}
+	sessions, err := allocator.config.Sessions.GetByDevAddr(uint32(devAddr))
+	if err != nil {
+		return 0, false, err
+	}
+	for _, session := range sessions {
+		if session.DevEUI != devEUI {
+			return devAddr, false, nil
+		}
+	}
+	return devAddr, true, nil
+}
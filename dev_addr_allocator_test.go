@@ -0,0 +1,76 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"math/rand"
+	"testing"
+)
+
+/* DevAddrAllocator Tests */
+
+func TestDevAddrAllocatorSequential(t *testing.T) {
+	netID := NetID(0xE0001F) // 7 bits of NwkAddr
+	sessions := NewMemorySessionStore()
+	allocator := NewDevAddrAllocator(DevAddrAllocatorConfig{NetID: netID, Sessions: sessions, Sequential: true})
+
+	// The first DevAddr is used by another device
+	used, _ := netID.DevAddr(0)
+	sessions.Save(&DeviceSession{DevEUI: 1000, DevAddr: uint32(used)}, nil)
+
+	for devEUI := uint64(1); devEUI < 128; devEUI++ {
+		devAddr, err := allocator.Allocate(devEUI)
+		if err != nil {
+			t.Fatalf("Allocate(%d) failed: %s", devEUI, err)
+		}
+		if want, _ := netID.DevAddr(uint32(devEUI)); devAddr != want {
+			t.Errorf("Allocate(%d)\n   got: %s\n  want: %s", devEUI, devAddr, want)
+		}
+		sessions.Save(&DeviceSession{DevEUI: devEUI, DevAddr: uint32(devAddr)}, nil)
+	}
+
+	if _, err := allocator.Allocate(200); err != ErrDevAddrExhausted {
+		t.Errorf("Allocate in a full range\n   got: %v\n  want: %v", err, ErrDevAddrExhausted)
+	}
+
+	// The DevAddr of the device itself is free for the device
+	devAddr, err := allocator.Allocate(1000)
+	if err != nil || devAddr != used {
+		t.Errorf("Allocate(1000)\n   got: %s, %v\n  want: %s", devAddr, err, used)
+	}
+}
+
+func TestDevAddrAllocatorRandom(t *testing.T) {
+	netID := NetID(0x000013)
+	sessions := NewMemorySessionStore()
+	allocator := NewDevAddrAllocator(DevAddrAllocatorConfig{NetID: netID, Sessions: sessions, Rand: rand.New(rand.NewSource(1))})
+
+	allocated := make(map[DevAddr]bool)
+	for devEUI := uint64(1); devEUI <= 100; devEUI++ {
+		devAddr, err := allocator.Allocate(devEUI)
+		if err != nil {
+			t.Fatalf("Allocate(%d) failed: %s", devEUI, err)
+		}
+		if !netID.Contains(devAddr) {
+			t.Errorf("Allocate(%d) = %s is not in the range of NetID %s", devEUI, devAddr, netID)
+		}
+		if allocated[devAddr] {
+			t.Errorf("Allocate(%d) = %s was already allocated", devEUI, devAddr)
+		}
+		allocated[devAddr] = true
+		sessions.Save(&DeviceSession{DevEUI: devEUI, DevAddr: uint32(devAddr)}, nil)
+	}
+
+	// A full range is exhausted after MaxAttempts
+	netID = NetID(0xE0001F)
+	allocator = NewDevAddrAllocator(DevAddrAllocatorConfig{NetID: netID, Sessions: sessions, MaxAttempts: 4})
+	for nwkAddr := uint32(0); nwkAddr < 128; nwkAddr++ {
+		devAddr, _ := netID.DevAddr(nwkAddr)
+		sessions.Save(&DeviceSession{DevEUI: 1000 + uint64(nwkAddr), DevAddr: uint32(devAddr)}, nil)
+	}
+	if _, err := allocator.Allocate(1); err != ErrDevAddrExhausted {
+		t.Errorf("Allocate in a full range\n   got: %v\n  want: %v", err, ErrDevAddrExhausted)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import "testing"
+
+/* NetID Tests */
+
+type NetIDTest struct {
+	netID       NetID
+	netIDType   uint8
+	nwkID       uint32
+	nwkAddrBits uint
+	nwkAddr     uint32
+	devAddr     DevAddr
+}
+
+var (
+	netIDs = []NetIDTest{
+		{0x000013, 0, 0x13, 25, 0x11234, 0x26011234},
+		{0x200005, 1, 0x05, 24, 0x000001, 0x85000001},
+		{0x4001FF, 2, 0x1FF, 20, 0xFFFFF, 0xDFFFFFFF},
+		{0x600010, 3, 0x10, 17, 0x00002, 0xE0200002},
+		{0x800ABC, 4, 0xABC, 15, 0x0007, 0xF55E0007},
+		{0xA01234, 5, 0x1234, 13, 0x0000, 0xFA468000},
+		{0xC00ABC, 6, 0x0ABC, 10, 0x3FF, 0xFC2AF3FF},
+		{0xE0001F, 7, 0x1F, 7, 0x01, 0xFE000F81},
+	}
+)
+
+func TestNetID(t *testing.T) {
+	for _, c := range netIDs {
+		if got := c.netID.Type(); got != c.netIDType {
+			t.Errorf("%s.Type()\n   got: %d\n  want: %d", c.netID, got, c.netIDType)
+		}
+		if got := c.netID.NwkID(); got != c.nwkID {
+			t.Errorf("%s.NwkID()\n   got: %#x\n  want: %#x", c.netID, got, c.nwkID)
+		}
+		if got := c.netID.NwkAddrBits(); got != c.nwkAddrBits {
+			t.Errorf("%s.NwkAddrBits()\n   got: %d\n  want: %d", c.netID, got, c.nwkAddrBits)
+		}
+		got, err := c.netID.DevAddr(c.nwkAddr)
+		if err != nil || got != c.devAddr {
+			t.Errorf("%s.DevAddr(%#x)\n   got: %s, %v\n  want: %s", c.netID, c.nwkAddr, got, err, c.devAddr)
+		}
+		if _, err := c.netID.DevAddr(1 << c.nwkAddrBits); err == nil {
+			t.Errorf("%s.DevAddr should error on a NwkAddr of %d bits", c.netID, c.nwkAddrBits+1)
+		}
+	}
+}
+
+/* DevAddr Tests */
+
+func TestDevAddr(t *testing.T) {
+	for _, c := range netIDs {
+		if got, ok := c.devAddr.NetIDType(); !ok || got != c.netIDType {
+			t.Errorf("%s.NetIDType()\n   got: %d, %v\n  want: %d", c.devAddr, got, ok, c.netIDType)
+		}
+		if got := c.devAddr.NwkID(); got != c.nwkID {
+			t.Errorf("%s.NwkID()\n   got: %#x\n  want: %#x", c.devAddr, got, c.nwkID)
+		}
+		if got := c.devAddr.NwkAddr(); got != c.nwkAddr {
+			t.Errorf("%s.NwkAddr()\n   got: %#x\n  want: %#x", c.devAddr, got, c.nwkAddr)
+		}
+		for _, other := range netIDs {
+			if got, want := other.netID.Contains(c.devAddr), other.netID == c.netID; got != want {
+				t.Errorf("%s.Contains(%s)\n   got: %v\n  want: %v", other.netID, c.devAddr, got, want)
+			}
+		}
+	}
+
+	// The DevAddr of another NwkID of the same type
+	if NetID(0x000013).Contains(0x28011234) {
+		t.Errorf("NetID 000013 should not contain DevAddr 28011234")
+	}
+	// The prefix of 8 ones is invalid
+	if _, ok := DevAddr(0xFF000000).NetIDType(); ok {
+		t.Errorf("DevAddr FF000000 should not have a NetID type")
+	}
+}
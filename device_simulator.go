@@ -0,0 +1,789 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+var (
+	// ErrNotJoined is returned when a device that has not joined a network
+	// sends or receives data messages
+	ErrNotJoined = errors.New("The device has not joined a network")
+
+	// ErrNoRXWindow is returned when a downlink message does not match an
+	// open receive window of the device
+	ErrNoRXWindow = errors.New("The downlink does not match an open receive window")
+
+	// ErrDutyCycleLimited is returned when none of the channels of a
+	// transmission has duty cycle budget left, or when the device waits for
+	// the aggregated duty cycle of the network
+	ErrDutyCycleLimited = errors.New("The duty cycle does not allow the transmission now")
+)
+
+// Transmission contains a message that is transmitted by a SimulatedDevice
+type Transmission struct {
+	PHYPayload []byte
+	Time       time.Time // Start of the transmission
+	Airtime    time.Duration
+	Frequency  uint32 // Hz
+	Channel    int
+	DataRate   int
+	TXPower    int
+}
+
+// End returns the time at which the Transmission ends
+func (transmission *Transmission) End() time.Time {
+	return transmission.Time.Add(transmission.Airtime)
+}
+
+// RXInfo returns the RXInfo of a gateway that received the Transmission. The
+// timestamp of the gateway counts the microseconds of the simulated time.
+func (transmission *Transmission) RXInfo(gatewayID uint64, rssi int, snr float64) RXInfo {
+	end := transmission.End()
+	return RXInfo{
+		GatewayID: gatewayID,
+		RSSI:      rssi,
+		SNR:       snr,
+		Timestamp: simulatedTimestamp(end),
+		Time:      end,
+		Frequency: transmission.Frequency,
+		Channel:   transmission.Channel,
+		DataRate:  transmission.DataRate,
+	}
+}
+
+// simulatedTimestamp returns the concentrator timestamp of a simulated time
+func simulatedTimestamp(t time.Time) uint32 {
+	return uint32(t.UnixNano() / int64(time.Microsecond))
+}
+
+// ReceiveWindow is a receive window that a SimulatedDevice opens after a
+// transmission
+type ReceiveWindow struct {
+	Window    RXWindow
+	Start     time.Time
+	Frequency uint32 // Hz
+	DataRate  int
+}
+
+// uplinkFrame contains the plaintext fields of an uplink data message, so
+// that it can be retransmitted on another channel
+type uplinkFrame struct {
+	confirmed  bool
+	fCtrl      FCtrl
+	fCnt       uint32
+	confFCnt   uint16 // The downlink frame counter that ACK refers to, LoRaWAN 1.1
+	fOpts      []byte
+	fPort      uint8
+	frmPayload []byte
+}
+
+// size returns the size of the PHYPayload of the frame: MHDR, FHDR, FPort
+// and FRMPayload, and MIC
+func (frame *uplinkFrame) size() int {
+	size := 1 + 7 + len(frame.fOpts) + 4
+	if len(frame.frmPayload) > 0 {
+		size += 1 + len(frame.frmPayload)
+	}
+	return size
+}
+
+/* SimulatedDevice Implementations */
+
+// SimulatedDeviceConfig contains the configuration of a SimulatedDevice.
+// Either RootKeys or ABP is required.
+type SimulatedDeviceConfig struct {
+	Region   *Region
+	RootKeys *RootKeys  // For OTAA
+	ABP      *ABPDevice // For ABP
+	ADR      bool       // Enables ADR after an OTAA join, ABP devices use ABP.ADR
+	Rand     *rand.Rand // Defaults to a source that is seeded with the current time
+}
+
+// SimulatedDevice is a virtual class A end device for testing a network
+// without radios. It joins, sends uplink messages on random enabled channels,
+// opens its RX1 and RX2 windows in simulated time, obeys the MAC commands it
+// receives and keeps its own frame counters. It keeps to the duty cycle of the
+// sub-bands, the dwell time of the region and the aggregated duty cycle of
+// DutyCycleReq. It is not safe for concurrent use.
+type SimulatedDevice struct {
+	region *Region
+	keys   *RootKeys
+	adr    bool
+	rand   *rand.Rand
+
+	// The session of the device: FCntUp is the counter of the next uplink
+	// message, NFCntDown and AFCntDown are the lowest accepted downlink counters
+	session  *DeviceSession
+	channels []Channel
+	backoff  ADRBackoff
+
+	dutyCycle    *DutyCycleTracker
+	maxDutyCycle uint8     // MaxDCycle of the last DutyCycleReq, the aggregated duty cycle is 1/2^MaxDCycle
+	offUntil     time.Time // The end of the off time of the aggregated duty cycle
+
+	joinRequest *JoinRequestPayload // The last join request, until it is accepted
+	last        *uplinkFrame
+	windows     []ReceiveWindow
+
+	answers  []MACCommand // Sent in the next uplink message
+	sticky   []MACCommand // Sent in every uplink message until a downlink is received
+	ack      bool         // The next uplink acknowledges a confirmed downlink
+	confFCnt uint16
+}
+
+// NewSimulatedDevice returns a new SimulatedDevice. ABP devices start with
+// their session, OTAA devices have to join first.
+func NewSimulatedDevice(config SimulatedDeviceConfig) (*SimulatedDevice, error) {
+	if config.Rand == nil {
+		config.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	device := &SimulatedDevice{
+		region:    config.Region,
+		adr:       config.ADR,
+		rand:      config.Rand,
+		channels:  append([]Channel{}, config.Region.UplinkChannels...),
+		dutyCycle: NewDutyCycleTracker(config.Region, false),
+	}
+	switch {
+	case config.RootKeys != nil:
+		device.keys = config.RootKeys.Clone()
+	case config.ABP != nil:
+		session, err := config.ABP.Session(config.Region)
+		if err != nil {
+			return nil, err
+		}
+		if config.ABP.ChannelPlan != nil && config.Region.CFListType != CFListChannelMask {
+			device.channels = append([]Channel{}, config.ABP.ChannelPlan.Channels...)
+		}
+		device.session = session
+	default:
+		return nil, errors.New("The device needs RootKeys or ABP settings")
+	}
+	return device, nil
+}
+
+// Joined returns true if the device has a session
+func (device *SimulatedDevice) Joined() bool {
+	return device.session != nil
+}
+
+// Session returns a copy of the session of the device, or nil if it has not
+// joined
+func (device *SimulatedDevice) Session() *DeviceSession {
+	if device.session == nil {
+		return nil
+	}
+	return device.session.Clone()
+}
+
+// ReceiveWindows returns the receive windows of the last transmission that
+// are still open
+func (device *SimulatedDevice) ReceiveWindows() []ReceiveWindow {
+	return append([]ReceiveWindow(nil), device.windows...)
+}
+
+// JoinRequest returns a join request at the lowest data rate. LoRaWAN 1.0
+// devices use a random DevNonce, LoRaWAN 1.1 devices increment it.
+func (device *SimulatedDevice) JoinRequest(now time.Time) (*Transmission, error) {
+	keys := device.keys
+	if keys == nil {
+		return nil, errors.New("ABP devices can not join")
+	}
+
+	mask := make([]bool, len(device.region.UplinkChannels))
+	for i := range mask {
+		mask[i] = true
+	}
+	// MHDR, JoinEUI, DevEUI, DevNonce and MIC
+	transmission, err := device.transmission(1+8+8+2+4, minUplinkDataRate(device.region), 0, device.region.UplinkChannels, mask, now)
+	if err != nil {
+		return nil, err
+	}
+
+	joinRequest := &JoinRequestPayload{JoinEUI: keys.JoinEUI, DevEUI: keys.DevEUI}
+	if keys.MACVersion.is11() {
+		if keys.NextDevNonce > 0xFFFF {
+			return nil, errors.New("The DevNonce of the device is exhausted")
+		}
+		joinRequest.DevNonce = uint16(keys.NextDevNonce)
+	} else {
+		joinRequest.DevNonce = uint16(device.rand.Intn(0x10000))
+	}
+
+	mhdr := &MHDR{MType: macMTypeJoinRequest, Major: macMajorLoRaWANR1}
+	mic, err := joinRequest.CalculateMIC(mhdr, keys.joinRequestKey())
+	if err != nil {
+		return nil, err
+	}
+	transmission.PHYPayload = (&PHYPayload{MHDR: mhdr, JoinRequestPayload: joinRequest, MIC: mic}).Bytes()
+
+	if keys.MACVersion.is11() {
+		keys.NextDevNonce++
+	}
+	device.record(transmission)
+	device.joinRequest = joinRequest
+	device.openWindows(transmission, true)
+	return transmission, nil
+}
+
+// Uplink returns an uplink data message with the MAC command answers of the
+// device in FOpts. It applies the ADR backoff before the message is sent. If
+// the message can not be sent, such as with ErrDutyCycleLimited, the device
+// is not changed.
+func (device *SimulatedDevice) Uplink(fPort uint8, payload []byte, confirmed bool, now time.Time) (*Transmission, error) {
+	session := device.session
+	if session == nil {
+		return nil, ErrNotJoined
+	}
+	if fPort == 0 && len(payload) > 0 {
+		return nil, errors.New("FPort 0 is reserved for MAC commands")
+	}
+
+	saved, backoff := session.Clone(), device.backoff
+	adrAckReq := device.backoff.Uplink(device.region, session)
+
+	var fOpts []byte
+	var pending []MACCommand
+	for i, answer := range append(append([]MACCommand{}, device.sticky...), device.answers...) {
+		answerBytes := answer.Bytes()
+		if len(fOpts)+len(answerBytes) > maxFOptsLen {
+			if i >= len(device.sticky) {
+				pending = append(pending, answer)
+			}
+			continue
+		}
+		fOpts = append(fOpts, answerBytes...)
+	}
+
+	frame := &uplinkFrame{
+		confirmed:  confirmed,
+		fCtrl:      FCtrl{ADR: session.ADR, ADRACKReq: adrAckReq, ACK: device.ack, FOptsLen: uint8(len(fOpts))},
+		fCnt:       session.FCntUp,
+		fOpts:      fOpts,
+		fPort:      fPort,
+		frmPayload: payload,
+	}
+	if device.ack {
+		frame.confFCnt = device.confFCnt
+	}
+	transmission, err := device.transmit(frame, now)
+	if err != nil {
+		device.session, device.backoff = saved, backoff
+		return nil, err
+	}
+	device.answers = pending
+	device.ack = false
+	session.FCntUp++
+	device.last = frame
+	return transmission, nil
+}
+
+// Retransmit returns the last uplink data message again, with the same frame
+// counter, for NbTrans or a confirmed message that was not acknowledged
+func (device *SimulatedDevice) Retransmit(now time.Time) (*Transmission, error) {
+	if device.session == nil {
+		return nil, ErrNotJoined
+	}
+	if device.last == nil {
+		return nil, errors.New("The device has not sent an uplink message")
+	}
+	return device.transmit(device.last, now)
+}
+
+// transmit encodes the frame for a random channel and opens the receive windows
+func (device *SimulatedDevice) transmit(frame *uplinkFrame, now time.Time) (*Transmission, error) {
+	session := device.session
+	transmission, err := device.transmission(frame.size(), session.DataRate, session.TXPower, device.channels, session.ChannelMask, now)
+	if err != nil {
+		return nil, err
+	}
+	if transmission.PHYPayload, err = device.encodeUplink(frame, transmission.DataRate, transmission.Channel); err != nil {
+		return nil, err
+	}
+	device.record(transmission)
+	device.openWindows(transmission, false)
+	return transmission, nil
+}
+
+// transmission returns a Transmission of size bytes on a random enabled
+// channel that supports the data rate and has duty cycle budget left. It
+// returns ErrDutyCycleLimited if there is no such channel.
+func (device *SimulatedDevice) transmission(size int, dataRate int, txPower int, channels []Channel, mask []bool, now time.Time) (*Transmission, error) {
+	airtime, err := device.region.TimeOnAir(dataRate, size, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []int
+	for i, channel := range channels {
+		enabled := mask == nil || i < len(mask) && mask[i]
+		if enabled && channel.Frequency != 0 && dataRate >= channel.MinDR && dataRate <= channel.MaxDR {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("No enabled channel supports data rate %d", dataRate)
+	}
+	if now.Before(device.offUntil) {
+		return nil, ErrDutyCycleLimited
+	}
+	available := candidates[:0]
+	for _, i := range candidates {
+		next, err := device.dutyCycle.NextTransmission(channels[i].Frequency, airtime, now)
+		if err != nil {
+			return nil, err
+		}
+		if !next.After(now) {
+			available = append(available, i)
+		}
+	}
+	if len(available) == 0 {
+		return nil, ErrDutyCycleLimited
+	}
+	channel := available[device.rand.Intn(len(available))]
+
+	return &Transmission{
+		Time:      now,
+		Airtime:   airtime,
+		Frequency: channels[channel].Frequency,
+		Channel:   channel,
+		DataRate:  dataRate,
+		TXPower:   txPower,
+	}, nil
+}
+
+// record records the transmission in the duty cycle of its sub-band and
+// starts the off time of the aggregated duty cycle
+func (device *SimulatedDevice) record(transmission *Transmission) {
+	// The frequency and time on air were checked by the transmission
+	device.dutyCycle.Record(transmission.Frequency, transmission.Airtime, transmission.Time)
+	if device.maxDutyCycle > 0 {
+		device.offUntil = transmission.Time.Add(transmission.Airtime << device.maxDutyCycle)
+	}
+}
+
+// encodeUplink encrypts the frame and calculates its MIC. The MIC of LoRaWAN
+// 1.1 depends on the data rate and channel of the transmission.
+func (device *SimulatedDevice) encodeUplink(frame *uplinkFrame, dataRate int, channel int) ([]byte, error) {
+	session := device.session
+	mhdr := &MHDR{MType: macMTypeUnconfirmedDataUp, Major: macMajorLoRaWANR1}
+	if frame.confirmed {
+		mhdr.MType = macMTypeConfirmedDataUp
+	}
+
+	fOpts := frame.fOpts
+	if session.MACVersion.is11() && len(fOpts) > 0 {
+		var err error
+		if fOpts, err = CryptData32(session.NwkSEncKey, fOpts, false, session.DevAddr, frame.fCnt); err != nil {
+			return nil, err
+		}
+	}
+	if fOpts == nil {
+		fOpts = []byte{}
+	}
+	key := session.AppSKey
+	if frame.fPort == 0 {
+		key = session.NwkSEncKey
+	}
+	var frmPayload []byte // Without FRMPayload there is no FPort either
+	if len(frame.frmPayload) > 0 {
+		var err error
+		if frmPayload, err = CryptData32(key, frame.frmPayload, false, session.DevAddr, frame.fCnt); err != nil {
+			return nil, err
+		}
+	}
+
+	fCtrl := frame.fCtrl
+	fHdr := &FHDR{DevAddr: session.DevAddr, FCtrl: &fCtrl, FCnt: uint16(frame.fCnt), FOpts: fOpts}
+	dataPayload := &DataPayload{FHDR: fHdr, RawFHDR: fHdr.Bytes(), FPort: frame.fPort, RawFRMPayload: frmPayload}
+	msg := append([]byte{mhdr.Byte()}, dataPayload.Bytes()...)
+
+	cmacF, err := calculateCMAC(session.FNwkSIntKey, dataMICBlock(0, 0, 0, false, session.DevAddr, frame.fCnt, len(msg)), msg)
+	if err != nil {
+		return nil, err
+	}
+	mic := cmacF[0:4]
+	if session.MACVersion.is11() {
+		b1 := dataMICBlock(frame.confFCnt, uint8(dataRate), uint8(channel), false, session.DevAddr, frame.fCnt, len(msg))
+		cmacS, err := calculateCMAC(session.SNwkSIntKey, b1, msg)
+		if err != nil {
+			return nil, err
+		}
+		mic = append(cmacS[0:2:2], cmacF[0:2]...)
+	}
+	return append(msg, mic...), nil
+}
+
+// openWindows opens RX1 and RX2 after the transmission, with the settings
+// that the DownlinkScheduler uses
+func (device *SimulatedDevice) openWindows(transmission *Transmission, join bool) {
+	region, session := device.region, device.session
+	device.windows = nil
+
+	rx1Delay, rx2Delay := region.JoinAcceptDelay1, region.JoinAcceptDelay2
+	var rx1DROffset int
+	rx2Frequency, rx2DataRate := region.RX2Frequency, region.RX2DataRate
+	if !join {
+		rx1Delay = region.ReceiveDelay1
+		if session.RXDelay > 0 {
+			rx1Delay = time.Duration(session.RXDelay) * time.Second
+		}
+		rx2Delay = rx1Delay + time.Second
+		rx1DROffset = session.RX1DROffset
+		if session.RX2Frequency != 0 {
+			rx2Frequency, rx2DataRate = session.RX2Frequency, session.RX2DataRate
+		}
+	}
+
+	end := transmission.End()
+	if rx1Frequency, err := region.RX1Frequency(transmission.Frequency); err == nil {
+		if rx1DataRate, err := region.RX1DataRate(transmission.DataRate, rx1DROffset); err == nil {
+			device.windows = append(device.windows, ReceiveWindow{Window: RX1, Start: end.Add(rx1Delay), Frequency: rx1Frequency, DataRate: rx1DataRate})
+		}
+	}
+	device.windows = append(device.windows, ReceiveWindow{Window: RX2, Start: end.Add(rx2Delay), Frequency: rx2Frequency, DataRate: rx2DataRate})
+}
+
+// Receive receives a downlink message in one of the open receive windows,
+// which closes the windows. It returns the decrypted downlink data message,
+// or nil for a join accept message.
+func (device *SimulatedDevice) Receive(txRequest *TXRequest) (*Downlink, error) {
+	var open bool
+	for _, window := range device.windows {
+		if window.Window == txRequest.Window && window.Frequency == txRequest.Frequency &&
+			window.DataRate == txRequest.DataRate && simulatedTimestamp(window.Start) == txRequest.Timestamp {
+			open = true
+		}
+	}
+	if !open {
+		return nil, ErrNoRXWindow
+	}
+	device.windows = nil
+
+	phyPayload, err := ParsePHYPayload(txRequest.PHYPayload)
+	if err != nil {
+		return nil, err
+	}
+	switch phyPayload.MHDR.MType {
+	case macMTypeJoinAccept:
+		return nil, device.receiveJoinAccept(phyPayload)
+	case macMTypeUnconfirmedDataDown, macMTypeConfirmedDataDown:
+		return device.receiveData(phyPayload)
+	default:
+		return nil, fmt.Errorf("MType %d is not a downlink message", phyPayload.MHDR.MType)
+	}
+}
+
+// receiveJoinAccept verifies the join accept message and starts the session
+func (device *SimulatedDevice) receiveJoinAccept(phyPayload *PHYPayload) error {
+	keys, joinRequest := device.keys, device.joinRequest
+	if joinRequest == nil {
+		return errors.New("The device did not send a join request")
+	}
+
+	key := keys.joinRequestKey()
+	joinAccept, mic, err := ParseJoinAccept(phyPayload, key)
+	if err != nil {
+		return err
+	}
+	var expected []byte
+	if keys.MACVersion.is11() && joinAccept.DLSettings.OptNeg {
+		jsIntKey, err := keys.JSIntKey()
+		if err != nil {
+			return err
+		}
+		expected, err = joinAccept.CalculateMICWithJoinRequest(phyPayload.MHDR, jsIntKey, joinReqTypeJoinRequest, joinRequest.JoinEUI, joinRequest.DevNonce)
+		if err != nil {
+			return err
+		}
+		if joinAccept.JoinNonce <= keys.JoinNonce {
+			return fmt.Errorf("JoinNonce %d is not higher than %d", joinAccept.JoinNonce, keys.JoinNonce)
+		}
+	} else if expected, err = joinAccept.CalculateMIC(phyPayload.MHDR, key); err != nil {
+		return err
+	}
+	if !bytes.Equal(mic, expected) {
+		return ErrInvalidMIC
+	}
+
+	session, err := NewJoinSession(keys, joinRequest, joinAccept)
+	if err != nil {
+		return err
+	}
+	keys.JoinNonce = joinAccept.JoinNonce
+	session.DataRate = minUplinkDataRate(device.region)
+	session.ADR = device.adr
+
+	device.channels = append([]Channel{}, device.region.UplinkChannels...)
+	session.ChannelMask = make([]bool, len(device.channels))
+	for i := range session.ChannelMask {
+		session.ChannelMask[i] = true
+	}
+	device.session = session
+	if len(joinAccept.CFList) == 16 {
+		device.applyCFList(joinAccept.CFList)
+	}
+
+	device.joinRequest = nil
+	device.last = nil
+	device.backoff = ADRBackoff{}
+	device.answers, device.sticky, device.ack = nil, nil, false
+	device.maxDutyCycle = 0
+	return nil
+}
+
+// applyCFList adds the channels of the CFList, or applies its channel mask
+// See Section 7 of the LoRaWAN Regional Parameters
+func (device *SimulatedDevice) applyCFList(cfList []byte) {
+	session := device.session
+	if CFListType(cfList[15]) == CFListChannelMask {
+		for i := range session.ChannelMask {
+			session.ChannelMask[i] = i < 15*8 && cfList[i/8]&(1<<uint(i%8)) != 0
+		}
+		return
+	}
+	defaults := device.region.UplinkChannels
+	for i := 0; i < 5; i++ {
+		frequency := parseUint24(cfList[i*3:]) * 100
+		if frequency == 0 {
+			continue
+		}
+		channel := Channel{Frequency: frequency}
+		if len(defaults) > 0 {
+			channel.MinDR, channel.MaxDR = defaults[0].MinDR, defaults[0].MaxDR
+		}
+		device.channels = append(device.channels, channel)
+		session.ChannelMask = append(session.ChannelMask, true)
+	}
+}
+
+// receiveData verifies and decrypts a downlink data message and handles its
+// MAC commands
+func (device *SimulatedDevice) receiveData(phyPayload *PHYPayload) (*Downlink, error) {
+	session := device.session
+	if session == nil {
+		return nil, ErrNotJoined
+	}
+	dataPayload := phyPayload.DataPayload
+	fHdr := dataPayload.FHDR
+	if fHdr.DevAddr != session.DevAddr {
+		return nil, fmt.Errorf("DevAddr %08X does not match session DevAddr %08X", fHdr.DevAddr, session.DevAddr)
+	}
+
+	fCntDown := &session.NFCntDown
+	if session.MACVersion.is11() && dataPayload.FPort > 0 {
+		fCntDown = &session.AFCntDown
+	}
+	fCnt := session.FCntPolicy.FullFCnt(*fCntDown, fHdr.FCnt)
+	if fCnt < *fCntDown {
+		return nil, ErrFCntTooLow
+	}
+
+	var confFCnt uint16
+	if session.MACVersion.is11() && fHdr.FCtrl.ACK && session.FCntUp > 0 {
+		confFCnt = uint16(session.FCntUp - 1)
+	}
+	msg := dataMessage(phyPayload)
+	mic, err := calculateCMAC(session.SNwkSIntKey, dataMICBlock(confFCnt, 0, 0, true, session.DevAddr, fCnt, len(msg)), msg)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(phyPayload.MIC, mic[0:4]) {
+		return nil, ErrInvalidMIC
+	}
+
+	downlink := &Downlink{
+		Confirmed: phyPayload.MHDR.MType == macMTypeConfirmedDataDown,
+		ACK:       fHdr.FCtrl.ACK,
+		FPending:  fHdr.FCtrl.FPending,
+		FOpts:     fHdr.FOpts,
+		FPort:     dataPayload.FPort,
+	}
+	if session.MACVersion.is11() && len(fHdr.FOpts) > 0 {
+		if downlink.FOpts, err = CryptData32(session.NwkSEncKey, fHdr.FOpts, true, session.DevAddr, fCnt); err != nil {
+			return nil, err
+		}
+	}
+	if len(dataPayload.RawFRMPayload) > 0 {
+		key := session.AppSKey
+		if dataPayload.FPort == 0 {
+			key = session.NwkSEncKey
+		}
+		if downlink.FRMPayload, err = CryptData32(key, dataPayload.RawFRMPayload, true, session.DevAddr, fCnt); err != nil {
+			return nil, err
+		}
+	}
+	*fCntDown = fCnt + 1
+
+	device.backoff.Downlink()
+	device.sticky = nil
+	if downlink.Confirmed {
+		device.ack, device.confFCnt = true, uint16(fCnt)
+	}
+
+	macCommandBytes := downlink.FOpts
+	if downlink.FPort == 0 && len(downlink.FRMPayload) > 0 {
+		macCommandBytes = downlink.FRMPayload
+	}
+	// The device handles the MAC commands up to the first one it does not know
+	macCommands, _ := ParseMACCommands(macCommandBytes, false)
+	device.handleMACCommands(macCommands)
+	return downlink, nil
+}
+
+// handleMACCommands applies the MAC commands and queues their answers
+func (device *SimulatedDevice) handleMACCommands(macCommands []MACCommand) {
+	session := device.session
+	for i := 0; i < len(macCommands); i++ {
+		macCommand := macCommands[i]
+		switch macCommand.CID {
+		case CIDLinkADR:
+			// Consecutive LinkADRReqs are handled as one block
+			end := i + 1
+			for end < len(macCommands) && macCommands[end].CID == CIDLinkADR {
+				end++
+			}
+			device.handleLinkADRReqs(macCommands[i:end])
+			i = end - 1
+		case CIDRXParamSetup:
+			if req, err := ParseRXParamSetupReq(macCommand); err == nil {
+				device.handleRXParamSetupReq(req)
+			}
+		case CIDRXTimingSetup:
+			if req, err := ParseRXTimingSetupReq(macCommand); err == nil {
+				session.RXDelay = req.Delay
+				device.sticky = append(device.sticky, MACCommand{CID: CIDRXTimingSetup})
+			}
+		case CIDNewChannel:
+			if req, err := ParseNewChannelReq(macCommand); err == nil {
+				device.handleNewChannelReq(req)
+			}
+		case CIDADRParamSetup:
+			if req, err := ParseADRParamSetupReq(macCommand); err == nil {
+				session.ADRAckLimit, session.ADRAckDelay = int(req.Limit()), int(req.Delay())
+				device.answers = append(device.answers, MACCommand{CID: CIDADRParamSetup})
+			}
+		case CIDDevStatus:
+			ans := &DevStatusAns{Battery: 255}
+			device.answers = append(device.answers, ans.MACCommand())
+		case CIDDutyCycle:
+			if len(macCommand.Payload) == 1 {
+				device.maxDutyCycle = macCommand.Payload[0] & 0x0F
+				device.answers = append(device.answers, MACCommand{CID: CIDDutyCycle})
+			}
+		case CIDLinkCheck:
+			// LinkCheckAns needs no answer
+		default:
+			return
+		}
+	}
+}
+
+// handleLinkADRReqs applies a block of LinkADRReqs if the device accepts all
+// of them, and answers each of them
+// See Section 5.3 of the LoRaWan Specification
+func (device *SimulatedDevice) handleLinkADRReqs(macCommands []MACCommand) {
+	region, session := device.region, device.session
+	mask := append([]bool{}, session.ChannelMask...)
+	ans := &LinkADRAns{PowerACK: true, DataRateACK: true, ChannelMaskACK: true}
+
+	var req *LinkADRReq
+	for _, macCommand := range macCommands {
+		var err error
+		if req, err = ParseLinkADRReq(macCommand); err != nil {
+			return
+		}
+		for i := 0; i < 16; i++ {
+			index := int(req.ChMaskCntl)*16 + i
+			enabled := req.ChMask&(1<<uint(i)) != 0
+			if index >= len(mask) || device.channels[index].Frequency == 0 {
+				ans.ChannelMaskACK = ans.ChannelMaskACK && !enabled
+				continue
+			}
+			mask[index] = enabled
+		}
+	}
+
+	// DataRate and TXPower 15 keep the current settings
+	dataRate, txPower := session.DataRate, session.TXPower
+	if req.DataRate != 0xF {
+		dataRate = int(req.DataRate)
+	}
+	if req.TXPower != 0xF {
+		txPower = int(req.TXPower)
+	}
+
+	var anyEnabled bool
+	ans.DataRateACK = false
+	for i, enabled := range mask {
+		if enabled {
+			anyEnabled = true
+			channel := device.channels[i]
+			ans.DataRateACK = ans.DataRateACK || dataRate >= channel.MinDR && dataRate <= channel.MaxDR
+		}
+	}
+	ans.ChannelMaskACK = ans.ChannelMaskACK && anyEnabled
+	if _, err := region.TXPower(txPower); err != nil {
+		ans.PowerACK = false
+	}
+
+	if ans.ACK() {
+		session.DataRate, session.TXPower, session.ChannelMask = dataRate, txPower, mask
+		if req.NbTrans > 0 {
+			session.NbTrans = int(req.NbTrans)
+		}
+	}
+	for range macCommands {
+		device.answers = append(device.answers, ans.MACCommand())
+	}
+}
+
+// handleRXParamSetupReq applies the RX settings if the device accepts all
+// of them
+// See Section 5.4 of the LoRaWan Specification
+func (device *SimulatedDevice) handleRXParamSetupReq(req *RXParamSetupReq) {
+	region, session := device.region, device.session
+	_, rx1Err := region.RX1DataRate(session.DataRate, int(req.RX1DROffset))
+	_, rx2Err := region.DataRate(int(req.RX2DataRate))
+	_, channelOK := region.SubBand(req.Frequency)
+	ans := &RXParamSetupAns{RX1DROffsetACK: rx1Err == nil, RX2DataRateACK: rx2Err == nil, ChannelACK: channelOK}
+	if ans.ACK() {
+		session.RX1DROffset = int(req.RX1DROffset)
+		session.RX2DataRate = int(req.RX2DataRate)
+		session.RX2Frequency = req.Frequency
+	}
+	device.sticky = append(device.sticky, ans.MACCommand())
+}
+
+// handleNewChannelReq creates, changes or removes a channel. The default
+// channels can not be changed, and fixed channel plans do not support it.
+// See Section 5.6 of the LoRaWan Specification
+func (device *SimulatedDevice) handleNewChannelReq(req *NewChannelReq) {
+	region, session := device.region, device.session
+	ans := &NewChannelAns{}
+	index := int(req.ChIndex)
+	if region.CFListType != CFListChannelMask && index >= len(region.UplinkChannels) && index < maxChannels {
+		_, minErr := region.DataRate(int(req.MinDR))
+		_, maxErr := region.DataRate(int(req.MaxDR))
+		_, frequencyOK := region.SubBand(req.Frequency)
+		ans.DataRateRangeOK = minErr == nil && maxErr == nil && req.MinDR <= req.MaxDR
+		ans.ChannelFrequencyOK = frequencyOK || req.Frequency == 0
+	}
+	if ans.DataRateRangeOK && ans.ChannelFrequencyOK {
+		for len(device.channels) <= index {
+			device.channels = append(device.channels, Channel{})
+			session.ChannelMask = append(session.ChannelMask, false)
+		}
+		device.channels[index] = Channel{Frequency: req.Frequency, MinDR: int(req.MinDR), MaxDR: int(req.MaxDR)}
+		session.ChannelMask[index] = req.Frequency != 0
+	}
+	device.answers = append(device.answers, ans.MACCommand())
+}
@@ -0,0 +1,331 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// testNetwork connects SimulatedDevices to a NetworkServer and a
+// DownlinkScheduler in simulated time
+type testNetwork struct {
+	region    *Region
+	sessions  *MemorySessionStore
+	ns        *NetworkServer
+	scheduler *DownlinkScheduler
+	now       time.Time
+}
+
+func newTestNetwork(version MACVersion, adr ADRHandler) *testNetwork {
+	region, _ := GetRegion("EU868", RP002_1_0_3)
+	js, _ := testJoinServer(version)
+	sessions := NewMemorySessionStore()
+	return &testNetwork{
+		region:    region,
+		sessions:  sessions,
+		ns:        NewNetworkServer(NetworkServerConfig{Sessions: sessions, JoinServer: js, ADR: adr}),
+		scheduler: NewDownlinkScheduler(region),
+		now:       time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+// exchange processes the transmission of the device and delivers the downlink
+// message, if any. The simulated time advances by a minute.
+func (network *testNetwork) exchange(t *testing.T, device *SimulatedDevice, transmission *Transmission) (*UplinkContext, *Downlink) {
+	network.now = network.now.Add(time.Minute)
+	uplink := &DeduplicatedUplink{PHYPayload: transmission.PHYPayload, RXInfo: []RXInfo{transmission.RXInfo(1, -50, 10)}}
+	ctx, phyPayload, err := network.ns.ProcessUplink(uplink)
+	if err != nil {
+		t.Fatalf("ProcessUplink failed: %s", err)
+	}
+	if phyPayload == nil {
+		return ctx, nil
+	}
+	txRequest, err := network.scheduler.Schedule(uplink, phyPayload, ctx.Session, transmission.End())
+	if err != nil {
+		t.Fatalf("Schedule failed: %s", err)
+	}
+	downlink, err := device.Receive(txRequest)
+	if err != nil {
+		t.Fatalf("Receive failed: %s", err)
+	}
+	return ctx, downlink
+}
+
+func (network *testNetwork) join(t *testing.T, device *SimulatedDevice) {
+	transmission, err := device.JoinRequest(network.now)
+	if err != nil {
+		t.Fatalf("JoinRequest failed: %s", err)
+	}
+	network.exchange(t, device, transmission)
+	if !device.Joined() {
+		t.Fatalf("The device did not join")
+	}
+}
+
+/* SimulatedDevice Tests */
+
+func TestSimulatedDeviceJoin(t *testing.T) {
+	for _, version := range []MACVersion{LoRaWAN1_0_2, LoRaWAN1_1} {
+		network := newTestNetwork(version, nil)
+		device, err := NewSimulatedDevice(SimulatedDeviceConfig{Region: network.region, RootKeys: testRootKeys(version), Rand: rand.New(rand.NewSource(1))})
+		if err != nil {
+			t.Fatalf("NewSimulatedDevice failed: %s", err)
+		}
+		if _, err := device.Uplink(1, []byte("hi"), false, network.now); err != ErrNotJoined {
+			t.Errorf("%s: Uplink before the join\n   got: %v\n  want: %v", version, err, ErrNotJoined)
+		}
+		network.join(t, device)
+
+		session, _ := network.sessions.GetByDevEUI(device.Session().DevEUI)
+		for _, key := range [][2][]byte{
+			{device.Session().FNwkSIntKey, session.FNwkSIntKey},
+			{device.Session().SNwkSIntKey, session.SNwkSIntKey},
+			{device.Session().NwkSEncKey, session.NwkSEncKey},
+			{device.Session().AppSKey, session.AppSKey},
+		} {
+			if !bytes.Equal(key[0], key[1]) {
+				t.Errorf("%s: The device derived other session keys\n   got: %X\n  want: %X", version, key[0], key[1])
+			}
+		}
+		if device.Session().MACVersion != session.MACVersion || device.Session().RXDelay != 1 {
+			t.Errorf("%s: Session of the device\n   got: %#v", version, device.Session())
+		}
+
+		// The confirmed uplink is acknowledged, and the device acknowledges
+		// nothing in the next one
+		transmission, err := device.Uplink(1, []byte("hello"), true, network.now)
+		if err != nil {
+			t.Fatalf("%s: Uplink failed: %s", version, err)
+		}
+		ctx, downlink := network.exchange(t, device, transmission)
+		if string(ctx.Uplink.FRMPayload) != "hello" || !ctx.Uplink.Confirmed {
+			t.Errorf("%s: Uplink of the device\n   got: %#v", version, ctx.Uplink)
+		}
+		if downlink == nil || !downlink.ACK {
+			t.Fatalf("%s: The confirmed uplink should be acknowledged\n   got: %#v", version, downlink)
+		}
+
+		transmission, _ = device.Uplink(2, []byte("again"), false, network.now)
+		ctx, downlink = network.exchange(t, device, transmission)
+		if ctx.Uplink.FCnt != 1 || ctx.Uplink.ACK || downlink != nil {
+			t.Errorf("%s: Second uplink\n   got: %#v", version, ctx.Uplink)
+		}
+		if device.Session().FCntUp != 2 {
+			t.Errorf("%s: FCntUp\n   got: %d\n  want: %d", version, device.Session().FCntUp, 2)
+		}
+
+		// The network drops a retransmission but acknowledges it again
+		transmission, _ = device.Uplink(1, nil, true, network.now)
+		network.exchange(t, device, transmission)
+		transmission, err = device.Retransmit(network.now)
+		if err != nil {
+			t.Fatalf("%s: Retransmit failed: %s", version, err)
+		}
+		ctx, downlink = network.exchange(t, device, transmission)
+		if !ctx.Uplink.Retransmission || downlink == nil || !downlink.ACK {
+			t.Errorf("%s: Retransmission\n   got: %#v", version, ctx.Uplink)
+		}
+	}
+}
+
+func TestSimulatedDeviceADR(t *testing.T) {
+	region, _ := GetRegion("EU868", RP002_1_0_3)
+	network := newTestNetwork(LoRaWAN1_0_2, &ADREngine{Region: region, Algorithm: &ClassicADRAlgorithm{History: 2}})
+	device, _ := NewSimulatedDevice(SimulatedDeviceConfig{Region: network.region, RootKeys: testRootKeys(LoRaWAN1_0_2), ADR: true, Rand: rand.New(rand.NewSource(1))})
+	network.join(t, device)
+
+	var linkADRReq bool
+	for i := 0; i < 3 && !linkADRReq; i++ {
+		transmission, _ := device.Uplink(1, []byte{byte(i)}, false, network.now)
+		_, downlink := network.exchange(t, device, transmission)
+		linkADRReq = downlink != nil && len(downlink.FOpts) > 0 && downlink.FOpts[0] == CIDLinkADR
+	}
+	if !linkADRReq {
+		t.Fatalf("The network did not send a LinkADRReq")
+	}
+	if device.Session().DataRate == 0 {
+		t.Errorf("The device did not apply the LinkADRReq\n   got: %#v", device.Session())
+	}
+
+	// The device answers in the next uplink, and the network applies the settings
+	transmission, _ := device.Uplink(1, nil, false, network.now)
+	if transmission.DataRate != device.Session().DataRate {
+		t.Errorf("DataRate of the transmission\n   got: %d\n  want: %d", transmission.DataRate, device.Session().DataRate)
+	}
+	ctx, _ := network.exchange(t, device, transmission)
+	macCommands, _ := ctx.Uplink.MACCommands()
+	if len(macCommands) != 1 || macCommands[0].CID != CIDLinkADR {
+		t.Fatalf("Answers of the device\n   got: %#v", macCommands)
+	}
+	if ans, _ := ParseLinkADRAns(macCommands[0]); !ans.ACK() {
+		t.Errorf("The device should acknowledge the LinkADRReq\n   got: %#v", ans)
+	}
+	if ctx.Session.PendingADR != nil || ctx.Session.DataRate != device.Session().DataRate {
+		t.Errorf("The network should apply the settings\n   got: %#v", ctx.Session)
+	}
+}
+
+func TestSimulatedDeviceMACCommands(t *testing.T) {
+	network := newTestNetwork(LoRaWAN1_1, nil)
+	device, _ := NewSimulatedDevice(SimulatedDeviceConfig{Region: network.region, RootKeys: testRootKeys(LoRaWAN1_1), Rand: rand.New(rand.NewSource(1))})
+	network.join(t, device)
+
+	transmission, _ := device.Uplink(1, nil, false, network.now)
+	network.exchange(t, device, transmission)
+
+	// The network sends MAC commands with FPort 0 in a confirmed downlink in RX1
+	// of the uplink
+	session, _ := network.sessions.GetByDevEUI(device.Session().DevEUI)
+	expected := session.FrameCounters()
+	session.NFCntDown = 5
+	macCommands := []MACCommand{
+		(&RXParamSetupReq{RX1DROffset: 2, RX2DataRate: 3, Frequency: 869525000}).MACCommand(),
+		(&NewChannelReq{ChIndex: 3, Frequency: 867100000, MinDR: 0, MaxDR: 5}).MACCommand(),
+		(&NewChannelReq{ChIndex: 0, Frequency: 867300000, MinDR: 0, MaxDR: 5}).MACCommand(),
+	}
+	phyPayload, err := session.EncodeDownlink(&Downlink{Confirmed: true, FRMPayload: MACCommandsBytes(macCommands)})
+	if err != nil {
+		t.Fatalf("EncodeDownlink failed: %s", err)
+	}
+	window := device.ReceiveWindows()[0]
+	txRequest := &TXRequest{PHYPayload: phyPayload.Bytes(), Window: window.Window, Timestamp: simulatedTimestamp(window.Start), Frequency: window.Frequency, DataRate: window.DataRate}
+
+	wrong := *txRequest
+	wrong.Timestamp++
+	if _, err := device.Receive(&wrong); err != ErrNoRXWindow {
+		t.Errorf("Receive outside the window\n   got: %v\n  want: %v", err, ErrNoRXWindow)
+	}
+	downlink, err := device.Receive(txRequest)
+	if err != nil {
+		t.Fatalf("Receive failed: %s", err)
+	}
+	if !bytes.Equal(downlink.FRMPayload, MACCommandsBytes(macCommands)) {
+		t.Errorf("FRMPayload of the downlink\n   got: %X\n  want: %X", downlink.FRMPayload, MACCommandsBytes(macCommands))
+	}
+	if _, err := device.Receive(txRequest); err != ErrNoRXWindow {
+		t.Errorf("Receive after the windows closed\n   got: %v\n  want: %v", err, ErrNoRXWindow)
+	}
+
+	deviceSession := device.Session()
+	if deviceSession.RX1DROffset != 2 || deviceSession.RX2DataRate != 3 || deviceSession.RX2Frequency != 869525000 {
+		t.Errorf("The device did not apply the RXParamSetupReq\n   got: %#v", deviceSession)
+	}
+	if len(deviceSession.ChannelMask) != 4 || !deviceSession.ChannelMask[3] {
+		t.Errorf("The device did not add the channel\n   got: %#v", deviceSession.ChannelMask)
+	}
+
+	// The next uplink acknowledges the downlink, answers the MAC commands and
+	// opens the new RX2
+	session.RX1DROffset, session.RX2DataRate, session.RX2Frequency = 2, 3, 869525000
+	if err := network.sessions.Save(session, &expected); err != nil {
+		t.Fatalf("Save failed: %s", err)
+	}
+	transmission, _ = device.Uplink(1, nil, false, network.now)
+	windows := device.ReceiveWindows()
+	if rx2 := windows[len(windows)-1]; rx2.Frequency != 869525000 || rx2.DataRate != 3 {
+		t.Errorf("RX2 of the device\n   got: %#v", rx2)
+	}
+	ctx, _ := network.exchange(t, device, transmission)
+	if !ctx.Uplink.ACK {
+		t.Errorf("The device should acknowledge the confirmed downlink")
+	}
+	answers, _ := ctx.Uplink.MACCommands()
+	want := []MACCommand{
+		(&RXParamSetupAns{RX1DROffsetACK: true, RX2DataRateACK: true, ChannelACK: true}).MACCommand(),
+		(&NewChannelAns{DataRateRangeOK: true, ChannelFrequencyOK: true}).MACCommand(),
+		(&NewChannelAns{}).MACCommand(),
+	}
+	if !bytes.Equal(MACCommandsBytes(answers), MACCommandsBytes(want)) {
+		t.Errorf("Answers of the device\n   got: %X\n  want: %X", MACCommandsBytes(answers), MACCommandsBytes(want))
+	}
+}
+
+func TestSimulatedDeviceABP(t *testing.T) {
+	network := newTestNetwork(LoRaWAN1_0_2, nil)
+	abp := testABPDevice(LoRaWAN1_0_2)
+	provisioner := NewABPProvisioner(ABPProvisionerConfig{NetID: testNetID, Region: network.region, Sessions: network.sessions})
+	if _, err := provisioner.Provision(abp); err != nil {
+		t.Fatalf("Provision failed: %s", err)
+	}
+	device, err := NewSimulatedDevice(SimulatedDeviceConfig{Region: network.region, ABP: abp, Rand: rand.New(rand.NewSource(1))})
+	if err != nil {
+		t.Fatalf("NewSimulatedDevice failed: %s", err)
+	}
+	if _, err := device.JoinRequest(network.now); err == nil {
+		t.Errorf("JoinRequest should fail for ABP devices")
+	}
+
+	transmission, err := device.Uplink(1, []byte("abp"), true, network.now)
+	if err != nil {
+		t.Fatalf("Uplink failed: %s", err)
+	}
+	if transmission.DataRate != 5 {
+		t.Errorf("DataRate of the transmission\n   got: %d\n  want: %d", transmission.DataRate, 5)
+	}
+	ctx, downlink := network.exchange(t, device, transmission)
+	if string(ctx.Uplink.FRMPayload) != "abp" || downlink == nil || !downlink.ACK {
+		t.Errorf("Exchange of the ABP device\n   got: %#v, %#v", ctx.Uplink, downlink)
+	}
+}
+
+func TestSimulatedDeviceDutyCycle(t *testing.T) {
+	region, _ := GetRegion("EU868", RP002_1_0_3)
+	abp := testABPDevice(LoRaWAN1_0_2)
+	abp.DataRate = 0
+	device, _ := NewSimulatedDevice(SimulatedDeviceConfig{Region: region, ABP: abp, Rand: rand.New(rand.NewSource(1))})
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// The default channels share a sub-band with 36 seconds per hour
+	var airtime time.Duration
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		var transmission *Transmission
+		if transmission, err = device.Uplink(1, make([]byte, 20), false, now); err == nil {
+			airtime += transmission.Airtime
+			now = transmission.End()
+		}
+	}
+	if err != ErrDutyCycleLimited {
+		t.Fatalf("Uplink after the budget is used\n   got: %v\n  want: %v", err, ErrDutyCycleLimited)
+	}
+	if airtime > 36*time.Second || airtime < 30*time.Second {
+		t.Errorf("Airtime before the duty cycle limits the device\n   got: %s", airtime)
+	}
+	fCntUp := device.Session().FCntUp
+	if _, err := device.Retransmit(now); err != ErrDutyCycleLimited {
+		t.Errorf("Retransmit after the budget is used\n   got: %v\n  want: %v", err, ErrDutyCycleLimited)
+	}
+	if device.Session().FCntUp != fCntUp {
+		t.Errorf("FCntUp after a failed uplink\n   got: %d\n  want: %d", device.Session().FCntUp, fCntUp)
+	}
+
+	// An aggregated duty cycle of 1/16 keeps the device off for 15 times the airtime
+	now = now.Add(DutyCycleWindow)
+	device.handleMACCommands([]MACCommand{{CID: CIDDutyCycle, Payload: []byte{4}}})
+	transmission, err := device.Uplink(1, nil, false, now)
+	if err != nil {
+		t.Fatalf("Uplink after the window failed: %s", err)
+	}
+	if !bytes.Equal(transmission.PHYPayload[8:9], []byte{CIDDutyCycle}) {
+		t.Errorf("The device should answer the DutyCycleReq\n   got: %X", transmission.PHYPayload)
+	}
+	if _, err := device.Uplink(1, nil, false, transmission.Time.Add(15*transmission.Airtime)); err != ErrDutyCycleLimited {
+		t.Errorf("Uplink during the off time\n   got: %v\n  want: %v", err, ErrDutyCycleLimited)
+	}
+	if _, err := device.Uplink(1, nil, false, transmission.Time.Add(16*transmission.Airtime)); err != nil {
+		t.Errorf("Uplink after the off time failed: %s", err)
+	}
+
+	// The dwell time of the region is enforced
+	region, _ = GetRegion("AS923", RP002_1_0_3)
+	device, _ = NewSimulatedDevice(SimulatedDeviceConfig{Region: region, ABP: abp, Rand: rand.New(rand.NewSource(1))})
+	if _, err := device.Uplink(1, make([]byte, 20), false, now); err != ErrDwellTimeExceeded {
+		t.Errorf("Uplink that exceeds the dwell time\n   got: %v\n  want: %v", err, ErrDwellTimeExceeded)
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrDownlinkQueueFull is returned when the downlink queue of a device is full
+var ErrDownlinkQueueFull = errors.New("The downlink queue of the device is full")
+
+// DownlinkQueueItem contains an application downlink message in the queue
+type DownlinkQueueItem struct {
+	ID         uint64    `json:"id"` // Assigned by Enqueue
+	FPort      uint8     `json:"f_port"`
+	FRMPayload []byte    `json:"frm_payload"`
+	Confirmed  bool      `json:"confirmed"`
+	ExpiresAt  time.Time `json:"expires_at"` // Zero means the item does not expire
+	Attempts   int       `json:"attempts"`   // The number of transmissions so far
+}
+
+// DownlinkEventType is the type of a DownlinkEvent
+type DownlinkEventType uint8
+
+// Types of DownlinkEvents
+const (
+	DownlinkAck     DownlinkEventType = iota // The device acknowledged a confirmed downlink
+	DownlinkNack                             // The device did not acknowledge a confirmed downlink within the attempts
+	DownlinkExpired                          // The downlink expired before it was sent or acknowledged
+)
+
+var downlinkEventTypeNames = map[DownlinkEventType]string{
+	DownlinkAck:     "ack",
+	DownlinkNack:    "nack",
+	DownlinkExpired: "expired",
+}
+
+// String implements fmt.Stringer
+func (eventType DownlinkEventType) String() string {
+	return downlinkEventTypeNames[eventType]
+}
+
+// DownlinkEvent reports what happened to a DownlinkQueueItem
+type DownlinkEvent struct {
+	Type   DownlinkEventType
+	DevEUI uint64
+	Item   *DownlinkQueueItem
+}
+
+/* DownlinkQueue Implementations */
+
+// deviceDownlinkQueue contains the queue of a device
+type deviceDownlinkQueue struct {
+	items    []*DownlinkQueueItem
+	inFlight *DownlinkQueueItem // A confirmed downlink that awaits an acknowledgement
+}
+
+// DownlinkQueue contains the application downlink messages of devices. It
+// retransmits confirmed downlink messages until they are acknowledged or the
+// maximum number of attempts is reached. It is safe for concurrent use.
+type DownlinkQueue struct {
+	maxItems    int
+	maxAttempts int
+	onEvent     func(DownlinkEvent)
+
+	mu      sync.Mutex
+	nextID  uint64
+	devices map[uint64]*deviceDownlinkQueue
+}
+
+// NewDownlinkQueue returns a new DownlinkQueue that holds at most maxItems per
+// device and transmits confirmed downlink messages at most maxAttempts times.
+// The onEvent func may be nil.
+func NewDownlinkQueue(maxItems int, maxAttempts int, onEvent func(DownlinkEvent)) *DownlinkQueue {
+	return &DownlinkQueue{
+		maxItems:    maxItems,
+		maxAttempts: maxAttempts,
+		onEvent:     onEvent,
+		devices:     make(map[uint64]*deviceDownlinkQueue),
+	}
+}
+
+// emit reports events, it must be called without holding the lock
+func (queue *DownlinkQueue) emit(events []DownlinkEvent) {
+	if queue.onEvent == nil {
+		return
+	}
+	for _, event := range events {
+		queue.onEvent(event)
+	}
+}
+
+// Enqueue adds a downlink message to the queue of a device and returns its ID
+func (queue *DownlinkQueue) Enqueue(devEUI uint64, item DownlinkQueueItem) (uint64, error) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	device, ok := queue.devices[devEUI]
+	if !ok {
+		device = &deviceDownlinkQueue{}
+		queue.devices[devEUI] = device
+	}
+	if len(device.items) >= queue.maxItems {
+		return 0, ErrDownlinkQueueFull
+	}
+
+	queue.nextID++
+	item.ID = queue.nextID
+	item.FRMPayload = cloneBytes(item.FRMPayload)
+	item.Attempts = 0
+	device.items = append(device.items, &item)
+	return item.ID, nil
+}
+
+// Len returns the number of downlink messages in the queue of a device,
+// including the confirmed downlink message that awaits an acknowledgement
+func (queue *DownlinkQueue) Len(devEUI uint64) int {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	device, ok := queue.devices[devEUI]
+	if !ok {
+		return 0
+	}
+	if device.inFlight != nil {
+		return len(device.items) + 1
+	}
+	return len(device.items)
+}
+
+// expire removes the expired items of a device
+func (queue *DownlinkQueue) expire(devEUI uint64, device *deviceDownlinkQueue, now time.Time) (events []DownlinkEvent) {
+	expired := func(item *DownlinkQueueItem) bool {
+		return !item.ExpiresAt.IsZero() && !now.Before(item.ExpiresAt)
+	}
+	if device.inFlight != nil && expired(device.inFlight) {
+		events = append(events, DownlinkEvent{Type: DownlinkExpired, DevEUI: devEUI, Item: device.inFlight})
+		device.inFlight = nil
+	}
+	items := device.items[:0]
+	for _, item := range device.items {
+		if expired(item) {
+			events = append(events, DownlinkEvent{Type: DownlinkExpired, DevEUI: devEUI, Item: item})
+			continue
+		}
+		items = append(items, item)
+	}
+	device.items = items
+	return events
+}
+
+// Expire removes the downlink messages that expired at now from all queues
+func (queue *DownlinkQueue) Expire(now time.Time) {
+	queue.mu.Lock()
+	var events []DownlinkEvent
+	for devEUI, device := range queue.devices {
+		events = append(events, queue.expire(devEUI, device, now)...)
+		if len(device.items) == 0 && device.inFlight == nil {
+			delete(queue.devices, devEUI)
+		}
+	}
+	queue.mu.Unlock()
+	queue.emit(events)
+}
+
+// HandleUplink resolves the confirmed downlink message that awaits an
+// acknowledgement, with the ACK bit of an uplink message of the device. If
+// it is not acknowledged, it is retransmitted by Next until the maximum
+// number of attempts is reached.
+func (queue *DownlinkQueue) HandleUplink(devEUI uint64, ack bool, now time.Time) {
+	queue.mu.Lock()
+	var events []DownlinkEvent
+	if device, ok := queue.devices[devEUI]; ok {
+		events = queue.expire(devEUI, device, now)
+		if item := device.inFlight; item != nil {
+			switch {
+			case ack:
+				events = append(events, DownlinkEvent{Type: DownlinkAck, DevEUI: devEUI, Item: item})
+				device.inFlight = nil
+			case item.Attempts >= queue.maxAttempts:
+				events = append(events, DownlinkEvent{Type: DownlinkNack, DevEUI: devEUI, Item: item})
+				device.inFlight = nil
+			}
+		}
+	}
+	queue.mu.Unlock()
+	queue.emit(events)
+}
+
+// Next returns the next downlink message for a device with an FRMPayload of
+// at most maxSize bytes, or nil if there is none. A confirmed downlink message
+// that awaits an acknowledgement is retransmitted first. FPending is set when
+// more downlink messages are waiting.
+func (queue *DownlinkQueue) Next(devEUI uint64, maxSize int, now time.Time) *Downlink {
+	queue.mu.Lock()
+	device, ok := queue.devices[devEUI]
+	if !ok {
+		queue.mu.Unlock()
+		return nil
+	}
+	events := queue.expire(devEUI, device, now)
+
+	item := device.inFlight
+	if item != nil && len(item.FRMPayload) > maxSize {
+		item = nil
+	}
+	if item == nil && device.inFlight == nil {
+		for i, candidate := range device.items {
+			if len(candidate.FRMPayload) > maxSize {
+				continue
+			}
+			item = candidate
+			device.items = append(device.items[:i:i], device.items[i+1:]...)
+			if item.Confirmed {
+				device.inFlight = item
+			}
+			break
+		}
+	}
+
+	var downlink *Downlink
+	if item != nil {
+		item.Attempts++
+		downlink = &Downlink{
+			Confirmed:  item.Confirmed,
+			FPending:   len(device.items) > 0,
+			FPort:      item.FPort,
+			FRMPayload: cloneBytes(item.FRMPayload),
+		}
+	}
+	if len(device.items) == 0 && device.inFlight == nil {
+		delete(queue.devices, devEUI)
+	}
+	queue.mu.Unlock()
+	queue.emit(events)
+	return downlink
+}
+
+/* DownlinkDecider Implementations */
+
+// QueueDownlinkDecider is a DownlinkDecider that sends the downlink messages
+// of a DownlinkQueue, together with the MAC commands of the uplink context.
+// The queue is handled at the Time of the uplink context, so that it follows
+// the Clock of the NetworkServer. Uplink contexts without Time are rejected.
+type QueueDownlinkDecider struct {
+	Queue  *DownlinkQueue
+	Region *Region
+}
+
+// maxFRMPayloadSize returns the maximum FRMPayload size of a downlink message
+// that answers the uplink, which fits both RX1 and RX2
+func (decider *QueueDownlinkDecider) maxFRMPayloadSize(ctx *UplinkContext) (int, error) {
+	region := decider.Region
+	dataRates := []int{region.RX2DataRate}
+	if ctx.Session.RX2Frequency != 0 {
+		dataRates[0] = ctx.Session.RX2DataRate
+	}
+	if len(ctx.RXInfo) > 0 {
+		rx1DataRate, err := region.RX1DataRate(ctx.RXInfo[0].DataRate, ctx.Session.RX1DROffset)
+		if err != nil {
+			return 0, err
+		}
+		dataRates = append(dataRates, rx1DataRate)
+	}
+
+	maxSize := -1
+	for _, dr := range dataRates {
+		size, err := region.MaxPayloadSize(dr, region.DownlinkDwellTime > 0)
+		if err != nil {
+			return 0, err
+		}
+		if maxSize == -1 || size.N < maxSize {
+			maxSize = size.N
+		}
+	}
+	return maxSize, nil
+}
+
+// DecideDownlink implements DownlinkDecider
+func (decider *QueueDownlinkDecider) DecideDownlink(ctx *UplinkContext) (*Downlink, error) {
+	now := ctx.Time
+	if now.IsZero() {
+		return nil, errors.New("The uplink context has no time")
+	}
+	devEUI := ctx.Session.DevEUI
+	decider.Queue.HandleUplink(devEUI, ctx.Uplink.ACK, now)
+
+	downlink, err := DefaultDownlinkDecider{}.DecideDownlink(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if downlink != nil && downlink.FRMPayload != nil {
+		// The MAC commands take the FRMPayload, the queue has to wait
+		downlink.FPending = decider.Queue.Len(devEUI) > 0
+		return downlink, nil
+	}
+
+	maxSize, err := decider.maxFRMPayloadSize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if downlink != nil {
+		maxSize -= len(downlink.FOpts)
+	}
+	next := decider.Queue.Next(devEUI, maxSize, now)
+	if next == nil {
+		if downlink != nil {
+			downlink.FPending = decider.Queue.Len(devEUI) > 0
+		}
+		return downlink, nil
+	}
+	if downlink != nil {
+		next.ACK, next.FOpts = downlink.ACK, downlink.FOpts
+	}
+	return next, nil
+}
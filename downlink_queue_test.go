@@ -0,0 +1,110 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"testing"
+	"time"
+)
+
+/* DownlinkQueue Tests */
+
+func TestDownlinkQueue(t *testing.T) {
+	var events []DownlinkEvent
+	queue := NewDownlinkQueue(3, 2, func(event DownlinkEvent) { events = append(events, event) })
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	devEUI := uint64(0x0004A30B001C0530)
+
+	queue.Enqueue(devEUI, DownlinkQueueItem{FPort: 1, FRMPayload: make([]byte, 100)})
+	confirmedID, _ := queue.Enqueue(devEUI, DownlinkQueueItem{FPort: 2, FRMPayload: []byte{0x01}, Confirmed: true})
+	expiringID, _ := queue.Enqueue(devEUI, DownlinkQueueItem{FPort: 3, ExpiresAt: now.Add(time.Minute)})
+	if _, err := queue.Enqueue(devEUI, DownlinkQueueItem{}); err != ErrDownlinkQueueFull {
+		t.Errorf("Enqueue to a full queue\n   got: %v\n  want: %v", err, ErrDownlinkQueueFull)
+	}
+
+	// The first item does not fit, the confirmed item is sent with FPending
+	downlink := queue.Next(devEUI, 51, now)
+	if downlink == nil || downlink.FPort != 2 || !downlink.Confirmed || !downlink.FPending {
+		t.Fatalf("Next\n   got: %#v", downlink)
+	}
+
+	// Without acknowledgement it is retransmitted until the attempts are used
+	queue.HandleUplink(devEUI, false, now)
+	if downlink := queue.Next(devEUI, 51, now); downlink == nil || downlink.FPort != 2 {
+		t.Fatalf("Next after a missing acknowledgement\n   got: %#v", downlink)
+	}
+	queue.HandleUplink(devEUI, false, now)
+	if len(events) != 1 || events[0].Type != DownlinkNack || events[0].Item.ID != confirmedID || events[0].Item.Attempts != 2 {
+		t.Fatalf("Events after the attempts\n   got: %#v", events)
+	}
+
+	// Expired items are reported
+	queue.Expire(now.Add(time.Minute))
+	if len(events) != 2 || events[1].Type != DownlinkExpired || events[1].Item.ID != expiringID {
+		t.Fatalf("Events after expiry\n   got: %#v", events)
+	}
+
+	downlink = queue.Next(devEUI, 242, now)
+	if downlink == nil || downlink.FPort != 1 || downlink.FPending {
+		t.Errorf("Next of the last item\n   got: %#v", downlink)
+	}
+	if queue.Len(devEUI) != 0 {
+		t.Errorf("Len of an empty queue\n   got: %d\n  want: 0", queue.Len(devEUI))
+	}
+
+	// An acknowledged confirmed item is reported
+	queue.Enqueue(devEUI, DownlinkQueueItem{FPort: 4, Confirmed: true})
+	queue.Next(devEUI, 51, now)
+	queue.HandleUplink(devEUI, true, now)
+	if len(events) != 3 || events[2].Type != DownlinkAck || events[2].Item.FPort != 4 {
+		t.Errorf("Events after an acknowledgement\n   got: %#v", events)
+	}
+}
+
+func TestQueueDownlinkDecider(t *testing.T) {
+	region, _ := GetRegion("EU868", RP002_1_0_3)
+	queue := NewDownlinkQueue(10, 1, nil)
+	decider := &QueueDownlinkDecider{Queue: queue, Region: region}
+	session := testSession(LoRaWAN1_0_2)
+
+	queue.Enqueue(session.DevEUI, DownlinkQueueItem{FPort: 1, FRMPayload: make([]byte, 50)})
+	queue.Enqueue(session.DevEUI, DownlinkQueueItem{FPort: 2, FRMPayload: make([]byte, 51)})
+
+	// RX2 uses DR0 with at most 51 bytes, the MAC command leaves 48 bytes
+	ctx := &UplinkContext{
+		Time:       time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC),
+		Session:    session,
+		Uplink:     &Uplink{Confirmed: true},
+		RXInfo:     []RXInfo{{DataRate: 5}},
+		MACAnswers: []MACCommand{{CID: CIDLinkCheck, Payload: []byte{20, 1}}},
+	}
+	downlink, err := decider.DecideDownlink(ctx)
+	if err != nil {
+		t.Fatalf("DecideDownlink failed: %s", err)
+	}
+	if downlink.FPort != 0 || !downlink.ACK || !downlink.FPending || len(downlink.FOpts) != 3 {
+		t.Errorf("DecideDownlink with MAC commands\n   got: %#v", downlink)
+	}
+
+	ctx.MACAnswers = nil
+	downlink, _ = decider.DecideDownlink(ctx)
+	if downlink.FPort != 1 || !downlink.ACK || !downlink.FPending {
+		t.Errorf("DecideDownlink\n   got: %#v", downlink)
+	}
+
+	// The queue is handled at the time of the uplink context
+	now := ctx.Time.Add(time.Hour)
+	queue.Enqueue(session.DevEUI, DownlinkQueueItem{FPort: 3, ExpiresAt: now})
+	ctx.Time = now.Add(time.Second)
+	downlink, _ = decider.DecideDownlink(ctx)
+	if downlink.FPort != 2 || downlink.FPending {
+		t.Errorf("DecideDownlink after the expiry of an item\n   got: %#v", downlink)
+	}
+
+	ctx.Time = time.Time{}
+	if _, err := decider.DecideDownlink(ctx); err == nil {
+		t.Errorf("DecideDownlink should error without the time of the uplink")
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrNoDownlinkPath is returned when none of the gateways that received an
+// uplink message can transmit the downlink message in RX1 or RX2
+var ErrNoDownlinkPath = errors.New("No gateway can transmit the downlink")
+
+// RXWindow is a receive window of a class A device
+type RXWindow uint8
+
+// Receive windows
+const (
+	RX1 RXWindow = 1
+	RX2 RXWindow = 2
+)
+
+// TXRequest contains a downlink message that is ready to be transmitted by a
+// gateway
+type TXRequest struct {
+	GatewayID  uint64   `json:"gateway_id"`
+	PHYPayload []byte   `json:"phy_payload"`
+	Window     RXWindow `json:"window"`
+	Timestamp  uint32   `json:"timestamp"` // Internal counter of the concentrator in microseconds
+	Frequency  uint32   `json:"frequency"` // Hz
+	DataRate   int      `json:"data_rate"`
+	Power      float64  `json:"power"` // EIRP in dBm
+}
+
+/* DownlinkScheduler Implementations */
+
+// DownlinkScheduler schedules class A downlink messages in the RX1 or RX2
+// window of the best gateway that received the uplink message, while keeping
+// the gateways within their duty cycle. It is safe for concurrent use.
+type DownlinkScheduler struct {
+	region *Region
+
+	mu        sync.Mutex
+	dutyCycle map[uint64]*DutyCycleTracker // Indexed by gateway
+}
+
+// NewDownlinkScheduler returns a new DownlinkScheduler for the region
+func NewDownlinkScheduler(region *Region) *DownlinkScheduler {
+	return &DownlinkScheduler{
+		region:    region,
+		dutyCycle: make(map[uint64]*DutyCycleTracker),
+	}
+}
+
+// rxDelays returns the delays of RX1 and RX2 after the end of the uplink.
+// Join-accept messages use the join-accept delays of the region, data
+// messages use the RX delay of the session.
+func (scheduler *DownlinkScheduler) rxDelays(phyPayload *PHYPayload, session *DeviceSession) (time.Duration, time.Duration) {
+	if phyPayload.MHDR.MType == macMTypeJoinAccept {
+		return scheduler.region.JoinAcceptDelay1, scheduler.region.JoinAcceptDelay2
+	}
+	rx1 := scheduler.region.ReceiveDelay1
+	if session != nil && session.RXDelay > 0 {
+		rx1 = time.Duration(session.RXDelay) * time.Second
+	}
+	return rx1, rx1 + time.Second
+}
+
+// candidates returns the TXRequests in RX1 and RX2 for a gateway
+func (scheduler *DownlinkScheduler) candidates(rxInfo RXInfo, phyPayload *PHYPayload, session *DeviceSession) ([]*TXRequest, error) {
+	region := scheduler.region
+	rx1Delay, rx2Delay := scheduler.rxDelays(phyPayload, session)
+
+	var rx1DROffset int
+	rx2Frequency, rx2DataRate := region.RX2Frequency, region.RX2DataRate
+	if session != nil && phyPayload.MHDR.MType != macMTypeJoinAccept {
+		rx1DROffset = session.RX1DROffset
+		if session.RX2Frequency != 0 {
+			rx2Frequency, rx2DataRate = session.RX2Frequency, session.RX2DataRate
+		}
+	}
+
+	rx1Frequency, err := region.RX1Frequency(rxInfo.Frequency)
+	if err != nil {
+		return nil, err
+	}
+	rx1DataRate, err := region.RX1DataRate(rxInfo.DataRate, rx1DROffset)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*TXRequest{
+		{
+			GatewayID: rxInfo.GatewayID,
+			Window:    RX1,
+			Timestamp: rxInfo.Timestamp + uint32(rx1Delay/time.Microsecond),
+			Frequency: rx1Frequency,
+			DataRate:  rx1DataRate,
+			Power:     region.MaxEIRP,
+		},
+		{
+			GatewayID: rxInfo.GatewayID,
+			Window:    RX2,
+			Timestamp: rxInfo.Timestamp + uint32(rx2Delay/time.Microsecond),
+			Frequency: rx2Frequency,
+			DataRate:  rx2DataRate,
+			Power:     region.MaxEIRP,
+		},
+	}, nil
+}
+
+// Schedule returns the TXRequest for a downlink message that answers the
+// deduplicated uplink message. The session may be nil for join-accept
+// messages. Gateways are tried from the best to the worst SNR and RSSI, and
+// RX1 is preferred over RX2. Windows that already passed at now, or that
+// would exceed the duty cycle of the gateway, are skipped, as are gateways of
+// which the uplink metadata does not map to downlink windows.
+func (scheduler *DownlinkScheduler) Schedule(uplink *DeduplicatedUplink, phyPayload *PHYPayload, session *DeviceSession, now time.Time) (*TXRequest, error) {
+	data := phyPayload.Bytes()
+
+	rxInfo := append([]RXInfo(nil), uplink.RXInfo...)
+	sort.SliceStable(rxInfo, func(i, j int) bool {
+		if rxInfo[i].SNR != rxInfo[j].SNR {
+			return rxInfo[i].SNR > rxInfo[j].SNR
+		}
+		return rxInfo[i].RSSI > rxInfo[j].RSSI
+	})
+
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	rx1Delay, rx2Delay := scheduler.rxDelays(phyPayload, session)
+	var candidatesErr error
+	var scheduled bool // Whether a gateway produced candidates
+	for _, gateway := range rxInfo {
+		candidates, err := scheduler.candidates(gateway, phyPayload, session)
+		if err != nil {
+			candidatesErr = err
+			continue
+		}
+		scheduled = true
+		received := gateway.Time
+		if received.IsZero() {
+			received = now
+		}
+		tracker, ok := scheduler.dutyCycle[gateway.GatewayID]
+		if !ok {
+			tracker = NewDutyCycleTracker(scheduler.region, true)
+			scheduler.dutyCycle[gateway.GatewayID] = tracker
+		}
+
+		for _, candidate := range candidates {
+			delay := rx1Delay
+			if candidate.Window == RX2 {
+				delay = rx2Delay
+			}
+			start := received.Add(delay)
+			if !now.Before(start) {
+				continue
+			}
+			timeOnAir, err := scheduler.region.TimeOnAir(candidate.DataRate, len(data), false)
+			if err != nil {
+				return nil, err
+			}
+			next, err := tracker.NextTransmission(candidate.Frequency, timeOnAir, start)
+			if err != nil || next.After(start) {
+				continue
+			}
+			if err := tracker.Record(candidate.Frequency, timeOnAir, start); err != nil {
+				return nil, err
+			}
+			candidate.PHYPayload = data
+			return candidate, nil
+		}
+	}
+	if !scheduled && candidatesErr != nil {
+		return nil, candidatesErr
+	}
+	return nil, ErrNoDownlinkPath
+}
@@ -0,0 +1,84 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"testing"
+	"time"
+)
+
+/* DownlinkScheduler Tests */
+
+func TestDownlinkScheduler(t *testing.T) {
+	region, _ := GetRegion("EU868", RP002_1_0_3)
+	received := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	uplink := &DeduplicatedUplink{RXInfo: []RXInfo{
+		{GatewayID: 1, SNR: 2, Timestamp: 1000, Time: received, Frequency: 868100000, DataRate: 0},
+		{GatewayID: 2, SNR: 8, Timestamp: 5000, Time: received, Frequency: 868100000, DataRate: 0},
+	}}
+	session := testSession(LoRaWAN1_0_2)
+	session.RX1DROffset = 0
+	phyPayload, _ := session.EncodeDownlink(&Downlink{ACK: true})
+
+	scheduler := NewDownlinkScheduler(region)
+	txRequest, err := scheduler.Schedule(uplink, phyPayload, session, received)
+	if err != nil {
+		t.Fatalf("Schedule failed: %s", err)
+	}
+	want := TXRequest{GatewayID: 2, PHYPayload: phyPayload.Bytes(), Window: RX1, Timestamp: 1005000, Frequency: 868100000, DataRate: 0, Power: 16}
+	if txRequest.GatewayID != want.GatewayID || txRequest.Window != want.Window || txRequest.Timestamp != want.Timestamp ||
+		txRequest.Frequency != want.Frequency || txRequest.DataRate != want.DataRate || txRequest.Power != want.Power {
+		t.Errorf("Schedule\n   got: %#v\n  want: %#v", txRequest, want)
+	}
+
+	// The RX delay of the session
+	session.RXDelay = 3
+	if txRequest, _ := scheduler.Schedule(uplink, phyPayload, session, received); txRequest.Timestamp != 3005000 {
+		t.Errorf("Schedule with RXDelay 3\n   got: %d\n  want: %d", txRequest.Timestamp, 3005000)
+	}
+	session.RXDelay = 0
+
+	// Join-accept messages use the join-accept delays
+	joinAccept := &PHYPayload{MHDR: &MHDR{MType: macMTypeJoinAccept, Major: macMajorLoRaWANR1}, RawMACPayload: make([]byte, 12), MIC: make([]byte, 4)}
+	if txRequest, _ := scheduler.Schedule(uplink, joinAccept, nil, received); txRequest.Timestamp != 5005000 {
+		t.Errorf("Schedule of a join-accept\n   got: %d\n  want: %d", txRequest.Timestamp, 5005000)
+	}
+
+	// RX2 is used when RX1 already passed
+	txRequest, err = scheduler.Schedule(uplink, phyPayload, session, received.Add(1500*time.Millisecond))
+	if err != nil || txRequest.Window != RX2 || txRequest.Timestamp != 2005000 || txRequest.Frequency != 869525000 {
+		t.Errorf("Schedule after RX1\n   got: %#v, %v", txRequest, err)
+	}
+	if _, err := scheduler.Schedule(uplink, phyPayload, session, received.Add(3*time.Second)); err != ErrNoDownlinkPath {
+		t.Errorf("Schedule after RX2\n   got: %v\n  want: %v", err, ErrNoDownlinkPath)
+	}
+
+	// RX2 and the other gateway are used when RX1 exceeds the duty cycle
+	windows := map[RXWindow]bool{}
+	gateways := map[uint64]bool{}
+	for i := 0; i < 1000; i++ {
+		txRequest, err := scheduler.Schedule(uplink, phyPayload, session, received)
+		if err != nil {
+			break
+		}
+		windows[txRequest.Window] = true
+		gateways[txRequest.GatewayID] = true
+	}
+	if !windows[RX2] || !gateways[1] {
+		t.Errorf("Schedule should fall back to RX2 and other gateways\n   got: windows %v, gateways %v", windows, gateways)
+	}
+
+	// Gateways with metadata that does not map to a downlink window are skipped
+	invalid := RXInfo{GatewayID: 3, SNR: 10, Timestamp: 9000, Time: received, Frequency: 868100000, DataRate: 20}
+	scheduler = NewDownlinkScheduler(region)
+	uplink.RXInfo = append(uplink.RXInfo, invalid)
+	if txRequest, err := scheduler.Schedule(uplink, phyPayload, session, received); err != nil || txRequest.GatewayID != 2 {
+		t.Errorf("Schedule with an invalid gateway\n   got: %#v, %v", txRequest, err)
+	}
+	uplink.RXInfo = []RXInfo{invalid}
+	if _, err := scheduler.Schedule(uplink, phyPayload, session, received); err == nil || err == ErrNoDownlinkPath {
+		t.Errorf("Schedule with only an invalid gateway\n   got: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DutyCycleWindow is the observation period over which the duty cycle of a
+// sub-band is enforced
+const DutyCycleWindow = time.Hour
+
+// ErrDwellTimeExceeded is returned when a transmission takes longer than the
+// dwell time of the region allows
+var ErrDwellTimeExceeded = errors.New("The time on air exceeds the dwell time")
+
+type transmission struct {
+	start     time.Time
+	timeOnAir time.Duration
+}
+
+/* DutyCycleTracker Implementations */
+
+// DutyCycleTracker records the transmissions of a device or gateway to
+// enforce the duty cycle of the sub-bands and the dwell time of a region.
+// It is safe for concurrent use.
+type DutyCycleTracker struct {
+	region    *Region
+	dwellTime time.Duration
+
+	mu            sync.Mutex
+	transmissions map[int][]transmission // Indexed by sub-band
+}
+
+// NewDutyCycleTracker returns a new DutyCycleTracker for uplink (device)
+// or downlink (gateway) transmissions in the region
+func NewDutyCycleTracker(region *Region, downlink bool) *DutyCycleTracker {
+	dwellTime := region.UplinkDwellTime
+	if downlink {
+		dwellTime = region.DownlinkDwellTime
+	}
+	return &DutyCycleTracker{
+		region:        region,
+		dwellTime:     dwellTime,
+		transmissions: make(map[int][]transmission),
+	}
+}
+
+// subBand returns the index and the SubBand that contains the frequency
+func (tracker *DutyCycleTracker) subBand(frequency uint32) (int, SubBand, error) {
+	for i, subBand := range tracker.region.SubBands {
+		if frequency >= subBand.MinFrequency && frequency <= subBand.MaxFrequency {
+			return i, subBand, nil
+		}
+	}
+	return 0, SubBand{}, fmt.Errorf("Frequency %d is outside the bands of %s", frequency, tracker.region.Name)
+}
+
+// checkDwellTime returns ErrDwellTimeExceeded if timeOnAir exceeds the dwell time
+func (tracker *DutyCycleTracker) checkDwellTime(timeOnAir time.Duration) error {
+	if tracker.dwellTime > 0 && timeOnAir > tracker.dwellTime {
+		return ErrDwellTimeExceeded
+	}
+	return nil
+}
+
+// Record records a transmission on the frequency that started at timestamp
+func (tracker *DutyCycleTracker) Record(frequency uint32, timeOnAir time.Duration, timestamp time.Time) error {
+	index, subBand, err := tracker.subBand(frequency)
+	if err != nil {
+		return err
+	}
+	if err := tracker.checkDwellTime(timeOnAir); err != nil {
+		return err
+	}
+	if subBand.DutyCycle >= 1 {
+		return nil
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	// Transmissions are not always recorded in order: the DownlinkScheduler
+	// records RX2 before the RX1 that precedes it. They are kept ordered by
+	// start, and those that are outside the window ending at the recorded
+	// transmission are pruned.
+	transmissions := tracker.prune(index, timestamp)
+	i := sort.Search(len(transmissions), func(i int) bool {
+		return transmissions[i].start.After(timestamp)
+	})
+	transmissions = append(transmissions, transmission{})
+	copy(transmissions[i+1:], transmissions[i:])
+	transmissions[i] = transmission{start: timestamp, timeOnAir: timeOnAir}
+	tracker.transmissions[index] = transmissions
+	return nil
+}
+
+// prune removes the transmissions of the sub-band that start before the
+// window ending at now, and returns the remaining transmissions, which may
+// include transmissions that start after now. Transmissions are ordered by
+// start, so the oldest are at the start.
+func (tracker *DutyCycleTracker) prune(index int, now time.Time) []transmission {
+	transmissions := tracker.transmissions[index]
+	for len(transmissions) > 0 && !transmissions[0].start.After(now.Add(-DutyCycleWindow)) {
+		transmissions = transmissions[1:]
+	}
+	tracker.transmissions[index] = transmissions
+	return transmissions
+}
+
+// timeOnAirInWindow returns the time on air of the transmissions that start
+// in the window ending at end
+func timeOnAirInWindow(transmissions []transmission, end time.Time) time.Duration {
+	var used time.Duration
+	for _, tx := range transmissions {
+		if tx.start.After(end.Add(-DutyCycleWindow)) && !tx.start.After(end) {
+			used += tx.timeOnAir
+		}
+	}
+	return used
+}
+
+// NextTransmission returns the earliest time from now at which a transmission
+// of timeOnAir may start on the frequency. Transmissions that are recorded
+// after now, such as scheduled downlink messages, are taken into account: the
+// transmission must also fit the windows that end at those transmissions.
+func (tracker *DutyCycleTracker) NextTransmission(frequency uint32, timeOnAir time.Duration, now time.Time) (time.Time, error) {
+	index, subBand, err := tracker.subBand(frequency)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := tracker.checkDwellTime(timeOnAir); err != nil {
+		return time.Time{}, err
+	}
+	if subBand.DutyCycle >= 1 {
+		return now, nil
+	}
+
+	budget := time.Duration(subBand.DutyCycle * float64(DutyCycleWindow))
+	if timeOnAir > budget {
+		return time.Time{}, fmt.Errorf("The time on air %s exceeds the duty cycle budget %s", timeOnAir, budget)
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	transmissions := tracker.prune(index, now)
+	fits := func(start time.Time) bool {
+		if timeOnAirInWindow(transmissions, start)+timeOnAir > budget {
+			return false
+		}
+		for _, tx := range transmissions {
+			if tx.start.After(start) && tx.start.Before(start.Add(DutyCycleWindow)) &&
+				timeOnAirInWindow(transmissions, tx.start)+timeOnAir > budget {
+				return false
+			}
+		}
+		return true
+	}
+
+	// The time on air in a window only decreases when a transmission leaves
+	// it, so those are the moments to try after now
+	if fits(now) {
+		return now, nil
+	}
+	next := now
+	for _, tx := range transmissions {
+		next = tx.start.Add(DutyCycleWindow)
+		if next.After(now) && fits(next) {
+			break
+		}
+	}
+	return next, nil
+}
+
+// Usage returns the fraction of the duty cycle budget of the sub-band of the
+// frequency that is used in the window ending at now
+func (tracker *DutyCycleTracker) Usage(frequency uint32, now time.Time) (float64, error) {
+	index, subBand, err := tracker.subBand(frequency)
+	if err != nil {
+		return 0, err
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	used := timeOnAirInWindow(tracker.prune(index, now), now)
+	return float64(used) / (subBand.DutyCycle * float64(DutyCycleWindow)), nil
+}
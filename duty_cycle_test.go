@@ -0,0 +1,119 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"testing"
+	"time"
+)
+
+/* DutyCycleTracker Tests */
+
+func TestDutyCycleTracker(t *testing.T) {
+	region, _ := GetRegion("EU868", RP002_1_0_3)
+	tracker := NewDutyCycleTracker(region, false)
+	start := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// 1% of an hour is 36 seconds
+	for i := 0; i < 3; i++ {
+		if err := tracker.Record(868100000, 10*time.Second, start.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatalf("Record failed: %s", err)
+		}
+	}
+
+	next, err := tracker.NextTransmission(868300000, 5*time.Second, start.Add(5*time.Minute))
+	if err != nil {
+		t.Fatalf("NextTransmission failed: %s", err)
+	}
+	if want := start.Add(5 * time.Minute); !next.Equal(want) {
+		t.Errorf("NextTransmission with budget left\n   got: %s\n  want: %s", next, want)
+	}
+
+	next, _ = tracker.NextTransmission(868300000, 10*time.Second, start.Add(5*time.Minute))
+	if want := start.Add(DutyCycleWindow); !next.Equal(want) {
+		t.Errorf("NextTransmission without budget left\n   got: %s\n  want: %s", next, want)
+	}
+
+	next, _ = tracker.NextTransmission(868300000, 30*time.Second, start.Add(5*time.Minute))
+	if want := start.Add(2*time.Minute + DutyCycleWindow); !next.Equal(want) {
+		t.Errorf("NextTransmission for a long transmission\n   got: %s\n  want: %s", next, want)
+	}
+
+	// Other sub-bands are not affected
+	next, _ = tracker.NextTransmission(869525000, 10*time.Second, start.Add(5*time.Minute))
+	if want := start.Add(5 * time.Minute); !next.Equal(want) {
+		t.Errorf("NextTransmission in another sub-band\n   got: %s\n  want: %s", next, want)
+	}
+
+	usage, _ := tracker.Usage(868500000, start.Add(5*time.Minute))
+	if usage < 0.83 || usage > 0.84 {
+		t.Errorf("Usage\n   got: %f\n  want: %f", usage, 30.0/36.0)
+	}
+
+	if _, err := tracker.NextTransmission(868100000, 40*time.Second, start); err == nil {
+		t.Errorf("NextTransmission should error when the time on air exceeds the budget")
+	}
+	if _, err := tracker.NextTransmission(915000000, time.Second, start); err == nil {
+		t.Errorf("NextTransmission should error on frequencies outside the region")
+	}
+}
+
+func TestDutyCycleTrackerOutOfOrder(t *testing.T) {
+	region, _ := GetRegion("EU868", RP002_1_0_3)
+	tracker := NewDutyCycleTracker(region, true)
+	start := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// Like RX2 and RX1 of the DownlinkScheduler, the later transmission is
+	// recorded first
+	tracker.Record(868100000, 10*time.Second, start.Add(2*time.Hour))
+	tracker.Record(868100000, 20*time.Second, start)
+
+	usage, _ := tracker.Usage(868100000, start.Add(time.Minute))
+	if usage < 0.55 || usage > 0.56 {
+		t.Errorf("Usage with an earlier transmission recorded last\n   got: %f\n  want: %f", usage, 20.0/36.0)
+	}
+
+	// The later transmission leaves no budget in the window that ends at it
+	next, _ := tracker.NextTransmission(868100000, 30*time.Second, start.Add(90*time.Minute))
+	if want := start.Add(3 * time.Hour); !next.Equal(want) {
+		t.Errorf("NextTransmission before a recorded transmission\n   got: %s\n  want: %s", next, want)
+	}
+	next, _ = tracker.NextTransmission(868100000, 20*time.Second, start.Add(90*time.Minute))
+	if want := start.Add(90 * time.Minute); !next.Equal(want) {
+		t.Errorf("NextTransmission that fits before a recorded transmission\n   got: %s\n  want: %s", next, want)
+	}
+	usage, _ = tracker.Usage(868100000, start.Add(2*time.Hour))
+	if usage < 0.27 || usage > 0.28 {
+		t.Errorf("Usage after the window of the earlier transmission\n   got: %f\n  want: %f", usage, 10.0/36.0)
+	}
+}
+
+func TestDutyCycleTrackerRecordPrunes(t *testing.T) {
+	region, _ := GetRegion("EU868", RP002_1_0_3)
+	tracker := NewDutyCycleTracker(region, false)
+	start := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 24*60; i++ {
+		tracker.Record(868100000, time.Second, start.Add(time.Duration(i)*time.Minute))
+	}
+	index, _, _ := tracker.subBand(868100000)
+	if got := len(tracker.transmissions[index]); got != 60 {
+		t.Errorf("Transmissions kept by Record\n   got: %d\n  want: %d", got, 60)
+	}
+}
+
+func TestDutyCycleTrackerDwellTime(t *testing.T) {
+	region, _ := GetRegion("AS923", RP002_1_0_3)
+	tracker := NewDutyCycleTracker(region, true)
+	now := time.Now()
+
+	if _, err := tracker.NextTransmission(923200000, 500*time.Millisecond, now); err != ErrDwellTimeExceeded {
+		t.Errorf("NextTransmission\n   got: %v\n  want: %v", err, ErrDwellTimeExceeded)
+	}
+
+	next, err := tracker.NextTransmission(923200000, 300*time.Millisecond, now)
+	if err != nil || !next.Equal(now) {
+		t.Errorf("NextTransmission\n   got: %s, %v\n  want: %s", next, err, now)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import "errors"
+
+// DefaultMaxFCntGap is the MAX_FCNT_GAP of LoRaWAN 1.0
+const DefaultMaxFCntGap = 16384
+
+// ErrFCntGapTooLarge is returned when the frame counter of an uplink message
+// is too far ahead of the expected frame counter
+var ErrFCntGapTooLarge = errors.New("The frame counter gap is too large")
+
+/* FCntPolicy Implementations */
+
+// FCntPolicy contains the rules for the frame counters of uplink messages.
+// The zero value rejects replays, but does not limit the gap, as LoRaWAN
+// 1.0.4 and 1.1 no longer define MAX_FCNT_GAP.
+type FCntPolicy struct {
+	// MaxGap is the maximum difference between the expected and the received
+	// frame counter. Zero disables the check.
+	MaxGap uint32 `json:"max_gap"`
+
+	// Relaxed accepts frame counters that restart from zero, for ABP devices
+	// that reset their frame counter when they reboot. This disables the
+	// protection against replays.
+	Relaxed bool `json:"relaxed"`
+}
+
+// DefaultFCntPolicy is the FCntPolicy of LoRaWAN 1.0
+var DefaultFCntPolicy = FCntPolicy{MaxGap: DefaultMaxFCntGap}
+
+// FullFCnt returns the 32-bit frame counter of which fCnt contains the 16
+// least significant bits, assuming that it is not lower than the expected
+// frame counter. This handles the rollover of the 16-bit frame counter.
+func (policy FCntPolicy) FullFCnt(expected uint32, fCnt uint16) uint32 {
+	full := expected&0xFFFF0000 | uint32(fCnt)
+	if full < expected {
+		full += 0x10000
+	}
+	return full
+}
+
+// Validate checks the full frame counter of an uplink message against the
+// expected frame counter
+func (policy FCntPolicy) Validate(expected uint32, fCnt uint32) error {
+	if fCnt < expected {
+		if policy.Relaxed {
+			return nil
+		}
+		return ErrFCntTooLow
+	}
+	if policy.MaxGap > 0 && fCnt-expected >= policy.MaxGap {
+		return ErrFCntGapTooLarge
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import "testing"
+
+/* FCntPolicy Tests */
+
+func TestFCntPolicyFullFCnt(t *testing.T) {
+	tests := []struct {
+		expected uint32
+		fCnt     uint16
+		full     uint32
+	}{
+		{0, 0, 0},
+		{5, 7, 7},
+		{0xFFFE, 0xFFFF, 0xFFFF},
+		{0xFFFE, 0x0001, 0x10001},
+		{0x1FFFF, 0x0000, 0x20000},
+	}
+	for _, test := range tests {
+		if full := DefaultFCntPolicy.FullFCnt(test.expected, test.fCnt); full != test.full {
+			t.Errorf("FullFCnt(%#x, %#x)\n   got: %#x\n  want: %#x", test.expected, test.fCnt, full, test.full)
+		}
+	}
+}
+
+func TestFCntPolicyValidate(t *testing.T) {
+	tests := []struct {
+		policy   FCntPolicy
+		expected uint32
+		fCnt     uint32
+		err      error
+	}{
+		{DefaultFCntPolicy, 10, 10, nil},
+		{DefaultFCntPolicy, 10, 9, ErrFCntTooLow},
+		{DefaultFCntPolicy, 10, 10 + DefaultMaxFCntGap - 1, nil},
+		{DefaultFCntPolicy, 10, 10 + DefaultMaxFCntGap, ErrFCntGapTooLarge},
+		{FCntPolicy{}, 10, 10 + DefaultMaxFCntGap, nil},
+		{FCntPolicy{Relaxed: true}, 10, 0, nil},
+	}
+	for _, test := range tests {
+		if err := test.policy.Validate(test.expected, test.fCnt); err != test.err {
+			t.Errorf("%#v.Validate(%d, %d)\n   got: %v\n  want: %v", test.policy, test.expected, test.fCnt, err, test.err)
+		}
+	}
+}
+
+func TestDeviceSessionFCntPolicy(t *testing.T) {
+	// A gap larger than MAX_FCNT_GAP is rejected
+	session := testSession(LoRaWAN1_0_2)
+	session.FCntPolicy = DefaultFCntPolicy
+	phyPayload, _ := ParsePHYPayload(testUplink(session, DefaultMaxFCntGap+1, false, 1, []byte{0x01}))
+	if _, err := session.DecodeUplink(phyPayload, testTXParams); err != ErrFCntGapTooLarge {
+		t.Errorf("DecodeUplink with a large gap\n   got: %v\n  want: %v", err, ErrFCntGapTooLarge)
+	}
+	if session.FCntUp != 0 {
+		t.Errorf("DecodeUplink with a large gap should not change FCntUp")
+	}
+
+	// A device that reset its frame counter is rejected, unless the policy is relaxed
+	session.FCntUp = 100
+	phyPayload, _ = ParsePHYPayload(testUplink(session, 0, false, 1, []byte{0x01}))
+	if _, err := session.DecodeUplink(phyPayload, testTXParams); err != ErrFCntTooLow {
+		t.Errorf("DecodeUplink after a reset\n   got: %v\n  want: %v", err, ErrFCntTooLow)
+	}
+	if _, _, err := ResolveSession(phyPayload, testTXParams, []*DeviceSession{session}); err != ErrNoMatchingSession {
+		t.Errorf("ResolveSession after a reset\n   got: %v\n  want: %v", err, ErrNoMatchingSession)
+	}
+
+	session.FCntPolicy.Relaxed = true
+	if _, _, err := ResolveSession(phyPayload, testTXParams, []*DeviceSession{session}); err != nil {
+		t.Errorf("ResolveSession after a reset with a relaxed policy failed: %s", err)
+	}
+	uplink, err := session.DecodeUplink(phyPayload, testTXParams)
+	if err != nil {
+		t.Fatalf("DecodeUplink after a reset with a relaxed policy failed: %s", err)
+	}
+	if uplink.FCnt != 0 || session.FCntUp != 1 {
+		t.Errorf("DecodeUplink after a reset with a relaxed policy\n   got: FCnt %d, FCntUp %d\n  want: FCnt 0, FCntUp 1", uplink.FCnt, session.FCntUp)
+	}
+}
@@ -4,34 +4,294 @@
 
 package lorawan
 
-import "fmt"
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"fmt"
+)
 
+// joinReqTypeJoinRequest is the JoinReqType of a join request message in the
+// join accept MIC of LoRaWAN 1.1. Rejoin requests use their RejoinType.
+const joinReqTypeJoinRequest = 0xFF
+
+// RejoinType values
+// See Section 6.2.4 of the LoRaWan 1.1 Specification
+const (
+	// RejoinType0 resets the session and radio parameters of the device
+	RejoinType0 = 0
+	// RejoinType1 restores a lost session, like a join request
+	RejoinType1 = 1
+	// RejoinType2 rekeys the session of the device, keeping its radio parameters
+	RejoinType2 = 2
+)
+
+/* JoinRequestPayload Implementations */
+
+// JoinRequestPayload contains the data structure for the MAC Payload of a join
+// request message
+// See Section 6.2.5 of the LoRaWan Specification
 type JoinRequestPayload struct {
+	JoinEUI  uint64 // AppEUI in LoRaWAN 1.0
+	DevEUI   uint64
+	DevNonce uint16
 }
 
+// Bytes returns the binary representation of the JoinRequestPayload
 func (joinRequestPayload *JoinRequestPayload) Bytes() []byte {
-	return []byte{}
+	joinRequestbuf := new(bytes.Buffer)
+	binary.Write(joinRequestbuf, binary.LittleEndian, joinRequestPayload.JoinEUI)
+	binary.Write(joinRequestbuf, binary.LittleEndian, joinRequestPayload.DevEUI)
+	binary.Write(joinRequestbuf, binary.LittleEndian, joinRequestPayload.DevNonce)
+	return joinRequestbuf.Bytes()
 }
 
-func (joinRequestPayload *JoinRequestPayload) CalculateMIC(mhdr *MHDR, nwkSKey []byte) ([]byte, error) {
-	return nil, nil
+// CalculateMIC calculates the Message Integrity Code for a join request
+// message with the AppKey (LoRaWAN 1.0) or the NwkKey (LoRaWAN 1.1)
+// See Section 6.2.5 of the LoRaWan Specification
+func (joinRequestPayload *JoinRequestPayload) CalculateMIC(mhdr *MHDR, key []byte) ([]byte, error) {
+	cmac, err := calculateCMAC(key, []byte{mhdr.Byte()}, joinRequestPayload.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return cmac[0:4], nil
 }
 
+// ParseJoinRequestPayload parses binary data to a JoinRequestPayload
 func ParseJoinRequestPayload(data []byte) (*JoinRequestPayload, error) {
-	return nil, fmt.Errorf("Join messages are not implemented yet.")
+	if len(data) != 18 {
+		// MACPayload: JoinEUI(8), DevEUI(8) and DevNonce(2)
+		return nil, fmt.Errorf("The join request MACPayload should be 18 bytes")
+	}
+	return &JoinRequestPayload{
+		JoinEUI:  binary.LittleEndian.Uint64(data[0:8]),
+		DevEUI:   binary.LittleEndian.Uint64(data[8:16]),
+		DevNonce: binary.LittleEndian.Uint16(data[16:18]),
+	}, nil
 }
 
+/* JoinAcceptPayload Implementations */
+
+// DLSettings contains the downlink settings of a join accept message
+type DLSettings struct {
+	OptNeg      bool // Set by LoRaWAN 1.1 join servers
+	RX1DROffset uint8
+	RX2DataRate uint8
+}
+
+// Byte returns the byte representation of the DLSettings
+func (dlSettings *DLSettings) Byte() byte {
+	return boolToByte(dlSettings.OptNeg)<<7 | (dlSettings.RX1DROffset&0x7)<<4 | dlSettings.RX2DataRate&0xF
+}
+
+// ParseDLSettings parses binary data to DLSettings
+func ParseDLSettings(data byte) DLSettings {
+	return DLSettings{
+		OptNeg:      data&0x80 != 0,
+		RX1DROffset: (data & 0x70) >> 4,
+		RX2DataRate: data & 0xF,
+	}
+}
+
+// JoinAcceptPayload contains the data structure for the decrypted MAC Payload
+// of a join accept message
+// See Section 6.2.6 of the LoRaWan Specification
 type JoinAcceptPayload struct {
+	JoinNonce  uint32 // 24 bits, AppNonce in LoRaWAN 1.0
+	NetID      uint32 // 24 bits
+	DevAddr    uint32
+	DLSettings DLSettings
+	RXDelay    uint8  // Seconds, zero means one second
+	CFList     []byte // Empty or 16 bytes
 }
 
+// Bytes returns the binary representation of the JoinAcceptPayload
 func (joinAcceptPayload *JoinAcceptPayload) Bytes() []byte {
-	return []byte{}
+	joinAcceptbuf := new(bytes.Buffer)
+	joinAcceptbuf.Write(uint24Bytes(joinAcceptPayload.JoinNonce))
+	joinAcceptbuf.Write(uint24Bytes(joinAcceptPayload.NetID))
+	binary.Write(joinAcceptbuf, binary.LittleEndian, joinAcceptPayload.DevAddr)
+	joinAcceptbuf.WriteByte(joinAcceptPayload.DLSettings.Byte())
+	joinAcceptbuf.WriteByte(joinAcceptPayload.RXDelay & 0xF)
+	joinAcceptbuf.Write(joinAcceptPayload.CFList)
+	return joinAcceptbuf.Bytes()
+}
+
+// CalculateMIC calculates the Message Integrity Code for a LoRaWAN 1.0 join
+// accept message with the AppKey
+// See Section 6.2.6 of the LoRaWan Specification
+func (joinAcceptPayload *JoinAcceptPayload) CalculateMIC(mhdr *MHDR, key []byte) ([]byte, error) {
+	cmac, err := calculateCMAC(key, []byte{mhdr.Byte()}, joinAcceptPayload.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return cmac[0:4], nil
 }
 
-func (joinAcceptPayload *JoinAcceptPayload) CalculateMIC(mhdr *MHDR, nwkSKey []byte) ([]byte, error) {
-	return nil, nil
+// CalculateMICWithJoinRequest calculates the Message Integrity Code for a
+// LoRaWAN 1.1 join accept message (with OptNeg set) with the JSIntKey, which
+// includes the JoinReqType, JoinEUI and DevNonce of the request
+// See Section 6.2.3 of the LoRaWan 1.1 Specification
+func (joinAcceptPayload *JoinAcceptPayload) CalculateMICWithJoinRequest(mhdr *MHDR, jsIntKey []byte, joinReqType byte, joinEUI uint64, devNonce uint16) ([]byte, error) {
+	requestbuf := new(bytes.Buffer)
+	requestbuf.WriteByte(joinReqType)
+	binary.Write(requestbuf, binary.LittleEndian, joinEUI)
+	binary.Write(requestbuf, binary.LittleEndian, devNonce)
+	cmac, err := calculateCMAC(jsIntKey, requestbuf.Bytes(), []byte{mhdr.Byte()}, joinAcceptPayload.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return cmac[0:4], nil
 }
 
+// ParseJoinAcceptPayload parses decrypted binary data to a JoinAcceptPayload
 func ParseJoinAcceptPayload(data []byte) (*JoinAcceptPayload, error) {
-	return nil, fmt.Errorf("Join messages are not implemented yet.")
+	if len(data) != 12 && len(data) != 28 {
+		// MACPayload: JoinNonce(3), NetID(3), DevAddr(4), DLSettings(1), RXDelay(1) and optional CFList(16)
+		return nil, fmt.Errorf("The join accept MACPayload should be 12 or 28 bytes")
+	}
+	joinAcceptPayload := &JoinAcceptPayload{
+		JoinNonce:  parseUint24(data[0:3]),
+		NetID:      parseUint24(data[3:6]),
+		DevAddr:    binary.LittleEndian.Uint32(data[6:10]),
+		DLSettings: ParseDLSettings(data[10]),
+		RXDelay:    data[11] & 0xF,
+	}
+	if len(data) == 28 {
+		joinAcceptPayload.CFList = cloneBytes(data[12:28])
+	}
+	return joinAcceptPayload, nil
+}
+
+/* RejoinRequestPayload Implementations */
+
+// RejoinRequestPayload contains the data structure for the MAC Payload of a
+// rejoin request message. Types 0 and 2 carry the NetID, type 1 carries the
+// JoinEUI.
+// See Section 6.2.4 of the LoRaWan 1.1 Specification
+type RejoinRequestPayload struct {
+	RejoinType uint8
+	NetID      uint32 // 24 bits, types 0 and 2
+	JoinEUI    uint64 // Type 1
+	DevEUI     uint64
+	RJCount    uint16 // RJcount0 for types 0 and 2, RJcount1 for type 1
+}
+
+// Bytes returns the binary representation of the RejoinRequestPayload
+func (rejoinRequestPayload *RejoinRequestPayload) Bytes() []byte {
+	rejoinRequestbuf := new(bytes.Buffer)
+	rejoinRequestbuf.WriteByte(rejoinRequestPayload.RejoinType)
+	if rejoinRequestPayload.RejoinType == RejoinType1 {
+		binary.Write(rejoinRequestbuf, binary.LittleEndian, rejoinRequestPayload.JoinEUI)
+	} else {
+		rejoinRequestbuf.Write(uint24Bytes(rejoinRequestPayload.NetID))
+	}
+	binary.Write(rejoinRequestbuf, binary.LittleEndian, rejoinRequestPayload.DevEUI)
+	binary.Write(rejoinRequestbuf, binary.LittleEndian, rejoinRequestPayload.RJCount)
+	return rejoinRequestbuf.Bytes()
+}
+
+// CalculateMIC calculates the Message Integrity Code for a rejoin request
+// message with the SNwkSIntKey (types 0 and 2) or the JSIntKey (type 1)
+// See Section 6.2.4 of the LoRaWan 1.1 Specification
+func (rejoinRequestPayload *RejoinRequestPayload) CalculateMIC(mhdr *MHDR, key []byte) ([]byte, error) {
+	cmac, err := calculateCMAC(key, []byte{mhdr.Byte()}, rejoinRequestPayload.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return cmac[0:4], nil
+}
+
+// ParseRejoinRequestPayload parses binary data to a RejoinRequestPayload
+func ParseRejoinRequestPayload(data []byte) (*RejoinRequestPayload, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("The rejoin request MACPayload should not be empty")
+	}
+	rejoinRequestPayload := &RejoinRequestPayload{RejoinType: data[0]}
+	switch data[0] {
+	case RejoinType0, RejoinType2:
+		if len(data) != 14 {
+			// MACPayload: RejoinType(1), NetID(3), DevEUI(8) and RJcount0(2)
+			return nil, fmt.Errorf("The rejoin request MACPayload of type %d should be 14 bytes", data[0])
+		}
+		rejoinRequestPayload.NetID = parseUint24(data[1:4])
+		data = data[4:]
+	case RejoinType1:
+		if len(data) != 19 {
+			// MACPayload: RejoinType(1), JoinEUI(8), DevEUI(8) and RJcount1(2)
+			return nil, fmt.Errorf("The rejoin request MACPayload of type %d should be 19 bytes", data[0])
+		}
+		rejoinRequestPayload.JoinEUI = binary.LittleEndian.Uint64(data[1:9])
+		data = data[9:]
+	default:
+		return nil, fmt.Errorf("RejoinType %d not supported", data[0])
+	}
+	rejoinRequestPayload.DevEUI = binary.LittleEndian.Uint64(data[0:8])
+	rejoinRequestPayload.RJCount = binary.LittleEndian.Uint16(data[8:10])
+	return rejoinRequestPayload, nil
+}
+
+/* Other Implementations */
+
+// EncryptJoinAccept encrypts the MACPayload and MIC of a join accept message.
+// The network uses AES decryption, so that devices only need AES encryption.
+// See Section 6.2.6 of the LoRaWan Specification
+func EncryptJoinAccept(key []byte, data []byte) ([]byte, error) {
+	return cryptJoinAccept(key, data, false)
+}
+
+// DecryptJoinAccept decrypts the MACPayload and MIC of a join accept message
+func DecryptJoinAccept(key []byte, data []byte) ([]byte, error) {
+	return cryptJoinAccept(key, data, true)
+}
+
+// cryptJoinAccept runs AES-128 in ECB mode over the blocks of the data
+func cryptJoinAccept(key []byte, data []byte, encrypt bool) ([]byte, error) {
+	if len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("The join accept should be a multiple of %d bytes, not %d", aes.BlockSize, len(data))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create AES cipher: %s", err.Error())
+	}
+	result := make([]byte, len(data))
+	for i := 0; i < len(data); i += aes.BlockSize {
+		if encrypt {
+			block.Encrypt(result[i:i+aes.BlockSize], data[i:i+aes.BlockSize])
+		} else {
+			block.Decrypt(result[i:i+aes.BlockSize], data[i:i+aes.BlockSize])
+		}
+	}
+	return result, nil
+}
+
+// ParseJoinAccept decrypts the join accept message with the AppKey (LoRaWAN
+// 1.0), the NwkKey (LoRaWAN 1.1) or the JSEncKey (answers to rejoin requests)
+// and parses it into the JoinAcceptPayload of the PHYPayload. It returns the
+// JoinAcceptPayload and the decrypted MIC, which the device verifies.
+func ParseJoinAccept(phyPayload *PHYPayload, key []byte) (*JoinAcceptPayload, []byte, error) {
+	if phyPayload.MHDR.MType != macMTypeJoinAccept {
+		return nil, nil, fmt.Errorf("MType %d is not a join accept message", phyPayload.MHDR.MType)
+	}
+	data, err := DecryptJoinAccept(key, append(cloneBytes(phyPayload.RawMACPayload), phyPayload.MIC...))
+	if err != nil {
+		return nil, nil, err
+	}
+	joinAcceptPayload, err := ParseJoinAcceptPayload(data[:len(data)-4])
+	if err != nil {
+		return nil, nil, err
+	}
+	phyPayload.JoinAcceptPayload = joinAcceptPayload
+	return joinAcceptPayload, data[len(data)-4:], nil
+}
+
+// uint24Bytes returns the little-endian binary representation of the 24
+// least significant bits
+func uint24Bytes(value uint32) []byte {
+	return []byte{byte(value), byte(value >> 8), byte(value >> 16)}
+}
+
+// parseUint24 parses 3 little-endian bytes
+func parseUint24(data []byte) uint32 {
+	return uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16
 }
@@ -4,8 +4,244 @@
 
 package lorawan
 
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
 /* JoinRequestPayload Tests */
 
-// TODO: Implement TestJoinRequestPayloadRaw
+type JoinRequestPayloadTest struct {
+	structure *JoinRequestPayload
+	binary    []byte
+}
+
+var (
+	joinRequestPayloads = []JoinRequestPayloadTest{
+		{&JoinRequestPayload{JoinEUI: 0x70B3D57ED0000001, DevEUI: 0x0004A30B001C0530, DevNonce: 0x1234},
+			[]byte{0x01, 0x00, 0x00, 0xD0, 0x7E, 0xD5, 0xB3, 0x70, 0x30, 0x05, 0x1C, 0x00, 0x0B, 0xA3, 0x04, 0x00, 0x34, 0x12}},
+		{&JoinRequestPayload{}, make([]byte, 18)},
+	}
+)
+
+func TestJoinRequestPayloadBytes(t *testing.T) {
+	for _, c := range joinRequestPayloads {
+		got := c.structure.Bytes()
+		if !bytes.Equal(got, c.binary) {
+			t.Errorf("%#v.Bytes()\n   got: %#v\n  want: %#v", c.structure, got, c.binary)
+		}
+	}
+}
+
+func TestParseJoinRequestPayload(t *testing.T) {
+	for _, c := range joinRequestPayloads {
+		got, err := ParseJoinRequestPayload(c.binary)
+		if err != nil {
+			t.Errorf("ParseJoinRequestPayload(%#v) failed: %s", c.binary, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.structure) {
+			t.Errorf("ParseJoinRequestPayload(%#v)\n   got: %#v\n  want: %#v", c.binary, got, c.structure)
+		}
+	}
+	if _, err := ParseJoinRequestPayload(make([]byte, 17)); err == nil {
+		t.Errorf("ParseJoinRequestPayload should error on 17 bytes")
+	}
+}
+
+func TestJoinRequestPHYPayload(t *testing.T) {
+	mhdr := &MHDR{MType: macMTypeJoinRequest, Major: macMajorLoRaWANR1}
+	joinRequest := joinRequestPayloads[0].structure
+	mic, err := joinRequest.CalculateMIC(mhdr, key)
+	if err != nil {
+		t.Fatalf("CalculateMIC failed: %s", err)
+	}
+	data := (&PHYPayload{MHDR: mhdr, JoinRequestPayload: joinRequest, MIC: mic}).Bytes()
+	if len(data) != 23 {
+		t.Fatalf("The join request should be 23 bytes, not %d", len(data))
+	}
+
+	got, err := ParsePHYPayload(data)
+	if err != nil {
+		t.Fatalf("ParsePHYPayload failed: %s", err)
+	}
+	if !reflect.DeepEqual(got.JoinRequestPayload, joinRequest) {
+		t.Errorf("ParsePHYPayload(%#v).JoinRequestPayload\n   got: %#v\n  want: %#v", data, got.JoinRequestPayload, joinRequest)
+	}
+	if !bytes.Equal(got.MIC, mic) {
+		t.Errorf("ParsePHYPayload(%#v).MIC\n   got: %#v\n  want: %#v", data, got.MIC, mic)
+	}
+}
+
+/* JoinAcceptPayload Tests */
+
+type DLSettingsTest struct {
+	structure DLSettings
+	binary    byte
+}
+
+var (
+	dlSettings = []DLSettingsTest{
+		{DLSettings{}, 0x00},
+		{DLSettings{OptNeg: true}, 0x80},
+		{DLSettings{RX1DROffset: 2, RX2DataRate: 3}, 0x23},
+		{DLSettings{OptNeg: true, RX1DROffset: 7, RX2DataRate: 15}, 0xFF},
+	}
+)
+
+func TestDLSettings(t *testing.T) {
+	for _, c := range dlSettings {
+		if got := c.structure.Byte(); got != c.binary {
+			t.Errorf("%#v.Byte()\n   got: %#v\n  want: %#v", c.structure, got, c.binary)
+		}
+		if got := ParseDLSettings(c.binary); got != c.structure {
+			t.Errorf("ParseDLSettings(%#v)\n   got: %#v\n  want: %#v", c.binary, got, c.structure)
+		}
+	}
+}
+
+type JoinAcceptPayloadTest struct {
+	structure *JoinAcceptPayload
+	binary    []byte
+}
+
+var (
+	joinAcceptPayloads = []JoinAcceptPayloadTest{
+		{&JoinAcceptPayload{JoinNonce: 0x010203, NetID: 0x000013, DevAddr: 0x26011234, DLSettings: DLSettings{RX2DataRate: 3}, RXDelay: 1},
+			[]byte{0x03, 0x02, 0x01, 0x13, 0x00, 0x00, 0x34, 0x12, 0x01, 0x26, 0x03, 0x01}},
+		{&JoinAcceptPayload{JoinNonce: 0xFFFFFF, NetID: 0xFFFFFF, DevAddr: 0xFFFFFFFF, DLSettings: DLSettings{OptNeg: true, RX1DROffset: 1}, RXDelay: 5,
+			CFList: []byte{0x18, 0x4F, 0x84, 0xE8, 0x56, 0x84, 0xB8, 0x5E, 0x84, 0x88, 0x66, 0x84, 0x58, 0x6E, 0x84, 0x00}},
+			[]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x90, 0x05,
+				0x18, 0x4F, 0x84, 0xE8, 0x56, 0x84, 0xB8, 0x5E, 0x84, 0x88, 0x66, 0x84, 0x58, 0x6E, 0x84, 0x00}},
+	}
+)
+
+func TestJoinAcceptPayloadBytes(t *testing.T) {
+	for _, c := range joinAcceptPayloads {
+		got := c.structure.Bytes()
+		if !bytes.Equal(got, c.binary) {
+			t.Errorf("%#v.Bytes()\n   got: %#v\n  want: %#v", c.structure, got, c.binary)
+		}
+	}
+}
+
+func TestParseJoinAcceptPayload(t *testing.T) {
+	for _, c := range joinAcceptPayloads {
+		got, err := ParseJoinAcceptPayload(c.binary)
+		if err != nil {
+			t.Errorf("ParseJoinAcceptPayload(%#v) failed: %s", c.binary, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.structure) {
+			t.Errorf("ParseJoinAcceptPayload(%#v)\n   got: %#v\n  want: %#v", c.binary, got, c.structure)
+		}
+	}
+	if _, err := ParseJoinAcceptPayload(make([]byte, 13)); err == nil {
+		t.Errorf("ParseJoinAcceptPayload should error on 13 bytes")
+	}
+}
+
+/* RejoinRequestPayload Tests */
+
+type RejoinRequestPayloadTest struct {
+	structure *RejoinRequestPayload
+	binary    []byte
+}
+
+var (
+	rejoinRequestPayloads = []RejoinRequestPayloadTest{
+		{&RejoinRequestPayload{RejoinType: RejoinType0, NetID: 0x000013, DevEUI: 0x0004A30B001C0530, RJCount: 0x0102},
+			[]byte{0x00, 0x13, 0x00, 0x00, 0x30, 0x05, 0x1C, 0x00, 0x0B, 0xA3, 0x04, 0x00, 0x02, 0x01}},
+		{&RejoinRequestPayload{RejoinType: RejoinType1, JoinEUI: 0x70B3D57ED0000001, DevEUI: 0x0004A30B001C0530, RJCount: 0xFFFF},
+			[]byte{0x01, 0x01, 0x00, 0x00, 0xD0, 0x7E, 0xD5, 0xB3, 0x70, 0x30, 0x05, 0x1C, 0x00, 0x0B, 0xA3, 0x04, 0x00, 0xFF, 0xFF}},
+		{&RejoinRequestPayload{RejoinType: RejoinType2, NetID: 0xFFFFFF, DevEUI: 1},
+			[]byte{0x02, 0xFF, 0xFF, 0xFF, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+	}
+)
+
+func TestRejoinRequestPayloadBytes(t *testing.T) {
+	for _, c := range rejoinRequestPayloads {
+		got := c.structure.Bytes()
+		if !bytes.Equal(got, c.binary) {
+			t.Errorf("%#v.Bytes()\n   got: %#v\n  want: %#v", c.structure, got, c.binary)
+		}
+	}
+}
+
+func TestParseRejoinRequestPayload(t *testing.T) {
+	for _, c := range rejoinRequestPayloads {
+		got, err := ParseRejoinRequestPayload(c.binary)
+		if err != nil {
+			t.Errorf("ParseRejoinRequestPayload(%#v) failed: %s", c.binary, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.structure) {
+			t.Errorf("ParseRejoinRequestPayload(%#v)\n   got: %#v\n  want: %#v", c.binary, got, c.structure)
+		}
+	}
+	for _, data := range [][]byte{{}, {0x00, 0x01}, make([]byte, 19), append([]byte{0x01}, make([]byte, 13)...), append([]byte{0x03}, make([]byte, 13)...)} {
+		if _, err := ParseRejoinRequestPayload(data); err == nil {
+			t.Errorf("ParseRejoinRequestPayload(%#v) should error", data)
+		}
+	}
+}
+
+func TestRejoinRequestPHYPayload(t *testing.T) {
+	mhdr := &MHDR{MType: macMTypeRejoinRequest, Major: macMajorLoRaWANR1}
+	for _, c := range rejoinRequestPayloads {
+		mic, _ := c.structure.CalculateMIC(mhdr, key)
+		data := (&PHYPayload{MHDR: mhdr, RejoinRequestPayload: c.structure, MIC: mic}).Bytes()
+		got, err := ParsePHYPayload(data)
+		if err != nil {
+			t.Fatalf("ParsePHYPayload failed: %s", err)
+		}
+		if !reflect.DeepEqual(got.RejoinRequestPayload, c.structure) || !bytes.Equal(got.MIC, mic) {
+			t.Errorf("ParsePHYPayload(%#v)\n   got: %#v\n  want: %#v", data, got.RejoinRequestPayload, c.structure)
+		}
+	}
+}
+
+/* Other Tests */
+
+func TestCryptJoinAccept(t *testing.T) {
+	for _, c := range joinAcceptPayloads {
+		mhdr := &MHDR{MType: macMTypeJoinAccept, Major: macMajorLoRaWANR1}
+		mic, err := c.structure.CalculateMIC(mhdr, key)
+		if err != nil {
+			t.Fatalf("CalculateMIC failed: %s", err)
+		}
+		plaintext := append(cloneBytes(c.binary), mic...)
+		encrypted, err := EncryptJoinAccept(key, plaintext)
+		if err != nil {
+			t.Fatalf("EncryptJoinAccept failed: %s", err)
+		}
+		if bytes.Equal(encrypted, plaintext) {
+			t.Errorf("EncryptJoinAccept(%#v) did not encrypt", plaintext)
+		}
+		if decrypted, _ := DecryptJoinAccept(key, encrypted); !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("DecryptJoinAccept(%#v)\n   got: %#v\n  want: %#v", encrypted, decrypted, plaintext)
+		}
 
-// TODO: Implement TestParseJoinRequestPayload
+		phyPayload := &PHYPayload{MHDR: mhdr, RawMACPayload: encrypted[:len(encrypted)-4], MIC: encrypted[len(encrypted)-4:]}
+		if _, err := phyPayload.MACPayload(); err == nil {
+			t.Errorf("MACPayload of an encrypted join accept should error")
+		}
+		got, gotMIC, err := ParseJoinAccept(phyPayload, key)
+		if err != nil {
+			t.Fatalf("ParseJoinAccept failed: %s", err)
+		}
+		if !reflect.DeepEqual(got, c.structure) || !bytes.Equal(gotMIC, mic) {
+			t.Errorf("ParseJoinAccept\n   got: %#v, MIC %x\n  want: %#v, MIC %x", got, gotMIC, c.structure, mic)
+		}
+		if macPayload, err := phyPayload.MACPayload(); err != nil || macPayload != MACPayload(got) {
+			t.Errorf("MACPayload after ParseJoinAccept\n   got: %#v, %v\n  want: %#v", macPayload, err, got)
+		}
+		if !bytes.Equal(phyPayload.Bytes(), append([]byte{mhdr.Byte()}, encrypted...)) {
+			t.Errorf("Bytes after ParseJoinAccept should stay encrypted\n   got: %x", phyPayload.Bytes())
+		}
+	}
+	if _, err := EncryptJoinAccept(key, make([]byte, 15)); err == nil {
+		t.Errorf("EncryptJoinAccept should error on 15 bytes")
+	}
+}
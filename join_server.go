@@ -0,0 +1,304 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrJoinNonceExhausted is returned when all 24-bit JoinNonces of a device are used
+var ErrJoinNonceExhausted = errors.New("The JoinNonce of the device is exhausted")
+
+// Key derivation prefixes
+// See Section 6.2.5 of the LoRaWan 1.1 Specification
+const (
+	keyPrefixFNwkSIntKey = 0x01 // NwkSKey in LoRaWAN 1.0
+	keyPrefixAppSKey     = 0x02
+	keyPrefixSNwkSIntKey = 0x03
+	keyPrefixNwkSEncKey  = 0x04
+	keyPrefixJSEncKey    = 0x05
+	keyPrefixJSIntKey    = 0x06
+)
+
+// deriveKey encrypts a block of the prefix and fields, padded with zeroes
+func deriveKey(key []byte, prefix byte, fields ...[]byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create AES cipher: %s", err.Error())
+	}
+	plaintext := make([]byte, aes.BlockSize)
+	plaintext[0] = prefix
+	copy(plaintext[1:], bytes.Join(fields, nil))
+	derived := make([]byte, aes.BlockSize)
+	block.Encrypt(derived, plaintext)
+	return derived, nil
+}
+
+// deriveJSKey derives the JSIntKey or JSEncKey of a LoRaWAN 1.1 device
+func deriveJSKey(nwkKey []byte, prefix byte, devEUI uint64) ([]byte, error) {
+	devEUIBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(devEUIBytes, devEUI)
+	return deriveKey(nwkKey, prefix, devEUIBytes)
+}
+
+// NewJoinSession derives the session keys from the root keys, the join
+// request and the join accept message, and returns the session of the device.
+// Devices use it after they decrypted the join accept message.
+// See Section 6.2.5 of the LoRaWan Specification
+func NewJoinSession(keys *RootKeys, joinRequest *JoinRequestPayload, joinAccept *JoinAcceptPayload) (*DeviceSession, error) {
+	session := &DeviceSession{
+		DevAddr:     joinAccept.DevAddr,
+		DevEUI:      joinRequest.DevEUI,
+		MACVersion:  keys.MACVersion,
+		RXDelay:     joinAccept.RXDelay,
+		RX1DROffset: int(joinAccept.DLSettings.RX1DROffset),
+		RX2DataRate: int(joinAccept.DLSettings.RX2DataRate),
+		NbTrans:     1,
+	}
+
+	joinNonce := uint24Bytes(joinAccept.JoinNonce)
+	devNonce := make([]byte, 2)
+	binary.LittleEndian.PutUint16(devNonce, joinRequest.DevNonce)
+
+	var err error
+	if !joinAccept.DLSettings.OptNeg {
+		// LoRaWAN 1.1 devices fall back to LoRaWAN 1.0 with the NwkKey
+		key := keys.joinRequestKey()
+		if session.MACVersion.is11() {
+			session.MACVersion = LoRaWAN1_0_4
+		}
+		netID := uint24Bytes(joinAccept.NetID)
+		var nwkSKey []byte
+		if nwkSKey, err = deriveKey(key, keyPrefixFNwkSIntKey, joinNonce, netID, devNonce); err != nil {
+			return nil, err
+		}
+		if session.AppSKey, err = deriveKey(key, keyPrefixAppSKey, joinNonce, netID, devNonce); err != nil {
+			return nil, err
+		}
+		session.FNwkSIntKey, session.SNwkSIntKey, session.NwkSEncKey = nwkSKey, cloneBytes(nwkSKey), cloneBytes(nwkSKey)
+		return session, nil
+	}
+
+	joinEUI := make([]byte, 8)
+	binary.LittleEndian.PutUint64(joinEUI, joinRequest.JoinEUI)
+	if session.FNwkSIntKey, err = deriveKey(keys.NwkKey, keyPrefixFNwkSIntKey, joinNonce, joinEUI, devNonce); err != nil {
+		return nil, err
+	}
+	if session.SNwkSIntKey, err = deriveKey(keys.NwkKey, keyPrefixSNwkSIntKey, joinNonce, joinEUI, devNonce); err != nil {
+		return nil, err
+	}
+	if session.NwkSEncKey, err = deriveKey(keys.NwkKey, keyPrefixNwkSEncKey, joinNonce, joinEUI, devNonce); err != nil {
+		return nil, err
+	}
+	if session.AppSKey, err = deriveKey(keys.AppKey, keyPrefixAppSKey, joinNonce, joinEUI, devNonce); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+/* JoinServer Implementations */
+
+// JoinServerConfig contains the configuration of a JoinServer
+type JoinServerConfig struct {
+	NetID           NetID
+	Keys            RootKeyStore
+	AllocateDevAddr func(devEUI uint64) (DevAddr, error) // See DevAddrAllocator
+
+	// The settings of the RX windows, OptNeg is set for LoRaWAN 1.1 devices
+	DLSettings DLSettings
+	RXDelay    uint8
+	CFList     []byte // Empty or 16 bytes, see ChannelPlan.CFList
+}
+
+// JoinResult contains the result of a join procedure
+type JoinResult struct {
+	Session    *DeviceSession
+	JoinAccept *PHYPayload // Encrypted
+}
+
+// JoinServer handles the (re)join requests of OTAA devices. It verifies them
+// with the root keys of the device, rejects reused DevNonces, and answers
+// with an encrypted join accept message. It is safe for concurrent use.
+type JoinServer struct {
+	config JoinServerConfig
+	mu     sync.Mutex // Serializes the nonce bookkeeping
+}
+
+// NewJoinServer returns a new JoinServer
+func NewJoinServer(config JoinServerConfig) *JoinServer {
+	return &JoinServer{config: config}
+}
+
+// HandleJoinRequest handles a join request message and returns the session
+// of the device and the join accept message
+func (js *JoinServer) HandleJoinRequest(phyPayload *PHYPayload) (*JoinResult, error) {
+	if phyPayload.MHDR.MType != macMTypeJoinRequest || phyPayload.JoinRequestPayload == nil {
+		return nil, errors.New("The PHYPayload is not a join request message")
+	}
+	joinRequest := phyPayload.JoinRequestPayload
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	keys, err := js.config.Keys.GetRootKeys(joinRequest.DevEUI)
+	if err != nil {
+		return nil, err
+	}
+	if keys.JoinEUI != joinRequest.JoinEUI {
+		return nil, fmt.Errorf("JoinEUI %016X does not match JoinEUI %016X of the device", joinRequest.JoinEUI, keys.JoinEUI)
+	}
+
+	mic, err := joinRequest.CalculateMIC(phyPayload.MHDR, keys.joinRequestKey())
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(phyPayload.MIC, mic) {
+		return nil, ErrInvalidMIC
+	}
+
+	if err := keys.useDevNonce(joinRequest.DevNonce); err != nil {
+		return nil, err
+	}
+	return js.accept(keys, joinReqTypeJoinRequest, joinRequest)
+}
+
+// HandleRejoinRequest handles a rejoin request message of a LoRaWAN 1.1
+// device and returns the new session of the device and the join accept
+// message. The join server verifies rejoin requests of type 1, the network
+// server verifies those of type 0 and 2 with ValidateRejoinRequest first.
+func (js *JoinServer) HandleRejoinRequest(phyPayload *PHYPayload) (*JoinResult, error) {
+	if phyPayload.MHDR.MType != macMTypeRejoinRequest || phyPayload.RejoinRequestPayload == nil {
+		return nil, errors.New("The PHYPayload is not a rejoin request message")
+	}
+	rejoinRequest := phyPayload.RejoinRequestPayload
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	keys, err := js.config.Keys.GetRootKeys(rejoinRequest.DevEUI)
+	if err != nil {
+		return nil, err
+	}
+	if !keys.MACVersion.is11() {
+		return nil, fmt.Errorf("MAC version %s does not support rejoin requests", keys.MACVersion)
+	}
+
+	switch rejoinRequest.RejoinType {
+	case RejoinType0, RejoinType2:
+		if NetID(rejoinRequest.NetID) != js.config.NetID {
+			return nil, fmt.Errorf("NetID %06X does not match NetID %s", rejoinRequest.NetID, js.config.NetID)
+		}
+	case RejoinType1:
+		if rejoinRequest.JoinEUI != keys.JoinEUI {
+			return nil, fmt.Errorf("JoinEUI %016X does not match JoinEUI %016X of the device", rejoinRequest.JoinEUI, keys.JoinEUI)
+		}
+		jsIntKey, err := keys.JSIntKey()
+		if err != nil {
+			return nil, err
+		}
+		mic, err := rejoinRequest.CalculateMIC(phyPayload.MHDR, jsIntKey)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(phyPayload.MIC, mic) {
+			return nil, ErrInvalidMIC
+		}
+		if err := keys.useRJCount1(rejoinRequest.RJCount); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("RejoinType %d not supported", rejoinRequest.RejoinType)
+	}
+
+	// The RJcount takes the place of the DevNonce in the session keys
+	return js.accept(keys, rejoinRequest.RejoinType, &JoinRequestPayload{
+		JoinEUI:  keys.JoinEUI,
+		DevEUI:   keys.DevEUI,
+		DevNonce: rejoinRequest.RJCount,
+	})
+}
+
+// accept saves the nonces of the device and answers a (re)join request with
+// the JoinReqType. The caller holds the lock.
+func (js *JoinServer) accept(keys *RootKeys, joinReqType byte, joinRequest *JoinRequestPayload) (*JoinResult, error) {
+	if keys.JoinNonce >= 0xFFFFFF {
+		return nil, ErrJoinNonceExhausted
+	}
+	keys.JoinNonce++
+
+	devAddr, err := js.config.AllocateDevAddr(joinRequest.DevEUI)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to allocate DevAddr: %s", err.Error())
+	}
+
+	// The nonces are saved before answering, so that they are never reused
+	if err := js.config.Keys.SaveRootKeys(keys); err != nil {
+		return nil, err
+	}
+
+	dlSettings := js.config.DLSettings
+	dlSettings.OptNeg = keys.MACVersion.is11()
+	joinAccept := &JoinAcceptPayload{
+		JoinNonce:  keys.JoinNonce,
+		NetID:      uint32(js.config.NetID),
+		DevAddr:    uint32(devAddr),
+		DLSettings: dlSettings,
+		RXDelay:    js.config.RXDelay,
+		CFList:     js.config.CFList,
+	}
+	phyPayload, err := js.encodeJoinAccept(keys, joinReqType, joinRequest, joinAccept)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := NewJoinSession(keys, joinRequest, joinAccept)
+	if err != nil {
+		return nil, err
+	}
+	return &JoinResult{Session: session, JoinAccept: phyPayload}, nil
+}
+
+// encodeJoinAccept calculates the MIC of the join accept message and encrypts
+// it. Answers to rejoin requests are encrypted with the JSEncKey.
+func (js *JoinServer) encodeJoinAccept(keys *RootKeys, joinReqType byte, joinRequest *JoinRequestPayload, joinAccept *JoinAcceptPayload) (*PHYPayload, error) {
+	mhdr := &MHDR{MType: macMTypeJoinAccept, Major: macMajorLoRaWANR1}
+
+	var mic []byte
+	var err error
+	if joinAccept.DLSettings.OptNeg {
+		var jsIntKey []byte
+		if jsIntKey, err = keys.JSIntKey(); err != nil {
+			return nil, err
+		}
+		mic, err = joinAccept.CalculateMICWithJoinRequest(mhdr, jsIntKey, joinReqType, joinRequest.JoinEUI, joinRequest.DevNonce)
+	} else {
+		mic, err = joinAccept.CalculateMIC(mhdr, keys.joinRequestKey())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := keys.joinRequestKey()
+	if joinReqType != joinReqTypeJoinRequest {
+		if key, err = keys.JSEncKey(); err != nil {
+			return nil, err
+		}
+	}
+	encrypted, err := EncryptJoinAccept(key, append(joinAccept.Bytes(), mic...))
+	if err != nil {
+		return nil, err
+	}
+	return &PHYPayload{
+		MHDR:          mhdr,
+		RawMHDR:       mhdr.Byte(),
+		RawMACPayload: encrypted[:len(encrypted)-4],
+		MIC:           encrypted[len(encrypted)-4:],
+	}, nil
+}
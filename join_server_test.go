@@ -0,0 +1,360 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"bytes"
+	"crypto/aes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+/* JoinServer Tests */
+
+const (
+	testJoinEUI = 0x70B3D57ED0000001
+	testNetID   = 0x000013
+)
+
+// testRootKeys returns the root keys of a test device
+func testRootKeys(version MACVersion) *RootKeys {
+	keys := &RootKeys{
+		DevEUI:     0x0004A30B001C0530,
+		JoinEUI:    testJoinEUI,
+		MACVersion: version,
+		AppKey:     cloneBytes(sessionAppSKey),
+	}
+	if version.is11() {
+		keys.NwkKey = cloneBytes(sessionNwkSKey)
+	}
+	return keys
+}
+
+// testJoinRequest encodes a join request message the way the device would
+func testJoinRequest(keys *RootKeys, devNonce uint16) []byte {
+	mhdr := &MHDR{MType: macMTypeJoinRequest, Major: macMajorLoRaWANR1}
+	joinRequest := &JoinRequestPayload{JoinEUI: keys.JoinEUI, DevEUI: keys.DevEUI, DevNonce: devNonce}
+	mic, _ := joinRequest.CalculateMIC(mhdr, keys.joinRequestKey())
+	return (&PHYPayload{MHDR: mhdr, JoinRequestPayload: joinRequest, MIC: mic}).Bytes()
+}
+
+// testJoinServer returns a JoinServer with the root keys of the test device
+func testJoinServer(version MACVersion) (*JoinServer, *MemoryRootKeyStore) {
+	store := NewMemoryRootKeyStore()
+	store.SaveRootKeys(testRootKeys(version))
+	js := NewJoinServer(JoinServerConfig{
+		NetID:           testNetID,
+		Keys:            store,
+		AllocateDevAddr: func(devEUI uint64) (DevAddr, error) { return 0x26011234, nil },
+		DLSettings:      DLSettings{RX1DROffset: 1, RX2DataRate: 3},
+		RXDelay:         1,
+	})
+	return js, store
+}
+
+func TestJoinServerHandleJoinRequest(t *testing.T) {
+	for _, version := range []MACVersion{LoRaWAN1_0_2, LoRaWAN1_1} {
+		js, store := testJoinServer(version)
+		keys := testRootKeys(version)
+
+		phyPayload, _ := ParsePHYPayload(testJoinRequest(keys, 0x0102))
+		result, err := js.HandleJoinRequest(phyPayload)
+		if err != nil {
+			t.Fatalf("%s: HandleJoinRequest failed: %s", version, err)
+		}
+
+		// The device decrypts the join accept and verifies its MIC
+		joinAccept, mic, err := ParseJoinAccept(result.JoinAccept, keys.joinRequestKey())
+		if err != nil {
+			t.Fatalf("%s: ParseJoinAccept failed: %s", version, err)
+		}
+		want := &JoinAcceptPayload{
+			JoinNonce:  1,
+			NetID:      testNetID,
+			DevAddr:    0x26011234,
+			DLSettings: DLSettings{OptNeg: version.is11(), RX1DROffset: 1, RX2DataRate: 3},
+			RXDelay:    1,
+		}
+		if !reflect.DeepEqual(joinAccept, want) {
+			t.Errorf("%s: join accept\n   got: %#v\n  want: %#v", version, joinAccept, want)
+		}
+		var wantMIC []byte
+		if version.is11() {
+			jsIntKey, _ := keys.JSIntKey()
+			wantMIC, _ = joinAccept.CalculateMICWithJoinRequest(result.JoinAccept.MHDR, jsIntKey, joinReqTypeJoinRequest, testJoinEUI, 0x0102)
+		} else {
+			wantMIC, _ = joinAccept.CalculateMIC(result.JoinAccept.MHDR, keys.AppKey)
+		}
+		if !bytes.Equal(mic, wantMIC) {
+			t.Errorf("%s: join accept MIC\n   got: %x\n  want: %x", version, mic, wantMIC)
+		}
+
+		// The device derives the same session keys
+		device, err := NewJoinSession(keys, phyPayload.JoinRequestPayload, joinAccept)
+		if err != nil {
+			t.Fatalf("%s: NewJoinSession failed: %s", version, err)
+		}
+		if !reflect.DeepEqual(device, result.Session) {
+			t.Errorf("%s: session\n   got: %#v\n  want: %#v", version, result.Session, device)
+		}
+		if bytes.Equal(device.FNwkSIntKey, device.AppSKey) {
+			t.Errorf("%s: the network and application session keys should differ", version)
+		}
+		if version.is11() == bytes.Equal(device.FNwkSIntKey, device.SNwkSIntKey) {
+			t.Errorf("%s: FNwkSIntKey and SNwkSIntKey should only differ for LoRaWAN 1.1", version)
+		}
+
+		stored, _ := store.GetRootKeys(keys.DevEUI)
+		if stored.JoinNonce != 1 {
+			t.Errorf("%s: stored JoinNonce\n   got: %d\n  want: 1", version, stored.JoinNonce)
+		}
+	}
+}
+
+func TestNewJoinSessionLoRaWAN1_0(t *testing.T) {
+	keys := testRootKeys(LoRaWAN1_0_2)
+	joinRequest := &JoinRequestPayload{JoinEUI: testJoinEUI, DevEUI: keys.DevEUI, DevNonce: 0x0102}
+	joinAccept := &JoinAcceptPayload{JoinNonce: 0x030405, NetID: testNetID, DevAddr: 0x26011234}
+	session, err := NewJoinSession(keys, joinRequest, joinAccept)
+	if err != nil {
+		t.Fatalf("NewJoinSession failed: %s", err)
+	}
+
+	// NwkSKey = aes128_encrypt(AppKey, 0x01 | AppNonce | NetID | DevNonce | pad16)
+	block, _ := aes.NewCipher(keys.AppKey)
+	for _, c := range []struct {
+		prefix byte
+		got    []byte
+	}{{0x01, session.FNwkSIntKey}, {0x01, session.NwkSEncKey}, {0x02, session.AppSKey}} {
+		want := make([]byte, 16)
+		block.Encrypt(want, []byte{c.prefix, 0x05, 0x04, 0x03, 0x13, 0x00, 0x00, 0x02, 0x01, 0, 0, 0, 0, 0, 0, 0})
+		if !bytes.Equal(c.got, want) {
+			t.Errorf("Session key %#x\n   got: %x\n  want: %x", c.prefix, c.got, want)
+		}
+	}
+
+	// LoRaWAN 1.1 devices fall back to LoRaWAN 1.0 without OptNeg
+	session, _ = NewJoinSession(testRootKeys(LoRaWAN1_1), joinRequest, joinAccept)
+	if session.MACVersion != LoRaWAN1_0_4 {
+		t.Errorf("MACVersion without OptNeg\n   got: %s\n  want: %s", session.MACVersion, LoRaWAN1_0_4)
+	}
+}
+
+func TestJoinServerRejectsJoinRequests(t *testing.T) {
+	for _, version := range []MACVersion{LoRaWAN1_0_2, LoRaWAN1_1} {
+		js, _ := testJoinServer(version)
+		keys := testRootKeys(version)
+		join := func(data []byte) error {
+			phyPayload, _ := ParsePHYPayload(data)
+			_, err := js.HandleJoinRequest(phyPayload)
+			return err
+		}
+
+		if err := join(testJoinRequest(keys, 10)); err != nil {
+			t.Fatalf("%s: HandleJoinRequest failed: %s", version, err)
+		}
+		if err := join(testJoinRequest(keys, 10)); err != ErrDevNonceReused {
+			t.Errorf("%s: reused DevNonce\n   got: %v\n  want: %v", version, err, ErrDevNonceReused)
+		}
+		lower := join(testJoinRequest(keys, 9))
+		if version.is11() && lower != ErrDevNonceReused || !version.is11() && lower != nil {
+			t.Errorf("%s: lower DevNonce\n   got: %v", version, lower)
+		}
+
+		invalid := testJoinRequest(keys, 20)
+		invalid[len(invalid)-1] ^= 0xFF
+		if err := join(invalid); err != ErrInvalidMIC {
+			t.Errorf("%s: invalid MIC\n   got: %v\n  want: %v", version, err, ErrInvalidMIC)
+		}
+		// A join request with an invalid MIC does not use the DevNonce
+		if err := join(testJoinRequest(keys, 20)); err != nil {
+			t.Errorf("%s: HandleJoinRequest after invalid MIC failed: %s", version, err)
+		}
+
+		unknown := testRootKeys(version)
+		unknown.DevEUI++
+		if err := join(testJoinRequest(unknown, 30)); err != ErrDeviceNotFound {
+			t.Errorf("%s: unknown device\n   got: %v\n  want: %v", version, err, ErrDeviceNotFound)
+		}
+		wrongJoinEUI := testRootKeys(version)
+		wrongJoinEUI.JoinEUI++
+		if err := join(testJoinRequest(wrongJoinEUI, 40)); err == nil {
+			t.Errorf("%s: HandleJoinRequest should error on a different JoinEUI", version)
+		}
+	}
+}
+
+// failingSaveStore is a DeviceSessionStore of which Save fails
+type failingSaveStore struct {
+	*MemorySessionStore
+}
+
+func (store *failingSaveStore) Save(session *DeviceSession, expected *FrameCounters) error {
+	return errors.New("Failed to save")
+}
+
+func TestNetworkServerJoin(t *testing.T) {
+	js, _ := testJoinServer(LoRaWAN1_0_2)
+	sessions := NewMemorySessionStore()
+	old := testSession(LoRaWAN1_0_2)
+	old.DevAddr = 0x26019999
+	sessions.Save(old, nil)
+
+	downlinks := make(chan *PHYPayload, 1)
+	errs := make(chan error, 1)
+	ns := NewNetworkServer(NetworkServerConfig{
+		DeduplicationWindow: 10 * time.Millisecond,
+		Sessions:            sessions,
+		JoinServer:          js,
+		OnDownlink:          func(ctx *UplinkContext, phyPayload *PHYPayload) { downlinks <- phyPayload },
+		OnError:             func(ctx *UplinkContext, err error) { errs <- err },
+	})
+
+	keys := testRootKeys(LoRaWAN1_0_2)
+	if err := ns.HandleUplink(testJoinRequest(keys, 1), RXInfo{GatewayID: 1}); err != nil {
+		t.Fatalf("HandleUplink failed: %s", err)
+	}
+	select {
+	case phyPayload := <-downlinks:
+		if phyPayload.MHDR.MType != macMTypeJoinAccept {
+			t.Errorf("Downlink MType\n   got: %d\n  want: %d", phyPayload.MHDR.MType, macMTypeJoinAccept)
+		}
+	case err := <-errs:
+		t.Fatalf("Processing the join request failed: %s", err)
+	case <-time.After(time.Second):
+		t.Fatalf("NetworkServer did not send a join accept")
+	}
+
+	session, err := sessions.GetByDevEUI(keys.DevEUI)
+	if err != nil {
+		t.Fatalf("GetByDevEUI failed: %s", err)
+	}
+	if session.DevAddr != 0x26011234 || session.FCntUp != 0 {
+		t.Errorf("The join should replace the session\n   got: %#v", session)
+	}
+	if byDevAddr, _ := sessions.GetByDevAddr(old.DevAddr); len(byDevAddr) != 0 {
+		t.Errorf("The join should replace the session of the old DevAddr\n   got: %#v", byDevAddr)
+	}
+
+	// The new session is used for data uplinks
+	phyPayload, _ := ParsePHYPayload(testUplink(session, 0, false, 1, []byte("hi")))
+	if _, _, err := ns.ProcessUplink(&DeduplicatedUplink{PHYPayload: phyPayload.Bytes()}); err != nil {
+		t.Errorf("ProcessUplink with the joined session failed: %s", err)
+	}
+
+	// The session is kept if the new session cannot be saved
+	failing := NewNetworkServer(NetworkServerConfig{Sessions: &failingSaveStore{sessions}, JoinServer: js})
+	joinRequest := &DeduplicatedUplink{PHYPayload: testJoinRequest(keys, 3), RXInfo: []RXInfo{{GatewayID: 1}}}
+	if _, _, err := failing.ProcessUplink(joinRequest); err == nil {
+		t.Errorf("ProcessUplink should fail when the session cannot be saved")
+	}
+	if kept, err := sessions.GetByDevEUI(keys.DevEUI); err != nil || kept.DevAddr != session.DevAddr {
+		t.Errorf("The session should be kept when the join fails\n   got: %#v, %v", kept, err)
+	}
+
+	without := NewNetworkServer(NetworkServerConfig{Sessions: sessions})
+	if err := without.HandleUplink(testJoinRequest(keys, 2), RXInfo{}); err == nil {
+		t.Errorf("HandleUplink should reject join requests without a JoinServer")
+	}
+}
+
+// testRejoinRequest encodes a rejoin request message the way the device would
+func testRejoinRequest(rejoinRequest *RejoinRequestPayload, key []byte) []byte {
+	mhdr := &MHDR{MType: macMTypeRejoinRequest, Major: macMajorLoRaWANR1}
+	mic, _ := rejoinRequest.CalculateMIC(mhdr, key)
+	return (&PHYPayload{MHDR: mhdr, RejoinRequestPayload: rejoinRequest, MIC: mic}).Bytes()
+}
+
+func TestJoinServerHandleRejoinRequest(t *testing.T) {
+	js, store := testJoinServer(LoRaWAN1_1)
+	keys := testRootKeys(LoRaWAN1_1)
+	jsIntKey, _ := keys.JSIntKey()
+	jsEncKey, _ := keys.JSEncKey()
+	rejoin := func(rejoinRequest *RejoinRequestPayload, key []byte) (*JoinResult, error) {
+		phyPayload, _ := ParsePHYPayload(testRejoinRequest(rejoinRequest, key))
+		return js.HandleRejoinRequest(phyPayload)
+	}
+
+	rejoinRequest := &RejoinRequestPayload{RejoinType: RejoinType1, JoinEUI: testJoinEUI, DevEUI: keys.DevEUI, RJCount: 5}
+	result, err := rejoin(rejoinRequest, jsIntKey)
+	if err != nil {
+		t.Fatalf("HandleRejoinRequest failed: %s", err)
+	}
+
+	// The device decrypts the join accept with the JSEncKey
+	joinAccept, mic, err := ParseJoinAccept(result.JoinAccept, jsEncKey)
+	if err != nil {
+		t.Fatalf("ParseJoinAccept failed: %s", err)
+	}
+	wantMIC, _ := joinAccept.CalculateMICWithJoinRequest(result.JoinAccept.MHDR, jsIntKey, RejoinType1, testJoinEUI, 5)
+	if !bytes.Equal(mic, wantMIC) {
+		t.Errorf("join accept MIC\n   got: %x\n  want: %x", mic, wantMIC)
+	}
+	device, _ := NewJoinSession(keys, &JoinRequestPayload{JoinEUI: testJoinEUI, DevEUI: keys.DevEUI, DevNonce: 5}, joinAccept)
+	if !reflect.DeepEqual(device, result.Session) {
+		t.Errorf("session\n   got: %#v\n  want: %#v", result.Session, device)
+	}
+	if stored, _ := store.GetRootKeys(keys.DevEUI); stored.NextRJCount1 != 6 || stored.JoinNonce != 1 {
+		t.Errorf("stored nonces\n   got: NextRJCount1 %d, JoinNonce %d\n  want: NextRJCount1 6, JoinNonce 1", stored.NextRJCount1, stored.JoinNonce)
+	}
+
+	if _, err := rejoin(rejoinRequest, jsIntKey); err != ErrRJCountReused {
+		t.Errorf("reused RJcount1\n   got: %v\n  want: %v", err, ErrRJCountReused)
+	}
+	if _, err := rejoin(&RejoinRequestPayload{RejoinType: RejoinType1, JoinEUI: testJoinEUI, DevEUI: keys.DevEUI, RJCount: 6}, key); err != ErrInvalidMIC {
+		t.Errorf("invalid MIC\n   got: %v\n  want: %v", err, ErrInvalidMIC)
+	}
+	if _, err := rejoin(&RejoinRequestPayload{RejoinType: RejoinType0, NetID: testNetID + 1, DevEUI: keys.DevEUI}, key); err == nil {
+		t.Errorf("HandleRejoinRequest should error on a different NetID")
+	}
+
+	js, _ = testJoinServer(LoRaWAN1_0_2)
+	if _, err := rejoin(&RejoinRequestPayload{RejoinType: RejoinType0, NetID: testNetID, DevEUI: keys.DevEUI}, key); err == nil {
+		t.Errorf("HandleRejoinRequest should error for LoRaWAN 1.0 devices")
+	}
+}
+
+func TestNetworkServerRejoin(t *testing.T) {
+	js, _ := testJoinServer(LoRaWAN1_1)
+	sessions := NewMemorySessionStore()
+	ns := NewNetworkServer(NetworkServerConfig{Sessions: sessions, JoinServer: js})
+	keys := testRootKeys(LoRaWAN1_1)
+	process := func(data []byte) (*UplinkContext, *PHYPayload, error) {
+		return ns.ProcessUplink(&DeduplicatedUplink{PHYPayload: data})
+	}
+
+	if _, _, err := process(testJoinRequest(keys, 1)); err != nil {
+		t.Fatalf("ProcessUplink of the join request failed: %s", err)
+	}
+	session, _ := sessions.GetByDevEUI(keys.DevEUI)
+	expected := session.FrameCounters()
+	session.DataRate, session.RX2Frequency = 5, 869525000
+	sessions.Save(session, &expected)
+
+	for _, rejoinType := range []uint8{RejoinType2, RejoinType0} {
+		previous, _ := sessions.GetByDevEUI(keys.DevEUI)
+		data := testRejoinRequest(&RejoinRequestPayload{RejoinType: rejoinType, NetID: testNetID, DevEUI: keys.DevEUI}, previous.SNwkSIntKey)
+		ctx, joinAccept, err := process(data)
+		if err != nil {
+			t.Fatalf("ProcessUplink of rejoin request type %d failed: %s", rejoinType, err)
+		}
+		if joinAccept == nil || joinAccept.MHDR.MType != macMTypeJoinAccept {
+			t.Errorf("Rejoin request type %d should be answered with a join accept", rejoinType)
+		}
+		if bytes.Equal(ctx.Session.SNwkSIntKey, previous.SNwkSIntKey) {
+			t.Errorf("Rejoin request type %d should rekey the session", rejoinType)
+		}
+		if wantDataRate := map[uint8]int{RejoinType0: 0, RejoinType2: 5}[rejoinType]; ctx.Session.DataRate != wantDataRate {
+			t.Errorf("DataRate after rejoin request type %d\n   got: %d\n  want: %d", rejoinType, ctx.Session.DataRate, wantDataRate)
+		}
+
+		// The rejoin request does not match the new session
+		if _, _, err := process(data); err != ErrInvalidMIC {
+			t.Errorf("Replayed rejoin request type %d\n   got: %v\n  want: %v", rejoinType, err, ErrInvalidMIC)
+		}
+	}
+}
@@ -4,7 +4,11 @@
 
 package lorawan
 
-import "fmt"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
 
 const (
 	// MType bit field values
@@ -14,8 +18,8 @@ const (
 	macMTypeUnconfirmedDataDown = 3
 	macMTypeConfirmedDataUp     = 4
 	macMTypeConfirmedDataDown   = 5
-	// macMTypeRFU = 6
-	macMTypeProprietary = 7
+	macMTypeRejoinRequest       = 6
+	macMTypeProprietary         = 7
 
 	// Major bit field values
 	macMajorLoRaWANR1 = 0
@@ -30,11 +34,12 @@ type PHYPayload struct {
 	MHDR    *MHDR
 	RawMHDR byte // Use MHDR.Bytes() instead
 	// TODO: Find a more elegant solution for this:
-	DataPayload        *DataPayload        // In case it's a data message
-	JoinRequestPayload *JoinRequestPayload // In case it's a join request message
-	JoinAcceptPayload  *JoinAcceptPayload  // In case it's a join accept message
-	RawMACPayload      []byte
-	MIC                []byte
+	DataPayload          *DataPayload          // In case it's a data message
+	JoinRequestPayload   *JoinRequestPayload   // In case it's a join request message
+	JoinAcceptPayload    *JoinAcceptPayload    // In case it's a join accept message, set by ParseJoinAccept
+	RejoinRequestPayload *RejoinRequestPayload // In case it's a rejoin request message
+	RawMACPayload        []byte
+	MIC                  []byte
 }
 
 // MACPayload returns the MAC Payload for this message type
@@ -48,12 +53,34 @@ func (phyPayload *PHYPayload) MACPayload() (MACPayload, error) {
 	case macMTypeJoinRequest:
 		return phyPayload.JoinRequestPayload, nil
 	case macMTypeJoinAccept:
+		if phyPayload.JoinAcceptPayload == nil {
+			return nil, errors.New("The join accept message is encrypted, use ParseJoinAccept first")
+		}
 		return phyPayload.JoinAcceptPayload, nil
+	case macMTypeRejoinRequest:
+		return phyPayload.RejoinRequestPayload, nil
 	default:
 		return nil, fmt.Errorf("MType %d not supported", phyPayload.MHDR.MType)
 	}
 }
 
+// Bytes returns the binary representation of the PHYPayload
+func (phyPayload *PHYPayload) Bytes() []byte {
+	phyPayloadbuf := new(bytes.Buffer)
+	phyPayloadbuf.WriteByte(phyPayload.MHDR.Byte())
+	if phyPayload.DataPayload != nil {
+		phyPayloadbuf.Write(phyPayload.DataPayload.Bytes())
+	} else if phyPayload.JoinRequestPayload != nil {
+		phyPayloadbuf.Write(phyPayload.JoinRequestPayload.Bytes())
+	} else if phyPayload.RejoinRequestPayload != nil {
+		phyPayloadbuf.Write(phyPayload.RejoinRequestPayload.Bytes())
+	} else {
+		phyPayloadbuf.Write(phyPayload.RawMACPayload)
+	}
+	phyPayloadbuf.Write(phyPayload.MIC)
+	return phyPayloadbuf.Bytes()
+}
+
 // ParsePHYPayload parses binary data to a PHYPayload
 func ParsePHYPayload(data []byte) (*PHYPayload, error) {
 	if len(data) < 5 {
@@ -88,7 +115,9 @@ func ParsePHYPayload(data []byte) (*PHYPayload, error) {
 	case macMTypeJoinRequest:
 		phyPayload.JoinRequestPayload, macPldErr = ParseJoinRequestPayload(phyPayload.RawMACPayload)
 	case macMTypeJoinAccept:
-		phyPayload.JoinAcceptPayload, macPldErr = ParseJoinAcceptPayload(phyPayload.RawMACPayload)
+		// The MACPayload of a join accept message is encrypted, see ParseJoinAccept
+	case macMTypeRejoinRequest:
+		phyPayload.RejoinRequestPayload, macPldErr = ParseRejoinRequestPayload(phyPayload.RawMACPayload)
 	default:
 		return phyPayload, fmt.Errorf("MType %d not supported", mhdr.MType)
 	}
@@ -110,6 +139,19 @@ func (mhdr *MHDR) Byte() byte {
 	return (mhdr.MType << 5) | mhdr.Major
 }
 
+// uplink returns true if the MHDR is of a message that is sent by an end-device
+func (mhdr *MHDR) uplink() bool {
+	switch mhdr.MType {
+	case macMTypeJoinRequest,
+		macMTypeRejoinRequest,
+		macMTypeUnconfirmedDataUp,
+		macMTypeConfirmedDataUp:
+		return true
+	default:
+		return false
+	}
+}
+
 // ParseMHDR parses binary data to a MHDR
 func ParseMHDR(data byte) (*MHDR, error) {
 	mhdr := &MHDR{
@@ -0,0 +1,411 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// MAC command identifiers
+// See Section 5 of the LoRaWan Specification
+const (
+	CIDReset            = 0x01
+	CIDLinkCheck        = 0x02
+	CIDLinkADR          = 0x03
+	CIDDutyCycle        = 0x04
+	CIDRXParamSetup     = 0x05
+	CIDDevStatus        = 0x06
+	CIDNewChannel       = 0x07
+	CIDRXTimingSetup    = 0x08
+	CIDTXParamSetup     = 0x09
+	CIDDLChannel        = 0x0A
+	CIDRekey            = 0x0B
+	CIDADRParamSetup    = 0x0C
+	CIDDeviceTime       = 0x0D
+	CIDForceRejoin      = 0x0E
+	CIDRejoinParamSetup = 0x0F
+)
+
+// Payload lengths of MAC commands sent by end-devices
+var uplinkMACCommandLengths = map[byte]int{
+	CIDReset:            1,
+	CIDLinkCheck:        0,
+	CIDLinkADR:          1,
+	CIDDutyCycle:        0,
+	CIDRXParamSetup:     1,
+	CIDDevStatus:        2,
+	CIDNewChannel:       1,
+	CIDRXTimingSetup:    0,
+	CIDTXParamSetup:     0,
+	CIDDLChannel:        1,
+	CIDRekey:            1,
+	CIDADRParamSetup:    0,
+	CIDDeviceTime:       0,
+	CIDRejoinParamSetup: 1,
+}
+
+// Payload lengths of MAC commands sent by the network
+var downlinkMACCommandLengths = map[byte]int{
+	CIDReset:            1,
+	CIDLinkCheck:        2,
+	CIDLinkADR:          4,
+	CIDDutyCycle:        1,
+	CIDRXParamSetup:     4,
+	CIDDevStatus:        0,
+	CIDNewChannel:       5,
+	CIDRXTimingSetup:    1,
+	CIDTXParamSetup:     1,
+	CIDDLChannel:        4,
+	CIDRekey:            1,
+	CIDADRParamSetup:    1,
+	CIDDeviceTime:       5,
+	CIDForceRejoin:      2,
+	CIDRejoinParamSetup: 1,
+}
+
+/* MACCommand Implementations */
+
+// MACCommand contains the data structure of a MAC command
+// See Section 5 of the LoRaWan Specification
+type MACCommand struct {
+	CID     byte
+	Payload []byte
+}
+
+// Bytes returns the binary representation of the MACCommand
+func (macCommand *MACCommand) Bytes() []byte {
+	return append([]byte{macCommand.CID}, macCommand.Payload...)
+}
+
+// ParseMACCommands parses binary data from FOpts or FRMPayload (with FPort 0)
+// to a list of MACCommands
+func ParseMACCommands(data []byte, uplink bool) ([]MACCommand, error) {
+	lengths := downlinkMACCommandLengths
+	if uplink {
+		lengths = uplinkMACCommandLengths
+	}
+
+	var macCommands []MACCommand
+	for index := 0; index < len(data); {
+		cid := data[index]
+		length, ok := lengths[cid]
+		if !ok {
+			return macCommands, fmt.Errorf("MAC command %#x not supported", cid)
+		}
+		index++
+		if len(data) < index+length {
+			return macCommands, fmt.Errorf("MAC command %#x should be %d bytes", cid, length)
+		}
+		macCommands = append(macCommands, MACCommand{CID: cid, Payload: data[index : index+length]})
+		index += length
+	}
+	return macCommands, nil
+}
+
+// MACCommandsBytes returns the binary representation of a list of MACCommands
+func MACCommandsBytes(macCommands []MACCommand) []byte {
+	buf := new(bytes.Buffer)
+	for _, macCommand := range macCommands {
+		buf.Write(macCommand.Bytes())
+	}
+	return buf.Bytes()
+}
+
+/* NewChannelReq Implementations */
+
+// NewChannelReq contains the data structure of a NewChannelReq MAC command
+// See Section 5.6 of the LoRaWan Specification
+type NewChannelReq struct {
+	ChIndex   uint8
+	Frequency uint32 // Hz, zero disables the channel
+	MinDR     uint8
+	MaxDR     uint8
+}
+
+// MACCommand returns the NewChannelReq as MACCommand
+func (req *NewChannelReq) MACCommand() MACCommand {
+	freq := req.Frequency / 100
+	return MACCommand{
+		CID: CIDNewChannel,
+		Payload: []byte{
+			req.ChIndex,
+			byte(freq), byte(freq >> 8), byte(freq >> 16),
+			req.MaxDR<<4 | req.MinDR&0xF,
+		},
+	}
+}
+
+// ParseNewChannelReq parses a MACCommand to a NewChannelReq
+func ParseNewChannelReq(macCommand MACCommand) (*NewChannelReq, error) {
+	if macCommand.CID != CIDNewChannel || len(macCommand.Payload) != 5 {
+		return nil, fmt.Errorf("MAC command %#x is not a NewChannelReq", macCommand.CID)
+	}
+	payload := macCommand.Payload
+	return &NewChannelReq{
+		ChIndex:   payload[0],
+		Frequency: (uint32(payload[1]) | uint32(payload[2])<<8 | uint32(payload[3])<<16) * 100,
+		MinDR:     payload[4] & 0xF,
+		MaxDR:     payload[4] >> 4,
+	}, nil
+}
+
+/* NewChannelAns Implementations */
+
+// NewChannelAns contains the data structure of a NewChannelAns MAC command
+// See Section 5.6 of the LoRaWan Specification
+type NewChannelAns struct {
+	DataRateRangeOK    bool
+	ChannelFrequencyOK bool
+}
+
+// MACCommand returns the NewChannelAns as MACCommand
+func (ans *NewChannelAns) MACCommand() MACCommand {
+	return MACCommand{CID: CIDNewChannel, Payload: []byte{boolToByte(ans.DataRateRangeOK)<<1 | boolToByte(ans.ChannelFrequencyOK)}}
+}
+
+// ParseNewChannelAns parses a MACCommand to a NewChannelAns
+func ParseNewChannelAns(macCommand MACCommand) (*NewChannelAns, error) {
+	if macCommand.CID != CIDNewChannel || len(macCommand.Payload) != 1 {
+		return nil, fmt.Errorf("MAC command %#x is not a NewChannelAns", macCommand.CID)
+	}
+	return &NewChannelAns{
+		DataRateRangeOK:    macCommand.Payload[0]&(1<<1) != 0,
+		ChannelFrequencyOK: macCommand.Payload[0]&1 != 0,
+	}, nil
+}
+
+/* LinkADRReq Implementations */
+
+// LinkADRReq contains the data structure of a LinkADRReq MAC command
+// See Section 5.3 of the LoRaWan Specification
+type LinkADRReq struct {
+	DataRate   uint8
+	TXPower    uint8
+	ChMask     uint16 // Bit i enables channel i of the block
+	ChMaskCntl uint8  // The block of 16 channels that ChMask applies to
+	NbTrans    uint8
+}
+
+// MACCommand returns the LinkADRReq as MACCommand
+func (req *LinkADRReq) MACCommand() MACCommand {
+	return MACCommand{
+		CID: CIDLinkADR,
+		Payload: []byte{
+			req.DataRate<<4 | req.TXPower&0xF,
+			byte(req.ChMask), byte(req.ChMask >> 8),
+			req.ChMaskCntl&0x7<<4 | req.NbTrans&0xF,
+		},
+	}
+}
+
+// ParseLinkADRReq parses a MACCommand to a LinkADRReq
+func ParseLinkADRReq(macCommand MACCommand) (*LinkADRReq, error) {
+	if macCommand.CID != CIDLinkADR || len(macCommand.Payload) != 4 {
+		return nil, fmt.Errorf("MAC command %#x is not a LinkADRReq", macCommand.CID)
+	}
+	payload := macCommand.Payload
+	return &LinkADRReq{
+		DataRate:   payload[0] >> 4,
+		TXPower:    payload[0] & 0xF,
+		ChMask:     uint16(payload[1]) | uint16(payload[2])<<8,
+		ChMaskCntl: payload[3] >> 4 & 0x7,
+		NbTrans:    payload[3] & 0xF,
+	}, nil
+}
+
+/* LinkADRAns Implementations */
+
+// LinkADRAns contains the data structure of a LinkADRAns MAC command
+// See Section 5.3 of the LoRaWan Specification
+type LinkADRAns struct {
+	PowerACK       bool
+	DataRateACK    bool
+	ChannelMaskACK bool
+}
+
+// MACCommand returns the LinkADRAns as MACCommand
+func (ans *LinkADRAns) MACCommand() MACCommand {
+	var status byte
+	if ans.PowerACK {
+		status |= 1 << 2
+	}
+	if ans.DataRateACK {
+		status |= 1 << 1
+	}
+	if ans.ChannelMaskACK {
+		status |= 1
+	}
+	return MACCommand{CID: CIDLinkADR, Payload: []byte{status}}
+}
+
+// ACK returns true if the device accepted all settings
+func (ans *LinkADRAns) ACK() bool {
+	return ans.PowerACK && ans.DataRateACK && ans.ChannelMaskACK
+}
+
+// ParseLinkADRAns parses a MACCommand to a LinkADRAns
+func ParseLinkADRAns(macCommand MACCommand) (*LinkADRAns, error) {
+	if macCommand.CID != CIDLinkADR || len(macCommand.Payload) != 1 {
+		return nil, fmt.Errorf("MAC command %#x is not a LinkADRAns", macCommand.CID)
+	}
+	status := macCommand.Payload[0]
+	return &LinkADRAns{
+		PowerACK:       status&(1<<2) != 0,
+		DataRateACK:    status&(1<<1) != 0,
+		ChannelMaskACK: status&1 != 0,
+	}, nil
+}
+
+/* ADRParamSetupReq Implementations */
+
+// ADRParamSetupReq contains the data structure of an ADRParamSetupReq MAC
+// command of LoRaWAN 1.1
+// See Section 5.12 of the LoRaWan 1.1 Specification
+type ADRParamSetupReq struct {
+	LimitExp uint8 // ADR_ACK_LIMIT = 2^LimitExp
+	DelayExp uint8 // ADR_ACK_DELAY = 2^DelayExp
+}
+
+// Limit returns the ADR_ACK_LIMIT
+func (req *ADRParamSetupReq) Limit() uint32 {
+	return 1 << req.LimitExp
+}
+
+// Delay returns the ADR_ACK_DELAY
+func (req *ADRParamSetupReq) Delay() uint32 {
+	return 1 << req.DelayExp
+}
+
+// MACCommand returns the ADRParamSetupReq as MACCommand
+func (req *ADRParamSetupReq) MACCommand() MACCommand {
+	return MACCommand{CID: CIDADRParamSetup, Payload: []byte{req.LimitExp<<4 | req.DelayExp&0xF}}
+}
+
+// ParseADRParamSetupReq parses a MACCommand to an ADRParamSetupReq
+func ParseADRParamSetupReq(macCommand MACCommand) (*ADRParamSetupReq, error) {
+	if macCommand.CID != CIDADRParamSetup || len(macCommand.Payload) != 1 {
+		return nil, fmt.Errorf("MAC command %#x is not an ADRParamSetupReq", macCommand.CID)
+	}
+	return &ADRParamSetupReq{
+		LimitExp: macCommand.Payload[0] >> 4,
+		DelayExp: macCommand.Payload[0] & 0xF,
+	}, nil
+}
+
+/* RXParamSetupReq Implementations */
+
+// RXParamSetupReq contains the data structure of an RXParamSetupReq MAC command
+// See Section 5.4 of the LoRaWan Specification
+type RXParamSetupReq struct {
+	RX1DROffset uint8
+	RX2DataRate uint8
+	Frequency   uint32 // Hz, of RX2
+}
+
+// MACCommand returns the RXParamSetupReq as MACCommand
+func (req *RXParamSetupReq) MACCommand() MACCommand {
+	freq := req.Frequency / 100
+	return MACCommand{
+		CID: CIDRXParamSetup,
+		Payload: []byte{
+			req.RX1DROffset&0x7<<4 | req.RX2DataRate&0xF,
+			byte(freq), byte(freq >> 8), byte(freq >> 16),
+		},
+	}
+}
+
+// ParseRXParamSetupReq parses a MACCommand to an RXParamSetupReq
+func ParseRXParamSetupReq(macCommand MACCommand) (*RXParamSetupReq, error) {
+	if macCommand.CID != CIDRXParamSetup || len(macCommand.Payload) != 4 {
+		return nil, fmt.Errorf("MAC command %#x is not an RXParamSetupReq", macCommand.CID)
+	}
+	payload := macCommand.Payload
+	return &RXParamSetupReq{
+		RX1DROffset: payload[0] >> 4 & 0x7,
+		RX2DataRate: payload[0] & 0xF,
+		Frequency:   parseUint24(payload[1:4]) * 100,
+	}, nil
+}
+
+/* RXParamSetupAns Implementations */
+
+// RXParamSetupAns contains the data structure of an RXParamSetupAns MAC command
+// See Section 5.4 of the LoRaWan Specification
+type RXParamSetupAns struct {
+	RX1DROffsetACK bool
+	RX2DataRateACK bool
+	ChannelACK     bool
+}
+
+// MACCommand returns the RXParamSetupAns as MACCommand
+func (ans *RXParamSetupAns) MACCommand() MACCommand {
+	return MACCommand{CID: CIDRXParamSetup, Payload: []byte{boolToByte(ans.RX1DROffsetACK)<<2 | boolToByte(ans.RX2DataRateACK)<<1 | boolToByte(ans.ChannelACK)}}
+}
+
+// ACK returns true if the device accepted all settings
+func (ans *RXParamSetupAns) ACK() bool {
+	return ans.RX1DROffsetACK && ans.RX2DataRateACK && ans.ChannelACK
+}
+
+// ParseRXParamSetupAns parses a MACCommand to an RXParamSetupAns
+func ParseRXParamSetupAns(macCommand MACCommand) (*RXParamSetupAns, error) {
+	if macCommand.CID != CIDRXParamSetup || len(macCommand.Payload) != 1 {
+		return nil, fmt.Errorf("MAC command %#x is not an RXParamSetupAns", macCommand.CID)
+	}
+	status := macCommand.Payload[0]
+	return &RXParamSetupAns{
+		RX1DROffsetACK: status&(1<<2) != 0,
+		RX2DataRateACK: status&(1<<1) != 0,
+		ChannelACK:     status&1 != 0,
+	}, nil
+}
+
+/* RXTimingSetupReq Implementations */
+
+// RXTimingSetupReq contains the data structure of an RXTimingSetupReq MAC
+// command
+// See Section 5.7 of the LoRaWan Specification
+type RXTimingSetupReq struct {
+	Delay uint8 // Seconds, zero means one second
+}
+
+// MACCommand returns the RXTimingSetupReq as MACCommand
+func (req *RXTimingSetupReq) MACCommand() MACCommand {
+	return MACCommand{CID: CIDRXTimingSetup, Payload: []byte{req.Delay & 0xF}}
+}
+
+// ParseRXTimingSetupReq parses a MACCommand to an RXTimingSetupReq
+func ParseRXTimingSetupReq(macCommand MACCommand) (*RXTimingSetupReq, error) {
+	if macCommand.CID != CIDRXTimingSetup || len(macCommand.Payload) != 1 {
+		return nil, fmt.Errorf("MAC command %#x is not an RXTimingSetupReq", macCommand.CID)
+	}
+	return &RXTimingSetupReq{Delay: macCommand.Payload[0] & 0xF}, nil
+}
+
+/* DevStatusAns Implementations */
+
+// DevStatusAns contains the data structure of a DevStatusAns MAC command
+// See Section 5.5 of the LoRaWan Specification
+type DevStatusAns struct {
+	Battery uint8 // 0 is external power, 1-254 is the level, 255 is unknown
+	Margin  int8  // dB, the SNR of the DevStatusReq, between -32 and 31
+}
+
+// MACCommand returns the DevStatusAns as MACCommand
+func (ans *DevStatusAns) MACCommand() MACCommand {
+	return MACCommand{CID: CIDDevStatus, Payload: []byte{ans.Battery, byte(ans.Margin) & 0x3F}}
+}
+
+// ParseDevStatusAns parses a MACCommand to a DevStatusAns
+func ParseDevStatusAns(macCommand MACCommand) (*DevStatusAns, error) {
+	if macCommand.CID != CIDDevStatus || len(macCommand.Payload) != 2 {
+		return nil, fmt.Errorf("MAC command %#x is not a DevStatusAns", macCommand.CID)
+	}
+	return &DevStatusAns{
+		Battery: macCommand.Payload[0],
+		Margin:  int8(macCommand.Payload[1]<<2) >> 2, // Sign-extend the 6 bits
+	}, nil
+}
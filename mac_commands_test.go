@@ -0,0 +1,220 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+/* MACCommand Tests */
+
+type MACCommandsTest struct {
+	structure []MACCommand
+	binary    []byte
+	uplink    bool
+}
+
+var (
+	macCommands = []MACCommandsTest{
+		{[]MACCommand{{CID: CIDLinkCheck, Payload: []byte{}}, {CID: CIDDevStatus, Payload: []byte{0xFF, 0x0A}}}, []byte{0x02, 0x06, 0xFF, 0x0A}, true},
+		{[]MACCommand{{CID: CIDLinkADR, Payload: []byte{0x51, 0x07, 0x00, 0x01}}, {CID: CIDDevStatus, Payload: []byte{}}}, []byte{0x03, 0x51, 0x07, 0x00, 0x01, 0x06}, false},
+	}
+)
+
+func TestMACCommandsBytes(t *testing.T) {
+	for _, c := range macCommands {
+		got := MACCommandsBytes(c.structure)
+		if !bytes.Equal(got, c.binary) {
+			t.Errorf("MACCommandsBytes(%#v)\n   got: %#v\n  want: %#v", c.structure, got, c.binary)
+		}
+	}
+}
+
+func TestParseMACCommands(t *testing.T) {
+	for _, c := range macCommands {
+		got, err := ParseMACCommands(c.binary, c.uplink)
+		if err != nil {
+			t.Errorf("ParseMACCommands(%#v) failed: %s", c.binary, err)
+		}
+		if !reflect.DeepEqual(got, c.structure) {
+			t.Errorf("ParseMACCommands(%#v)\n   got: %#v\n  want: %#v", c.binary, got, c.structure)
+		}
+	}
+
+	_, err1 := ParseMACCommands([]byte{0x03, 0x51}, false)
+	if err1 == nil {
+		t.Errorf("ParseMACCommands should error on truncated data")
+	}
+
+	_, err2 := ParseMACCommands([]byte{0x80}, true)
+	if err2 == nil {
+		t.Errorf("ParseMACCommands should error on unknown commands")
+	}
+}
+
+/* NewChannelReq Tests */
+
+func TestNewChannelReq(t *testing.T) {
+	req := &NewChannelReq{ChIndex: 3, Frequency: 867100000, MinDR: 0, MaxDR: 5}
+	macCommand := req.MACCommand()
+	want := []byte{0x07, 0x03, 0x18, 0x4F, 0x84, 0x50}
+	if !bytes.Equal(macCommand.Bytes(), want) {
+		t.Errorf("%#v.MACCommand()\n   got: %#v\n  want: %#v", req, macCommand.Bytes(), want)
+	}
+
+	got, err := ParseNewChannelReq(macCommand)
+	if err != nil {
+		t.Fatalf("ParseNewChannelReq failed: %s", err)
+	}
+	if !reflect.DeepEqual(got, req) {
+		t.Errorf("ParseNewChannelReq(%#v)\n   got: %#v\n  want: %#v", macCommand, got, req)
+	}
+}
+
+/* LinkADRReq Tests */
+
+func TestLinkADRReq(t *testing.T) {
+	req := &LinkADRReq{DataRate: 5, TXPower: 2, ChMask: 0x00FF, ChMaskCntl: 0, NbTrans: 1}
+	macCommand := req.MACCommand()
+	want := []byte{0x03, 0x52, 0xFF, 0x00, 0x01}
+	if !bytes.Equal(macCommand.Bytes(), want) {
+		t.Errorf("%#v.MACCommand()\n   got: %#v\n  want: %#v", req, macCommand.Bytes(), want)
+	}
+
+	got, err := ParseLinkADRReq(macCommand)
+	if err != nil {
+		t.Fatalf("ParseLinkADRReq failed: %s", err)
+	}
+	if !reflect.DeepEqual(got, req) {
+		t.Errorf("ParseLinkADRReq(%#v)\n   got: %#v\n  want: %#v", macCommand, got, req)
+	}
+}
+
+/* LinkADRAns Tests */
+
+func TestLinkADRAns(t *testing.T) {
+	ans := &LinkADRAns{PowerACK: true, DataRateACK: false, ChannelMaskACK: true}
+	macCommand := ans.MACCommand()
+	want := []byte{0x03, 0x05}
+	if !bytes.Equal(macCommand.Bytes(), want) {
+		t.Errorf("%#v.MACCommand()\n   got: %#v\n  want: %#v", ans, macCommand.Bytes(), want)
+	}
+
+	got, err := ParseLinkADRAns(macCommand)
+	if err != nil {
+		t.Fatalf("ParseLinkADRAns failed: %s", err)
+	}
+	if !reflect.DeepEqual(got, ans) || got.ACK() {
+		t.Errorf("ParseLinkADRAns(%#v)\n   got: %#v\n  want: %#v", macCommand, got, ans)
+	}
+}
+
+/* ADRParamSetupReq Tests */
+
+func TestADRParamSetupReq(t *testing.T) {
+	req := &ADRParamSetupReq{LimitExp: 6, DelayExp: 5}
+	if req.Limit() != 64 || req.Delay() != 32 {
+		t.Errorf("%#v Limit and Delay\n   got: %d, %d\n  want: 64, 32", req, req.Limit(), req.Delay())
+	}
+	macCommand := req.MACCommand()
+	want := []byte{0x0C, 0x65}
+	if !bytes.Equal(macCommand.Bytes(), want) {
+		t.Errorf("%#v.MACCommand()\n   got: %#v\n  want: %#v", req, macCommand.Bytes(), want)
+	}
+
+	got, err := ParseADRParamSetupReq(macCommand)
+	if err != nil {
+		t.Fatalf("ParseADRParamSetupReq failed: %s", err)
+	}
+	if !reflect.DeepEqual(got, req) {
+		t.Errorf("ParseADRParamSetupReq(%#v)\n   got: %#v\n  want: %#v", macCommand, got, req)
+	}
+}
+
+func TestNewChannelAns(t *testing.T) {
+	ans := &NewChannelAns{DataRateRangeOK: true, ChannelFrequencyOK: false}
+	macCommand := ans.MACCommand()
+	want := []byte{0x07, 0x02}
+	if !bytes.Equal(macCommand.Bytes(), want) {
+		t.Errorf("%#v.MACCommand()\n   got: %#v\n  want: %#v", ans, macCommand.Bytes(), want)
+	}
+
+	got, err := ParseNewChannelAns(macCommand)
+	if err != nil {
+		t.Fatalf("ParseNewChannelAns failed: %s", err)
+	}
+	if !reflect.DeepEqual(got, ans) {
+		t.Errorf("ParseNewChannelAns(%#v)\n   got: %#v\n  want: %#v", macCommand, got, ans)
+	}
+}
+
+func TestRXParamSetupReq(t *testing.T) {
+	req := &RXParamSetupReq{RX1DROffset: 2, RX2DataRate: 3, Frequency: 869525000}
+	macCommand := req.MACCommand()
+	want := []byte{0x05, 0x23, 0xD2, 0xAD, 0x84}
+	if !bytes.Equal(macCommand.Bytes(), want) {
+		t.Errorf("%#v.MACCommand()\n   got: %#v\n  want: %#v", req, macCommand.Bytes(), want)
+	}
+
+	got, err := ParseRXParamSetupReq(macCommand)
+	if err != nil {
+		t.Fatalf("ParseRXParamSetupReq failed: %s", err)
+	}
+	if !reflect.DeepEqual(got, req) {
+		t.Errorf("ParseRXParamSetupReq(%#v)\n   got: %#v\n  want: %#v", macCommand, got, req)
+	}
+}
+
+func TestRXParamSetupAns(t *testing.T) {
+	ans := &RXParamSetupAns{RX1DROffsetACK: true, RX2DataRateACK: true, ChannelACK: false}
+	macCommand := ans.MACCommand()
+	want := []byte{0x05, 0x06}
+	if !bytes.Equal(macCommand.Bytes(), want) {
+		t.Errorf("%#v.MACCommand()\n   got: %#v\n  want: %#v", ans, macCommand.Bytes(), want)
+	}
+
+	got, err := ParseRXParamSetupAns(macCommand)
+	if err != nil {
+		t.Fatalf("ParseRXParamSetupAns failed: %s", err)
+	}
+	if !reflect.DeepEqual(got, ans) || got.ACK() {
+		t.Errorf("ParseRXParamSetupAns(%#v)\n   got: %#v\n  want: %#v", macCommand, got, ans)
+	}
+}
+
+func TestRXTimingSetupReq(t *testing.T) {
+	req := &RXTimingSetupReq{Delay: 5}
+	macCommand := req.MACCommand()
+	want := []byte{0x08, 0x05}
+	if !bytes.Equal(macCommand.Bytes(), want) {
+		t.Errorf("%#v.MACCommand()\n   got: %#v\n  want: %#v", req, macCommand.Bytes(), want)
+	}
+
+	got, err := ParseRXTimingSetupReq(macCommand)
+	if err != nil {
+		t.Fatalf("ParseRXTimingSetupReq failed: %s", err)
+	}
+	if !reflect.DeepEqual(got, req) {
+		t.Errorf("ParseRXTimingSetupReq(%#v)\n   got: %#v\n  want: %#v", macCommand, got, req)
+	}
+}
+
+func TestDevStatusAns(t *testing.T) {
+	for _, ans := range []*DevStatusAns{{Battery: 255, Margin: 20}, {Battery: 0, Margin: -32}, {Battery: 128, Margin: 31}} {
+		macCommand := ans.MACCommand()
+		got, err := ParseDevStatusAns(macCommand)
+		if err != nil {
+			t.Fatalf("ParseDevStatusAns failed: %s", err)
+		}
+		if !reflect.DeepEqual(got, ans) {
+			t.Errorf("ParseDevStatusAns(%#v)\n   got: %#v\n  want: %#v", macCommand, got, ans)
+		}
+	}
+	if got := (&DevStatusAns{Battery: 1, Margin: -1}).MACCommand(); !bytes.Equal(got.Bytes(), []byte{0x06, 0x01, 0x3F}) {
+		t.Errorf("DevStatusAns with a negative margin\n   got: %#v\n  want: %#v", got.Bytes(), []byte{0x06, 0x01, 0x3F})
+	}
+}
@@ -27,6 +27,15 @@ var (
 	}
 )
 
+func TestPHYPayloadBytes(t *testing.T) {
+	for _, c := range phyPayloads {
+		got := c.structure.Bytes()
+		if !bytes.Equal(got, c.binary) {
+			t.Errorf("%#v.Bytes()\n   got: %#v\n  want: %#v", c.structure, got, c.binary)
+		}
+	}
+}
+
 func TestParsePHYPayload(t *testing.T) {
 	// TODO: Test for invalid inputs
 
@@ -0,0 +1,388 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Defaults of the NetworkServerConfig
+const (
+	DefaultDeduplicationWindow = 200 * time.Millisecond
+	DefaultMaxPendingUplinks   = 10000
+)
+
+// maxFOptsLen is the maximum length of the FOpts field
+const maxFOptsLen = 15
+
+// UplinkContext contains an uplink message while it passes through the stages
+// of the NetworkServer
+type UplinkContext struct {
+	PHYPayload *PHYPayload
+	RXInfo     []RXInfo       // Ordered from the best to the worst SNR
+	Session    *DeviceSession // Saved after the ADR stage and after encoding the downlink
+	Uplink     *Uplink        // The decrypted uplink message
+	MACAnswers []MACCommand   // MAC commands to send in the downlink
+	Time       time.Time      // The time at which the uplink is processed, from the Clock of the NetworkServer.
+}
+
+// SessionResolver finds the session of an uplink data message
+type SessionResolver interface {
+	ResolveSession(phyPayload *PHYPayload, txParams *UplinkTXParams) (*DeviceSession, error)
+}
+
+// MACCommandHandler handles the MAC commands of an uplink message and returns
+// the MAC commands to send in the downlink
+type MACCommandHandler interface {
+	HandleMACCommands(ctx *UplinkContext, macCommands []MACCommand) ([]MACCommand, error)
+}
+
+// ADRHandler adapts the data rate and TX power of a device and returns the
+// MAC commands to send in the downlink
+type ADRHandler interface {
+	HandleADR(ctx *UplinkContext) ([]MACCommand, error)
+}
+
+// ApplicationForwarder forwards the application payload of an uplink message
+type ApplicationForwarder interface {
+	ForwardUplink(ctx *UplinkContext) error
+}
+
+// DownlinkDecider decides on the downlink message that answers an uplink
+// message. It returns nil if no downlink message should be sent.
+type DownlinkDecider interface {
+	DecideDownlink(ctx *UplinkContext) (*Downlink, error)
+}
+
+/* SessionResolver Implementations */
+
+// StoreSessionResolver is a SessionResolver that resolves sessions from a
+// DeviceSessionStore
+type StoreSessionResolver struct {
+	Store DeviceSessionStore
+}
+
+// ResolveSession implements SessionResolver
+func (resolver *StoreSessionResolver) ResolveSession(phyPayload *PHYPayload, txParams *UplinkTXParams) (*DeviceSession, error) {
+	if phyPayload.DataPayload == nil || phyPayload.DataPayload.FHDR == nil {
+		return nil, errors.New("The PHYPayload does not contain a data payload")
+	}
+	sessions, err := resolver.Store.GetByDevAddr(phyPayload.DataPayload.FHDR.DevAddr)
+	if err != nil {
+		return nil, err
+	}
+	session, _, err := ResolveSession(phyPayload, txParams, sessions)
+	return session, err
+}
+
+/* DownlinkDecider Implementations */
+
+// DefaultDownlinkDecider is a DownlinkDecider that only sends a downlink
+// message to acknowledge confirmed uplink messages, to answer ADRACKReq and
+// to send MAC commands. MAC commands that do not fit in FOpts are sent on
+// FPort 0.
+type DefaultDownlinkDecider struct{}
+
+// DecideDownlink implements DownlinkDecider
+func (DefaultDownlinkDecider) DecideDownlink(ctx *UplinkContext) (*Downlink, error) {
+	if !ctx.Uplink.Confirmed && !ctx.Uplink.ADRACKReq && len(ctx.MACAnswers) == 0 {
+		return nil, nil
+	}
+	downlink := &Downlink{ACK: ctx.Uplink.Confirmed}
+	macCommands := MACCommandsBytes(ctx.MACAnswers)
+	if len(macCommands) > maxFOptsLen {
+		downlink.FRMPayload = macCommands
+	} else {
+		downlink.FOpts = macCommands
+	}
+	return downlink, nil
+}
+
+/* NetworkServer Implementations */
+
+// NetworkServerConfig contains the configuration of a NetworkServer. Only
+// Sessions is required, stages that are nil are skipped.
+type NetworkServerConfig struct {
+	Clock               Clock // Defaults to a RealClock
+	DeduplicationWindow time.Duration
+	MaxPendingUplinks   int
+
+	Sessions    DeviceSessionStore
+	Resolver    SessionResolver // Defaults to a StoreSessionResolver on Sessions
+	MACCommands MACCommandHandler
+	ADR         ADRHandler
+	Application ApplicationForwarder
+	Downlinks   DownlinkDecider // Defaults to DefaultDownlinkDecider
+
+	// JoinServer handles join requests, which are rejected when it is nil
+	JoinServer *JoinServer
+
+	// OnDownlink is called with the encoded downlink message that answers an
+	// uplink message
+	OnDownlink func(ctx *UplinkContext, phyPayload *PHYPayload)
+
+	// Scheduler schedules the downlink messages for OnTXRequest
+	Scheduler   *DownlinkScheduler
+	OnTXRequest func(ctx *UplinkContext, txRequest *TXRequest)
+
+	// OnError is called when processing a deduplicated uplink message fails
+	OnError func(ctx *UplinkContext, err error)
+}
+
+// NetworkServer processes uplink messages: it deduplicates them, resolves and
+// validates them against the device session, handles MAC commands and ADR,
+// forwards the application payload and decides on a downlink message
+type NetworkServer struct {
+	config       NetworkServerConfig
+	deduplicator *Deduplicator
+}
+
+// NewNetworkServer returns a new NetworkServer
+func NewNetworkServer(config NetworkServerConfig) *NetworkServer {
+	if config.Clock == nil {
+		config.Clock = RealClock{}
+	}
+	if config.DeduplicationWindow == 0 {
+		config.DeduplicationWindow = DefaultDeduplicationWindow
+	}
+	if config.MaxPendingUplinks == 0 {
+		config.MaxPendingUplinks = DefaultMaxPendingUplinks
+	}
+	if config.Resolver == nil {
+		config.Resolver = &StoreSessionResolver{Store: config.Sessions}
+	}
+	if config.Downlinks == nil {
+		config.Downlinks = DefaultDownlinkDecider{}
+	}
+	ns := &NetworkServer{config: config}
+	ns.deduplicator = NewDeduplicatorWithClock(config.Clock, config.DeduplicationWindow, config.MaxPendingUplinks, ns.handleDeduplicated)
+	return ns
+}
+
+// HandleUplink handles an uplink message that was received by a gateway. The
+// message is processed when the deduplication window closes.
+func (ns *NetworkServer) HandleUplink(data []byte, rxInfo RXInfo) error {
+	phyPayload, err := ParsePHYPayload(data)
+	if err != nil {
+		return err
+	}
+	switch mType := phyPayload.MHDR.MType; {
+	case mType == macMTypeUnconfirmedDataUp, mType == macMTypeConfirmedDataUp:
+	case mType == macMTypeJoinRequest && ns.config.JoinServer != nil:
+	case mType == macMTypeRejoinRequest && ns.config.JoinServer != nil:
+	default:
+		return fmt.Errorf("MType %d is not supported", mType)
+	}
+	return ns.deduplicator.Add(data, rxInfo)
+}
+
+// handleDeduplicated processes a deduplicated uplink message and reports the result
+func (ns *NetworkServer) handleDeduplicated(uplink *DeduplicatedUplink) {
+	ctx, phyPayload, err := ns.ProcessUplink(uplink)
+	if err != nil {
+		if ns.config.OnError != nil {
+			ns.config.OnError(ctx, err)
+		}
+		return
+	}
+	if phyPayload == nil {
+		return
+	}
+	if ns.config.OnDownlink != nil {
+		ns.config.OnDownlink(ctx, phyPayload)
+	}
+	if ns.config.Scheduler != nil && ns.config.OnTXRequest != nil {
+		txRequest, err := ns.config.Scheduler.Schedule(uplink, phyPayload, ctx.Session, ns.config.Clock.Now())
+		if err != nil {
+			if ns.config.OnError != nil {
+				ns.config.OnError(ctx, err)
+			}
+			return
+		}
+		ns.config.OnTXRequest(ctx, txRequest)
+	}
+}
+
+// ProcessUplink passes a deduplicated uplink message through the stages of
+// the NetworkServer and returns the encoded downlink message, if any
+func (ns *NetworkServer) ProcessUplink(uplink *DeduplicatedUplink) (*UplinkContext, *PHYPayload, error) {
+	ctx := &UplinkContext{RXInfo: uplink.RXInfo, Time: ns.config.Clock.Now()}
+
+	phyPayload, err := ParsePHYPayload(uplink.PHYPayload)
+	if err != nil {
+		return ctx, nil, err
+	}
+	ctx.PHYPayload = phyPayload
+
+	switch phyPayload.MHDR.MType {
+	case macMTypeJoinRequest:
+		return ns.join(ctx)
+	case macMTypeRejoinRequest:
+		return ns.rejoin(ctx)
+	}
+
+	txParams := uplink.TXParams()
+	ctx.Session, err = ns.config.Resolver.ResolveSession(phyPayload, txParams)
+	if err != nil {
+		return ctx, nil, err
+	}
+	expected := ctx.Session.FrameCounters()
+
+	ctx.Uplink, err = ctx.Session.DecodeUplink(phyPayload, txParams)
+	if err != nil {
+		return ctx, nil, err
+	}
+	if ctx.Uplink.Retransmission {
+		return ns.acknowledge(ctx, expected)
+	}
+
+	if ns.config.MACCommands != nil {
+		macCommands, err := ctx.Uplink.MACCommands()
+		if err != nil {
+			return ctx, nil, err
+		}
+		if len(macCommands) > 0 {
+			answers, err := ns.config.MACCommands.HandleMACCommands(ctx, macCommands)
+			if err != nil {
+				return ctx, nil, err
+			}
+			ctx.MACAnswers = append(ctx.MACAnswers, answers...)
+		}
+	}
+
+	if ns.config.ADR != nil && ctx.Uplink.ADR {
+		macCommands, err := ns.config.ADR.HandleADR(ctx)
+		if err != nil {
+			return ctx, nil, err
+		}
+		ctx.MACAnswers = append(ctx.MACAnswers, macCommands...)
+	}
+
+	// Saving the advanced frame counter before forwarding makes sure that the
+	// uplink message is forwarded at most once
+	if err := ns.config.Sessions.Save(ctx.Session, &expected); err != nil {
+		return ctx, nil, err
+	}
+	expected = ctx.Session.FrameCounters()
+
+	if ns.config.Application != nil && ctx.Uplink.FPort > 0 {
+		if err := ns.config.Application.ForwardUplink(ctx); err != nil {
+			return ctx, nil, err
+		}
+	}
+
+	downlink, err := ns.config.Downlinks.DecideDownlink(ctx)
+	if err != nil || downlink == nil {
+		return ctx, nil, err
+	}
+	downlinkPayload, err := ctx.Session.EncodeDownlink(downlink)
+	if err != nil {
+		return ctx, nil, err
+	}
+	if err := ns.config.Sessions.Save(ctx.Session, &expected); err != nil {
+		return ctx, nil, err
+	}
+	return ctx, downlinkPayload, nil
+}
+
+// join handles a join request with the JoinServer and replaces the session
+// of the device with the session of the join accept message
+func (ns *NetworkServer) join(ctx *UplinkContext) (*UplinkContext, *PHYPayload, error) {
+	if ns.config.JoinServer == nil {
+		return ctx, nil, fmt.Errorf("MType %d is not supported", ctx.PHYPayload.MHDR.MType)
+	}
+	result, err := ns.config.JoinServer.HandleJoinRequest(ctx.PHYPayload)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ns.replaceSession(ctx, result)
+}
+
+// rejoin handles a rejoin request with the JoinServer. Rejoin requests of
+// type 0 and 2 are validated with the current session of the device first.
+func (ns *NetworkServer) rejoin(ctx *UplinkContext) (*UplinkContext, *PHYPayload, error) {
+	if ns.config.JoinServer == nil {
+		return ctx, nil, fmt.Errorf("MType %d is not supported", ctx.PHYPayload.MHDR.MType)
+	}
+	rejoinRequest := ctx.PHYPayload.RejoinRequestPayload
+
+	var previous *DeviceSession
+	if rejoinRequest.RejoinType != RejoinType1 {
+		var err error
+		if previous, err = ns.config.Sessions.GetByDevEUI(rejoinRequest.DevEUI); err != nil {
+			return ctx, nil, err
+		}
+		ctx.Session = previous
+		expected := previous.FrameCounters()
+		if err := previous.ValidateRejoinRequest(ctx.PHYPayload); err != nil {
+			return ctx, nil, err
+		}
+		// RJcount0 is saved before answering, so that it is never reused
+		if err := ns.config.Sessions.Save(previous, &expected); err != nil {
+			return ctx, nil, err
+		}
+	}
+
+	result, err := ns.config.JoinServer.HandleRejoinRequest(ctx.PHYPayload)
+	if err != nil {
+		return ctx, nil, err
+	}
+	if rejoinRequest.RejoinType == RejoinType2 {
+		result.Session.keepRadioParameters(previous)
+	}
+	return ns.replaceSession(ctx, result)
+}
+
+// replaceSession replaces the session of the device with the session of the
+// join accept message. The current session is replaced in a single Save with
+// its frame counters, so that the device never ends up without a session.
+func (ns *NetworkServer) replaceSession(ctx *UplinkContext, result *JoinResult) (*UplinkContext, *PHYPayload, error) {
+	ctx.Session = result.Session
+	var expected *FrameCounters
+	current, err := ns.config.Sessions.GetByDevEUI(result.Session.DevEUI)
+	switch {
+	case err == nil:
+		frameCounters := current.FrameCounters()
+		expected = &frameCounters
+	case err != ErrSessionNotFound:
+		return ctx, nil, err
+	}
+	if err := ns.config.Sessions.Save(result.Session, expected); err != nil {
+		return ctx, nil, err
+	}
+	return ctx, result.JoinAccept, nil
+}
+
+// maxRetransmissionACKs is the maximum number of ACKs for retransmissions of
+// the same uplink message. Devices transmit a confirmed uplink message at most
+// 8 times, so more retransmissions are replays that should not make the
+// gateways transmit.
+const maxRetransmissionACKs = 7
+
+// acknowledge answers a retransmission of an uplink message that was already
+// processed. The device only repeats a confirmed uplink message when it missed
+// the ACK, so it is acknowledged again, up to maxRetransmissionACKs times, but
+// the MAC commands, ADR and the application payload are not handled twice.
+// The retransmission is counted in the ADR history.
+func (ns *NetworkServer) acknowledge(ctx *UplinkContext, expected FrameCounters) (*UplinkContext, *PHYPayload, error) {
+	changed := ctx.Session.recordRetransmission(ctx.Uplink.FCnt)
+	var phyPayload *PHYPayload
+	if ctx.Uplink.Confirmed && ctx.Session.RetransmissionACKs < maxRetransmissionACKs {
+		var err error
+		if phyPayload, err = ctx.Session.EncodeDownlink(&Downlink{ACK: true}); err != nil {
+			return ctx, nil, err
+		}
+		ctx.Session.RetransmissionACKs++
+		changed = true
+	}
+	if changed {
+		if err := ns.config.Sessions.Save(ctx.Session, &expected); err != nil {
+			return ctx, nil, err
+		}
+	}
+	return ctx, phyPayload, nil
+}
@@ -0,0 +1,206 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* NetworkServer Tests */
+
+// testStages implements the optional stages of the NetworkServer
+type testStages struct {
+	mu          sync.Mutex
+	macCommands []MACCommand
+	forwarded   []*Uplink
+}
+
+func (stages *testStages) HandleMACCommands(ctx *UplinkContext, macCommands []MACCommand) ([]MACCommand, error) {
+	stages.mu.Lock()
+	defer stages.mu.Unlock()
+	stages.macCommands = append(stages.macCommands, macCommands...)
+	return []MACCommand{{CID: CIDLinkCheck, Payload: []byte{20, byte(len(ctx.RXInfo))}}}, nil
+}
+
+func (stages *testStages) ForwardUplink(ctx *UplinkContext) error {
+	stages.mu.Lock()
+	defer stages.mu.Unlock()
+	stages.forwarded = append(stages.forwarded, ctx.Uplink)
+	return nil
+}
+
+func TestNetworkServer(t *testing.T) {
+	store := NewMemorySessionStore()
+	device := testSession(LoRaWAN1_0_2)
+	store.Save(device.Clone(), nil)
+
+	stages := &testStages{}
+	downlinks := make(chan *PHYPayload, 1)
+	errs := make(chan error, 1)
+	ns := NewNetworkServer(NetworkServerConfig{
+		DeduplicationWindow: 20 * time.Millisecond,
+		Sessions:            store,
+		MACCommands:         stages,
+		Application:         stages,
+		OnDownlink:          func(ctx *UplinkContext, phyPayload *PHYPayload) { downlinks <- phyPayload },
+		OnError:             func(ctx *UplinkContext, err error) { errs <- err },
+	})
+
+	// A confirmed LinkCheckReq on FPort 0, received by two gateways
+	data := testUplink(device, 0, true, 0, []byte{CIDLinkCheck})
+	for gatewayID := uint64(1); gatewayID <= 2; gatewayID++ {
+		if err := ns.HandleUplink(data, RXInfo{GatewayID: gatewayID}); err != nil {
+			t.Fatalf("HandleUplink failed: %s", err)
+		}
+	}
+	if err := ns.HandleUplink([]byte{0x00}, RXInfo{}); err == nil {
+		t.Errorf("HandleUplink should error on invalid messages")
+	}
+
+	select {
+	case phyPayload := <-downlinks:
+		fHdr := phyPayload.DataPayload.FHDR
+		if !fHdr.FCtrl.ACK || !bytes.Equal(fHdr.FOpts, []byte{CIDLinkCheck, 20, 2}) {
+			t.Errorf("Downlink\n   got: ACK %v, FOpts %x\n  want: ACK true, FOpts 021402", fHdr.FCtrl.ACK, fHdr.FOpts)
+		}
+	case err := <-errs:
+		t.Fatalf("Processing the uplink failed: %s", err)
+	case <-time.After(time.Second):
+		t.Fatalf("NetworkServer did not send a downlink")
+	}
+	if len(stages.macCommands) != 1 || stages.macCommands[0].CID != CIDLinkCheck {
+		t.Errorf("MAC commands\n   got: %#v", stages.macCommands)
+	}
+	if len(stages.forwarded) != 0 {
+		t.Errorf("MAC commands on FPort 0 should not be forwarded")
+	}
+
+	session, _ := store.GetByDevEUI(device.DevEUI)
+	if session.FCntUp != 1 || session.NFCntDown != 1 {
+		t.Errorf("Session after the uplink\n   got: FCntUp %d, NFCntDown %d\n  want: FCntUp 1, NFCntDown 1", session.FCntUp, session.NFCntDown)
+	}
+
+	// An unconfirmed application message is forwarded without downlink
+	uplink := &DeduplicatedUplink{PHYPayload: testUplink(device, 1, false, 10, []byte("hello"))}
+	if _, phyPayload, err := ns.ProcessUplink(uplink); err != nil || phyPayload != nil {
+		t.Errorf("ProcessUplink\n   got: %v, %v\n  want: no downlink", phyPayload, err)
+	}
+	if len(stages.forwarded) != 1 || !bytes.Equal(stages.forwarded[0].FRMPayload, []byte("hello")) {
+		t.Errorf("Forwarded uplinks\n   got: %#v", stages.forwarded)
+	}
+
+	// Retransmissions are not forwarded again, confirmed ones are acknowledged again
+	if _, phyPayload, err := ns.ProcessUplink(uplink); err != nil || phyPayload != nil {
+		t.Errorf("ProcessUplink of a retransmission\n   got: %v, %v\n  want: no downlink", phyPayload, err)
+	}
+	if _, phyPayload, err := ns.ProcessUplink(&DeduplicatedUplink{PHYPayload: data}); err != ErrNoMatchingSession {
+		t.Errorf("ProcessUplink of a replay\n   got: %v, %v\n  want: %v", phyPayload, err, ErrNoMatchingSession)
+	}
+	confirmed := &DeduplicatedUplink{PHYPayload: testUplink(device, 2, true, 10, []byte("again"))}
+	ns.ProcessUplink(confirmed)
+	_, phyPayload, err := ns.ProcessUplink(confirmed)
+	if err != nil || phyPayload == nil || !phyPayload.DataPayload.FHDR.FCtrl.ACK || len(phyPayload.DataPayload.FHDR.FOpts) != 0 {
+		t.Errorf("ProcessUplink of a confirmed retransmission\n   got: %#v, %v", phyPayload, err)
+	}
+	if len(stages.forwarded) != 2 {
+		t.Errorf("Retransmissions should not be forwarded\n   got: %d\n  want: 2", len(stages.forwarded))
+	}
+	session, _ = store.GetByDevEUI(device.DevEUI)
+	if session.FCntUp != 3 || session.NFCntDown != 3 {
+		t.Errorf("Session after the retransmissions\n   got: FCntUp %d, NFCntDown %d\n  want: FCntUp 3, NFCntDown 3", session.FCntUp, session.NFCntDown)
+	}
+
+	// Replays of the confirmed uplink are not acknowledged without limit
+	acks := 1
+	for i := 0; i < 2*maxRetransmissionACKs; i++ {
+		if _, phyPayload, err := ns.ProcessUplink(confirmed); err != nil {
+			t.Fatalf("ProcessUplink of a confirmed retransmission failed: %s", err)
+		} else if phyPayload != nil {
+			acks++
+		}
+	}
+	if acks != maxRetransmissionACKs {
+		t.Errorf("ACKs for retransmissions\n   got: %d\n  want: %d", acks, maxRetransmissionACKs)
+	}
+}
+
+func TestDefaultDownlinkDecider(t *testing.T) {
+	tests := []struct {
+		uplink   *Uplink
+		answers  []MACCommand
+		downlink bool
+	}{
+		{&Uplink{}, nil, false},
+		{&Uplink{Confirmed: true}, nil, true},
+		{&Uplink{ADR: true, ADRACKReq: true}, nil, true},
+		{&Uplink{}, []MACCommand{{CID: CIDDevStatus}}, true},
+	}
+	for _, test := range tests {
+		downlink, err := DefaultDownlinkDecider{}.DecideDownlink(&UplinkContext{Uplink: test.uplink, MACAnswers: test.answers})
+		if err != nil || (downlink != nil) != test.downlink {
+			t.Errorf("DecideDownlink(%#v)\n   got: %#v, %v\n  want downlink: %v", test.uplink, downlink, err, test.downlink)
+		}
+	}
+}
+
+func TestNetworkServerFakeClock(t *testing.T) {
+	region, _ := GetRegion("EU868", RP002_1_0_3)
+	js, _ := testJoinServer(LoRaWAN1_1)
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	var txRequests []*TXRequest
+	ns := NewNetworkServer(NetworkServerConfig{
+		Clock:       clock,
+		Sessions:    NewMemorySessionStore(),
+		JoinServer:  js,
+		Scheduler:   NewDownlinkScheduler(region),
+		OnTXRequest: func(ctx *UplinkContext, txRequest *TXRequest) { txRequests = append(txRequests, txRequest) },
+		OnError:     func(ctx *UplinkContext, err error) { t.Errorf("Processing the uplink failed: %s", err) },
+	})
+	device, _ := NewSimulatedDevice(SimulatedDeviceConfig{Region: region, RootKeys: testRootKeys(LoRaWAN1_1), Rand: rand.New(rand.NewSource(1))})
+
+	// transmit delivers the transmission to two gateways, closes the
+	// deduplication window and delivers the downlink message, if any
+	transmit := func(transmission *Transmission, err error) {
+		if err != nil {
+			t.Fatalf("Transmission failed: %s", err)
+		}
+		clock.Advance(transmission.Airtime)
+		for gatewayID := uint64(1); gatewayID <= 2; gatewayID++ {
+			if err := ns.HandleUplink(transmission.PHYPayload, transmission.RXInfo(gatewayID, -80, float64(gatewayID))); err != nil {
+				t.Fatalf("HandleUplink failed: %s", err)
+			}
+		}
+		txRequests = nil
+		clock.Advance(DefaultDeduplicationWindow)
+		if len(txRequests) != 1 {
+			t.Fatalf("TXRequests after the deduplication window\n   got: %d\n  want: 1", len(txRequests))
+		}
+		if txRequests[0].GatewayID != 2 {
+			t.Errorf("The downlink should be sent by the gateway with the best SNR\n   got: %d", txRequests[0].GatewayID)
+		}
+		if _, err := device.Receive(txRequests[0]); err != nil {
+			t.Fatalf("Receive failed: %s", err)
+		}
+	}
+
+	transmit(device.JoinRequest(clock.Now()))
+	if !device.Joined() {
+		t.Fatalf("The device did not join")
+	}
+
+	// A confirmed uplink every 15 minutes for a week takes no real time
+	for i := 0; i < 7*24*4; i++ {
+		clock.Advance(15 * time.Minute)
+		transmit(device.Uplink(1, []byte{byte(i)}, true, clock.Now()))
+	}
+	if device.Session().FCntUp != 7*24*4 || device.Session().NFCntDown != 7*24*4 {
+		t.Errorf("Frame counters of the device\n   got: FCntUp %d, NFCntDown %d", device.Session().FCntUp, device.Session().NFCntDown)
+	}
+}
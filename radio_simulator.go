@@ -0,0 +1,444 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// DefaultCaptureThreshold is the power in dB by which a LoRa transmission
+// has to exceed the interference of the same spreading factor to be received
+const DefaultCaptureThreshold = 6.0
+
+// noiseFigure is the noise figure of the gateway receiver in dB
+const noiseFigure = 6.0
+
+// noiseFloor returns the thermal noise in dBm of the bandwidth in Hz
+func noiseFloor(bandwidth int) float64 {
+	return -174 + 10*math.Log10(float64(bandwidth)) + noiseFigure
+}
+
+// loraSensitivity returns the lowest signal strength in dBm at which a
+// gateway receives the data rate
+func loraSensitivity(dataRate DataRate) (float64, error) {
+	snr, ok := requiredSNR[dataRate.SpreadingFactor]
+	if dataRate.Modulation != ModulationLoRa || !ok {
+		return 0, fmt.Errorf("The radio simulator does not support %s data rates with SF%d", dataRate.Modulation, dataRate.SpreadingFactor)
+	}
+	return noiseFloor(dataRate.Bandwidth) + snr, nil
+}
+
+// PathLossModel returns the path loss in dB over a distance in meters
+type PathLossModel interface {
+	PathLoss(distance float64) float64
+}
+
+// TrafficPattern returns the interval until the next uplink message of a device
+type TrafficPattern interface {
+	NextInterval(rand *rand.Rand) time.Duration
+}
+
+/* PathLossModel Implementations */
+
+// LogDistancePathLoss is the log-distance path loss model. The zero value uses
+// the parameters that were measured for LoRa in a built-up area.
+type LogDistancePathLoss struct {
+	ReferenceLoss     float64 // dB at the ReferenceDistance, defaults to 127.41
+	ReferenceDistance float64 // meters, defaults to 40
+	Exponent          float64 // defaults to 2.08
+}
+
+// PathLoss implements PathLossModel. Distances within the ReferenceDistance
+// have the ReferenceLoss.
+func (model LogDistancePathLoss) PathLoss(distance float64) float64 {
+	if model.ReferenceLoss == 0 {
+		model.ReferenceLoss = 127.41
+	}
+	if model.ReferenceDistance == 0 {
+		model.ReferenceDistance = 40
+	}
+	if model.Exponent == 0 {
+		model.Exponent = 2.08
+	}
+	if distance <= model.ReferenceDistance {
+		return model.ReferenceLoss
+	}
+	return model.ReferenceLoss + 10*model.Exponent*math.Log10(distance/model.ReferenceDistance)
+}
+
+/* TrafficPattern Implementations */
+
+// PeriodicTraffic sends an uplink message every Interval, plus or minus a
+// random Jitter. The interval is counted from the end of a transmission, so
+// an Interval of zero keeps the channel busy.
+type PeriodicTraffic struct {
+	Interval time.Duration
+	Jitter   time.Duration
+}
+
+// NextInterval implements TrafficPattern
+func (traffic PeriodicTraffic) NextInterval(rand *rand.Rand) time.Duration {
+	interval := traffic.Interval
+	if traffic.Jitter > 0 {
+		interval += time.Duration(rand.Int63n(2*int64(traffic.Jitter)+1)) - traffic.Jitter
+	}
+	if interval < 0 {
+		return 0
+	}
+	return interval
+}
+
+// PoissonTraffic sends uplink messages at exponentially distributed
+// intervals, which is the traffic of many independent sensors
+type PoissonTraffic struct {
+	MeanInterval time.Duration
+}
+
+// NextInterval implements TrafficPattern
+func (traffic PoissonTraffic) NextInterval(rand *rand.Rand) time.Duration {
+	return time.Duration(rand.ExpFloat64() * float64(traffic.MeanInterval))
+}
+
+/* RadioSimulator Implementations */
+
+// DataRateAssignment selects the data rates of the devices in a RadioSimulator
+type DataRateAssignment uint8
+
+// DataRateAssignments
+const (
+	FixedDataRates      DataRateAssignment = iota // The DataRate of each device
+	LinkBudgetDataRates                           // The fastest data rate that reaches the nearest gateway with the LinkMargin
+)
+
+// RadioGateway is a gateway in a RadioSimulator
+type RadioGateway struct {
+	ID   uint64
+	X, Y float64 // meters
+}
+
+// RadioDevice is a device in a RadioSimulator
+type RadioDevice struct {
+	DevAddr     uint32
+	X, Y        float64 // meters
+	DataRate    int
+	TXPower     int   // TXPower index of the region
+	Channels    []int // Indexes of the uplink channels of the region, of which those that support the data rate are used. Defaults to all channels.
+	PayloadSize int   // Size of the FRMPayload
+	Traffic     TrafficPattern
+}
+
+// RadioSimulatorConfig contains the configuration of a RadioSimulator
+type RadioSimulatorConfig struct {
+	Region   *Region
+	Gateways []RadioGateway
+	Devices  []RadioDevice
+
+	Start    time.Time     // Start of the simulated time
+	Duration time.Duration // Length of the simulated time
+
+	DataRates        DataRateAssignment
+	LinkMargin       float64       // dB above the sensitivity, for LinkBudgetDataRates
+	PathLoss         PathLossModel // Defaults to LogDistancePathLoss
+	CaptureThreshold float64       // dB, defaults to DefaultCaptureThreshold
+	DutyCycle        bool          // Devices wait for the duty cycle of the region
+	Rand             *rand.Rand    // Defaults to a source that is seeded with the current time
+}
+
+// DeliveryStats counts the transmissions of a spreading factor or gateway
+type DeliveryStats struct {
+	Sent       int `json:"sent"`
+	Received   int `json:"received"`
+	Collided   int `json:"collided"`     // Within range, but lost to interference
+	OutOfRange int `json:"out_of_range"` // Below the sensitivity
+}
+
+// DeliveryRatio returns the fraction of the sent transmissions that was received
+func (stats *DeliveryStats) DeliveryRatio() float64 {
+	if stats.Sent == 0 {
+		return 0
+	}
+	return float64(stats.Received) / float64(stats.Sent)
+}
+
+// RadioReport contains the results of a RadioSimulator. A transmission is
+// received if at least one gateway receives it.
+type RadioReport struct {
+	Transmissions    int                       `json:"transmissions"`
+	Received         int                       `json:"received"`
+	SpreadingFactors map[int]*DeliveryStats    `json:"spreading_factors"`
+	Gateways         map[uint64]*DeliveryStats `json:"gateways"`
+}
+
+// DeliveryRatio returns the fraction of the transmissions that was received
+func (report *RadioReport) DeliveryRatio() float64 {
+	if report.Transmissions == 0 {
+		return 0
+	}
+	return float64(report.Received) / float64(report.Transmissions)
+}
+
+// radioTransmission is a transmission in a RadioSimulator
+type radioTransmission struct {
+	start, end time.Time
+	frequency  uint32
+	sf         int
+	rxPower    []float64 // dBm, indexed by gateway
+	inRange    []bool    // indexed by gateway
+	noise      []float64 // mW of interference, indexed by gateway
+}
+
+// RadioSimulator simulates the uplink messages of many devices on shared
+// channels. It models the time on air of the encoded frames, path loss,
+// collisions between transmissions with the same frequency and spreading
+// factor, and the capture effect. Different spreading factors are considered
+// orthogonal.
+type RadioSimulator struct {
+	config RadioSimulatorConfig
+}
+
+// NewRadioSimulator returns a new RadioSimulator
+func NewRadioSimulator(config RadioSimulatorConfig) *RadioSimulator {
+	if config.PathLoss == nil {
+		config.PathLoss = LogDistancePathLoss{}
+	}
+	if config.CaptureThreshold == 0 {
+		config.CaptureThreshold = DefaultCaptureThreshold
+	}
+	if config.Rand == nil {
+		config.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return &RadioSimulator{config: config}
+}
+
+// rxPower returns the signal strength in dBm of the device at each gateway
+func (simulator *RadioSimulator) rxPower(device *RadioDevice) ([]float64, error) {
+	eirp, err := simulator.config.Region.TXPower(device.TXPower)
+	if err != nil {
+		return nil, err
+	}
+	rxPower := make([]float64, len(simulator.config.Gateways))
+	for i, gateway := range simulator.config.Gateways {
+		rxPower[i] = eirp - simulator.config.PathLoss.PathLoss(math.Hypot(device.X-gateway.X, device.Y-gateway.Y))
+	}
+	return rxPower, nil
+}
+
+// linkBudgetDataRate returns the fastest LoRa data rate of which the
+// sensitivity plus the LinkMargin is below the strongest signal, or the slowest
+// data rate if none is
+func (simulator *RadioSimulator) linkBudgetDataRate(rxPower []float64) int {
+	region := simulator.config.Region
+	best := math.Inf(-1)
+	for _, power := range rxPower {
+		best = math.Max(best, power)
+	}
+	dataRate := minUplinkDataRate(region)
+	for _, channel := range region.UplinkChannels {
+		for dr := channel.MinDR; dr <= channel.MaxDR; dr++ {
+			params, err := region.DataRate(dr)
+			if err != nil {
+				continue
+			}
+			sensitivity, err := loraSensitivity(params)
+			if err == nil && dr > dataRate && sensitivity+simulator.config.LinkMargin <= best {
+				dataRate = dr
+			}
+		}
+	}
+	return dataRate
+}
+
+// channels returns the uplink channels that the device uses at the data rate.
+// Channels of the device that do not support the data rate, which may be
+// chosen by LinkBudgetDataRates, are skipped.
+func (simulator *RadioSimulator) channels(device *RadioDevice, dataRate int) ([]Channel, error) {
+	uplinkChannels := simulator.config.Region.UplinkChannels
+	candidates := uplinkChannels
+	if device.Channels != nil {
+		candidates = make([]Channel, 0, len(device.Channels))
+		for _, index := range device.Channels {
+			if index < 0 || index >= len(uplinkChannels) {
+				return nil, fmt.Errorf("The region has no uplink channel %d", index)
+			}
+			candidates = append(candidates, uplinkChannels[index])
+		}
+	}
+	var channels []Channel
+	for _, channel := range candidates {
+		if dataRate >= channel.MinDR && dataRate <= channel.MaxDR {
+			channels = append(channels, channel)
+		}
+	}
+	if len(channels) == 0 {
+		return nil, fmt.Errorf("No uplink channel supports data rate %d", dataRate)
+	}
+	return channels, nil
+}
+
+// transmissions returns the transmissions of the device in the simulated time
+func (simulator *RadioSimulator) transmissions(device *RadioDevice) ([]*radioTransmission, error) {
+	config := simulator.config
+	if device.Traffic == nil {
+		return nil, errors.New("The device needs a TrafficPattern")
+	}
+	rxPower, err := simulator.rxPower(device)
+	if err != nil {
+		return nil, err
+	}
+	dataRate := device.DataRate
+	if config.DataRates == LinkBudgetDataRates {
+		dataRate = simulator.linkBudgetDataRate(rxPower)
+	}
+	params, err := config.Region.DataRate(dataRate)
+	if err != nil {
+		return nil, err
+	}
+	sensitivity, err := loraSensitivity(params)
+	if err != nil {
+		return nil, err
+	}
+	channels, err := simulator.channels(device, dataRate)
+	if err != nil {
+		return nil, err
+	}
+	inRange := make([]bool, len(rxPower))
+	for i, power := range rxPower {
+		inRange[i] = power >= sensitivity
+	}
+
+	var dutyCycle *DutyCycleTracker
+	if config.DutyCycle {
+		dutyCycle = NewDutyCycleTracker(config.Region, false)
+	}
+
+	var transmissions []*radioTransmission
+	end := config.Start.Add(config.Duration)
+	t := config.Start.Add(time.Duration(config.Rand.Int63n(int64(device.Traffic.NextInterval(config.Rand)) + 1)))
+	for fCnt := uint32(0); t.Before(end); fCnt++ {
+		phyPayload := &PHYPayload{
+			MHDR: &MHDR{MType: macMTypeUnconfirmedDataUp, Major: macMajorLoRaWANR1},
+			DataPayload: &DataPayload{
+				FHDR:          &FHDR{DevAddr: device.DevAddr, FCtrl: &FCtrl{}, FCnt: uint16(fCnt)},
+				FPort:         1,
+				RawFRMPayload: make([]byte, device.PayloadSize),
+			},
+			MIC: make([]byte, 4),
+		}
+		timeOnAir, err := phyPayload.TimeOnAir(config.Region, dataRate)
+		if err != nil {
+			return nil, err
+		}
+		channel := channels[config.Rand.Intn(len(channels))]
+		if dutyCycle != nil {
+			if t, err = dutyCycle.NextTransmission(channel.Frequency, timeOnAir, t); err != nil {
+				return nil, err
+			}
+			if !t.Before(end) {
+				break
+			}
+			if err := dutyCycle.Record(channel.Frequency, timeOnAir, t); err != nil {
+				return nil, err
+			}
+		}
+		transmissions = append(transmissions, &radioTransmission{
+			start:     t,
+			end:       t.Add(timeOnAir),
+			frequency: channel.Frequency,
+			sf:        params.SpreadingFactor,
+			rxPower:   rxPower,
+			inRange:   inRange,
+			noise:     make([]float64, len(rxPower)),
+		})
+		t = t.Add(timeOnAir + device.Traffic.NextInterval(config.Rand))
+	}
+	return transmissions, nil
+}
+
+// dBmToMilliwatts converts a power in dBm to mW
+func dBmToMilliwatts(power float64) float64 {
+	return math.Pow(10, power/10)
+}
+
+// Run simulates the transmissions of all devices and reports which of them
+// were received
+func (simulator *RadioSimulator) Run() (*RadioReport, error) {
+	config := simulator.config
+	var transmissions []*radioTransmission
+	for i := range config.Devices {
+		deviceTransmissions, err := simulator.transmissions(&config.Devices[i])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to simulate device %d: %s", i, err.Error())
+		}
+		transmissions = append(transmissions, deviceTransmissions...)
+	}
+	sort.SliceStable(transmissions, func(i, j int) bool {
+		return transmissions[i].start.Before(transmissions[j].start)
+	})
+
+	// Sum the interference of overlapping transmissions
+	for i, tx := range transmissions {
+		for _, other := range transmissions[i+1:] {
+			if !other.start.Before(tx.end) {
+				break
+			}
+			if other.frequency != tx.frequency || other.sf != tx.sf {
+				continue
+			}
+			for gateway := range config.Gateways {
+				tx.noise[gateway] += dBmToMilliwatts(other.rxPower[gateway])
+				other.noise[gateway] += dBmToMilliwatts(tx.rxPower[gateway])
+			}
+		}
+	}
+
+	report := &RadioReport{
+		Transmissions:    len(transmissions),
+		SpreadingFactors: make(map[int]*DeliveryStats),
+		Gateways:         make(map[uint64]*DeliveryStats),
+	}
+	for _, gateway := range config.Gateways {
+		report.Gateways[gateway.ID] = &DeliveryStats{}
+	}
+	for _, tx := range transmissions {
+		sfStats, ok := report.SpreadingFactors[tx.sf]
+		if !ok {
+			sfStats = &DeliveryStats{}
+			report.SpreadingFactors[tx.sf] = sfStats
+		}
+		sfStats.Sent++
+
+		var inRange, received bool
+		for i, gateway := range config.Gateways {
+			stats := report.Gateways[gateway.ID]
+			stats.Sent++
+			switch {
+			case !tx.inRange[i]:
+				stats.OutOfRange++
+				continue
+			case tx.noise[i] > 0 && tx.rxPower[i]-10*math.Log10(tx.noise[i]) < config.CaptureThreshold:
+				stats.Collided++
+			default:
+				stats.Received++
+				received = true
+			}
+			inRange = true
+		}
+		switch {
+		case received:
+			sfStats.Received++
+			report.Received++
+		case inRange:
+			sfStats.Collided++
+		default:
+			sfStats.OutOfRange++
+		}
+	}
+	return report, nil
+}
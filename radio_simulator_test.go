@@ -0,0 +1,218 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+/* PathLossModel Tests */
+
+func TestLogDistancePathLoss(t *testing.T) {
+	tests := []struct {
+		model    LogDistancePathLoss
+		distance float64
+		want     float64
+	}{
+		{LogDistancePathLoss{}, 10, 127.41},
+		{LogDistancePathLoss{}, 40, 127.41},
+		{LogDistancePathLoss{}, 400, 148.21},
+		{LogDistancePathLoss{ReferenceLoss: 40, ReferenceDistance: 1, Exponent: 2}, 1000, 100},
+	}
+	for _, tt := range tests {
+		if got := tt.model.PathLoss(tt.distance); math.Abs(got-tt.want) > 0.01 {
+			t.Errorf("PathLoss(%v) of %#v\n   got: %.2f\n  want: %.2f", tt.distance, tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestLoRaSensitivity(t *testing.T) {
+	tests := []struct {
+		dataRate DataRate
+		want     float64
+	}{
+		{DataRate{Modulation: ModulationLoRa, SpreadingFactor: 7, Bandwidth: 125000}, -124.53},
+		{DataRate{Modulation: ModulationLoRa, SpreadingFactor: 12, Bandwidth: 125000}, -137.03},
+		{DataRate{Modulation: ModulationLoRa, SpreadingFactor: 7, Bandwidth: 250000}, -121.52},
+	}
+	for _, tt := range tests {
+		if got, err := loraSensitivity(tt.dataRate); err != nil || math.Abs(got-tt.want) > 0.01 {
+			t.Errorf("loraSensitivity(%#v)\n   got: %.2f, %v\n  want: %.2f", tt.dataRate, got, err, tt.want)
+		}
+	}
+	if _, err := loraSensitivity(DataRate{Modulation: ModulationFSK, BitRate: 50000}); err == nil {
+		t.Errorf("loraSensitivity should reject FSK data rates")
+	}
+}
+
+/* TrafficPattern Tests */
+
+func TestTrafficPatterns(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	periodic := PeriodicTraffic{Interval: time.Minute, Jitter: 10 * time.Second}
+	poisson := PoissonTraffic{MeanInterval: time.Minute}
+	var sum time.Duration
+	for i := 0; i < 10000; i++ {
+		if interval := periodic.NextInterval(r); interval < 50*time.Second || interval > 70*time.Second {
+			t.Fatalf("Interval of %#v\n   got: %s", periodic, interval)
+		}
+		sum += poisson.NextInterval(r)
+	}
+	if mean := sum / 10000; mean < 55*time.Second || mean > 65*time.Second {
+		t.Errorf("Mean interval of %#v\n   got: %s", poisson, mean)
+	}
+	if interval := (PeriodicTraffic{Interval: time.Second, Jitter: time.Hour}).NextInterval(r); interval < 0 {
+		t.Errorf("Intervals should not be negative\n   got: %s", interval)
+	}
+}
+
+/* RadioSimulator Tests */
+
+// busyDevice returns a device that transmits back to back on the first channel
+func busyDevice(devAddr uint32, x float64, dataRate int) RadioDevice {
+	return RadioDevice{DevAddr: devAddr, X: x, DataRate: dataRate, Channels: []int{0}, PayloadSize: 10, Traffic: PeriodicTraffic{}}
+}
+
+func TestRadioSimulatorCapture(t *testing.T) {
+	region, _ := GetRegion("EU868", RP002_1_0_3)
+	tests := []struct {
+		name    string
+		devices []RadioDevice
+		want    []float64 // Delivery ratio per spreading factor of the devices
+	}{
+		{"alone", []RadioDevice{busyDevice(1, 50, 5)}, []float64{1}},
+		{"out of range", []RadioDevice{busyDevice(1, 10000, 5)}, []float64{0}},
+		{"capture", []RadioDevice{busyDevice(1, 50, 5), busyDevice(2, 150, 5)}, []float64{0.5}},
+		{"collision", []RadioDevice{busyDevice(1, 50, 5), busyDevice(2, 60, 5)}, []float64{0}},
+		{"orthogonal", []RadioDevice{busyDevice(1, 50, 5), busyDevice(2, 60, 4)}, []float64{1, 1}},
+	}
+	for _, tt := range tests {
+		simulator := NewRadioSimulator(RadioSimulatorConfig{
+			Region:   region,
+			Gateways: []RadioGateway{{ID: 1}},
+			Devices:  tt.devices,
+			Duration: time.Minute,
+			Rand:     rand.New(rand.NewSource(1)),
+		})
+		report, err := simulator.Run()
+		if err != nil {
+			t.Fatalf("%s: Run failed: %s", tt.name, err)
+		}
+		for i, want := range tt.want {
+			params, _ := region.DataRate(tt.devices[i].DataRate)
+			stats := report.SpreadingFactors[params.SpreadingFactor]
+			if got := stats.DeliveryRatio(); math.Abs(got-want) > 0.02 {
+				t.Errorf("%s: Delivery ratio of SF%d\n   got: %.2f (%#v)\n  want: %.2f", tt.name, params.SpreadingFactor, got, stats, want)
+			}
+		}
+		if gateway := report.Gateways[1]; gateway.Sent != report.Transmissions || gateway.Received != report.Received {
+			t.Errorf("%s: Stats of the gateway\n   got: %#v", tt.name, gateway)
+		}
+	}
+}
+
+func TestRadioSimulatorDutyCycle(t *testing.T) {
+	region, _ := GetRegion("EU868", RP002_1_0_3)
+	device := busyDevice(1, 50, 5)
+	simulator := NewRadioSimulator(RadioSimulatorConfig{
+		Region:    region,
+		Gateways:  []RadioGateway{{ID: 1}},
+		Devices:   []RadioDevice{device},
+		Duration:  2 * time.Hour,
+		DutyCycle: true,
+		Rand:      rand.New(rand.NewSource(1)),
+	})
+	report, err := simulator.Run()
+	if err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	// MHDR, FHDR, FPort, FRMPayload and MIC
+	timeOnAir, _ := region.TimeOnAir(5, 1+7+1+device.PayloadSize+4, true)
+	if airtime := time.Duration(report.Transmissions) * timeOnAir; airtime > 2*36*time.Second+timeOnAir {
+		t.Errorf("Airtime of %d transmissions exceeds the duty cycle\n   got: %s", report.Transmissions, airtime)
+	}
+	if report.DeliveryRatio() != 1 {
+		t.Errorf("Delivery ratio\n   got: %.2f\n  want: 1", report.DeliveryRatio())
+	}
+}
+
+func TestRadioSimulatorCapacity(t *testing.T) {
+	region, _ := GetRegion("EU868", RP002_1_0_3)
+	r := rand.New(rand.NewSource(1))
+	devices := make([]RadioDevice, 2000)
+	for i := range devices {
+		distance, angle := 700*math.Sqrt(r.Float64()), 2*math.Pi*r.Float64()
+		devices[i] = RadioDevice{
+			DevAddr:     uint32(i),
+			X:           distance * math.Cos(angle),
+			Y:           distance * math.Sin(angle),
+			PayloadSize: 20,
+			Traffic:     PoissonTraffic{MeanInterval: 10 * time.Minute},
+		}
+	}
+	simulator := NewRadioSimulator(RadioSimulatorConfig{
+		Region:    region,
+		Gateways:  []RadioGateway{{ID: 1}, {ID: 2, X: 500}},
+		Devices:   devices,
+		Duration:  time.Hour,
+		DataRates: LinkBudgetDataRates,
+		Rand:      r,
+	})
+	report, err := simulator.Run()
+	if err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	// The first uplink of a device is at a random offset within its first interval
+	if report.Transmissions < 12000 || report.Transmissions > 14000 {
+		t.Errorf("Transmissions\n   got: %d\n  want: about 13000", report.Transmissions)
+	}
+	if ratio := report.DeliveryRatio(); ratio < 0.5 || ratio >= 1 {
+		t.Errorf("Delivery ratio with collisions\n   got: %.2f", ratio)
+	}
+
+	// Slower data rates are used by devices further away, and collide more
+	sf7, sf12 := report.SpreadingFactors[7], report.SpreadingFactors[12]
+	if sf7 == nil || sf12 == nil {
+		t.Fatalf("Spreading factors\n   got: %#v", report.SpreadingFactors)
+	}
+	if sf7.DeliveryRatio() <= sf12.DeliveryRatio() {
+		t.Errorf("Delivery ratio of SF7 should exceed SF12\n   got: %.2f, %.2f", sf7.DeliveryRatio(), sf12.DeliveryRatio())
+	}
+	var sent, received int
+	for _, stats := range report.SpreadingFactors {
+		sent += stats.Sent
+		received += stats.Received
+		if stats.Sent != stats.Received+stats.Collided+stats.OutOfRange {
+			t.Errorf("Inconsistent stats\n   got: %#v", stats)
+		}
+	}
+	if sent != report.Transmissions || received != report.Received {
+		t.Errorf("Stats per spreading factor\n   got: %d sent, %d received\n  want: %d sent, %d received", sent, received, report.Transmissions, report.Received)
+	}
+	for id, stats := range report.Gateways {
+		if stats.Sent != report.Transmissions || stats.Received > report.Received {
+			t.Errorf("Stats of gateway %d\n   got: %#v", id, stats)
+		}
+	}
+}
+
+func TestRadioSimulatorErrors(t *testing.T) {
+	region, _ := GetRegion("EU868", RP002_1_0_3)
+	for _, device := range []RadioDevice{
+		{DataRate: 5},
+		{DataRate: 5, Traffic: PoissonTraffic{MeanInterval: time.Minute}, Channels: []int{16}},
+		{DataRate: 6, Traffic: PoissonTraffic{MeanInterval: time.Minute}, Channels: []int{0}},
+		{DataRate: 7, Traffic: PoissonTraffic{MeanInterval: time.Minute}},
+		{DataRate: 5, TXPower: 20, Traffic: PoissonTraffic{MeanInterval: time.Minute}},
+	} {
+		simulator := NewRadioSimulator(RadioSimulatorConfig{Region: region, Devices: []RadioDevice{device}, Duration: time.Hour})
+		if _, err := simulator.Run(); err == nil {
+			t.Errorf("Run should fail for device %#v", device)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"testing"
+)
+
+/* RegionalParametersVersion Tests */
+
+func TestRegionalParametersVersionText(t *testing.T) {
+	for version := RP1_0_2RevB; version <= RP002_1_0_4; version++ {
+		text, err := version.MarshalText()
+		if err != nil {
+			t.Errorf("%s.MarshalText() failed: %s", version, err)
+			continue
+		}
+		var got RegionalParametersVersion
+		if err := got.UnmarshalText(text); err != nil {
+			t.Errorf("UnmarshalText(%q) failed: %s", text, err)
+		}
+		if got != version {
+			t.Errorf("UnmarshalText(%q)\n   got: %s\n  want: %s", text, got, version)
+		}
+	}
+
+	_, err := ParseRegionalParametersVersion("1.0.1")
+	if err == nil {
+		t.Errorf("ParseRegionalParametersVersion should error on unknown versions")
+	}
+}
+
+/* Region Tests */
+
+type MaxPayloadSizeTest struct {
+	region    string
+	version   RegionalParametersVersion
+	dr        int
+	dwellTime bool
+	want      MaxPayloadSize
+}
+
+var (
+	maxPayloadSizes = []MaxPayloadSizeTest{
+		{"EU868", RP1_0_2RevB, 0, false, MaxPayloadSize{59, 51}},
+		{"EU868", RP002_1_0_3, 5, false, MaxPayloadSize{230, 222}},
+		{"US915", RP1_0_2RevB, 8, false, MaxPayloadSize{41, 33}},
+		{"US915", RP1_1RevA, 8, false, MaxPayloadSize{61, 53}},
+		{"US915", RP002_1_0_3, 9, false, MaxPayloadSize{137, 129}},
+		{"AS923", RP1_0_2RevB, 2, true, MaxPayloadSize{19, 11}},
+		{"AS923-2", RP002_1_0_1, 2, false, MaxPayloadSize{59, 51}},
+		{"EU868", RP002_1_0_3, 9, false, MaxPayloadSize{123, 115}},
+		{"US915", RP002_1_0_3, 5, false, MaxPayloadSize{58, 50}},
+	}
+)
+
+func TestRegionMaxPayloadSize(t *testing.T) {
+	for _, c := range maxPayloadSizes {
+		region, err := GetRegion(c.region, c.version)
+		if err != nil {
+			t.Errorf("GetRegion(%s, %s) failed: %s", c.region, c.version, err)
+			continue
+		}
+		got, err := region.MaxPayloadSize(c.dr, c.dwellTime)
+		if err != nil {
+			t.Errorf("%s.MaxPayloadSize(%d) failed: %s", c.region, c.dr, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s(%s).MaxPayloadSize(%d, %v)\n   got: %#v\n  want: %#v", c.region, c.version, c.dr, c.dwellTime, got, c.want)
+		}
+	}
+
+	as923, _ := GetRegion("AS923-1", RP002_1_0_3)
+	if _, err := as923.MaxPayloadSize(0, true); err == nil {
+		t.Errorf("AS923 DR0 should not be usable with dwell time")
+	}
+}
+
+func TestRegionLRFHSS(t *testing.T) {
+	eu868, _ := GetRegion("EU868", RP002_1_0_3)
+	dataRate, err := eu868.DataRate(10)
+	if err != nil {
+		t.Fatalf("EU868.DataRate(10) failed: %s", err)
+	}
+	if want := lrFHSSDataRate("1/3", 336000); dataRate != want {
+		t.Errorf("EU868.DataRate(10)\n   got: %#v\n  want: %#v", dataRate, want)
+	}
+	if dr, _ := eu868.RX1DataRate(9, 1); dr != 1 {
+		t.Errorf("EU868.RX1DataRate(9, 1)\n   got: %d\n  want: %d", dr, 1)
+	}
+
+	eu868, _ = GetRegion("EU868", RP1_0_2RevB)
+	if _, err := eu868.DataRate(8); err == nil {
+		t.Errorf("EU868 DR8 should not be defined in 1.0.2rB")
+	}
+}
+
+func TestGetRegion(t *testing.T) {
+	if _, err := GetRegion("AS923-2", RP1_0_2RevB); err == nil {
+		t.Errorf("GetRegion should error on AS923-2 before RP002-1.0.1")
+	}
+	if _, err := GetRegion("AS923-4", RP002_1_0_1); err == nil {
+		t.Errorf("GetRegion should error on AS923-4 before RP002-1.0.2")
+	}
+	if _, err := GetRegion("XX123", RP002_1_0_3); err == nil {
+		t.Errorf("GetRegion should error on unknown regions")
+	}
+
+	as923, err := GetRegion("AS923-3", RP002_1_0_3)
+	if err != nil {
+		t.Fatalf("GetRegion(AS923-3) failed: %s", err)
+	}
+	if as923.RX2Frequency != 916600000 {
+		t.Errorf("AS923-3.RX2Frequency\n   got: %d\n  want: %d", as923.RX2Frequency, 916600000)
+	}
+}
+
+func TestRegionRX1(t *testing.T) {
+	eu868, _ := GetRegion("EU868", RP002_1_0_3)
+	if dr, _ := eu868.RX1DataRate(5, 2); dr != 3 {
+		t.Errorf("EU868.RX1DataRate(5, 2)\n   got: %d\n  want: %d", dr, 3)
+	}
+	if dr, _ := eu868.RX1DataRate(1, 3); dr != 0 {
+		t.Errorf("EU868.RX1DataRate(1, 3)\n   got: %d\n  want: %d", dr, 0)
+	}
+	if freq, _ := eu868.RX1Frequency(868300000); freq != 868300000 {
+		t.Errorf("EU868.RX1Frequency(868300000)\n   got: %d\n  want: %d", freq, 868300000)
+	}
+
+	us915, _ := GetRegion("US915", RP002_1_0_3)
+	if dr, _ := us915.RX1DataRate(0, 0); dr != 10 {
+		t.Errorf("US915.RX1DataRate(0, 0)\n   got: %d\n  want: %d", dr, 10)
+	}
+	if freq, _ := us915.RX1Frequency(904100000); freq != 923900000 {
+		t.Errorf("US915.RX1Frequency(904100000)\n   got: %d\n  want: %d", freq, 923900000)
+	}
+	if _, err := us915.RX1Frequency(868100000); err == nil {
+		t.Errorf("US915.RX1Frequency should error on unknown frequencies")
+	}
+
+	as923, _ := GetRegion("AS923", RP002_1_0_3)
+	if dr, _ := as923.RX1DataRate(5, 7); dr != 5 {
+		t.Errorf("AS923.RX1DataRate(5, 7)\n   got: %d\n  want: %d", dr, 5)
+	}
+	if dr, _ := as923.RX1DataRate(3, 6); dr != 4 {
+		t.Errorf("AS923.RX1DataRate(3, 6)\n   got: %d\n  want: %d", dr, 4)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// ErrNoMatchingSession is returned when none of the candidate sessions
+// matches the MIC of an uplink message
+var ErrNoMatchingSession = errors.New("No device session matches the MIC")
+
+// parallelResolveThreshold is the number of candidate sessions from which the
+// MICs are calculated in parallel
+const parallelResolveThreshold = 8
+
+// ResolveSession finds the session of an uplink data message among candidate
+// sessions that share its DevAddr, by calculating the MIC with the full frame
+// counter of every candidate. It returns the matching session and the full
+// frame counter. If multiple candidates match, the first is returned. The
+// txParams may only be nil if all candidates are LoRaWAN 1.0 devices. The
+// sessions are not changed.
+func ResolveSession(phyPayload *PHYPayload, txParams *UplinkTXParams, sessions []*DeviceSession) (*DeviceSession, uint32, error) {
+	mType := phyPayload.MHDR.MType
+	if mType != macMTypeUnconfirmedDataUp && mType != macMTypeConfirmedDataUp {
+		return nil, 0, fmt.Errorf("MType %d is not an uplink data message", mType)
+	}
+	if phyPayload.DataPayload == nil || phyPayload.DataPayload.FHDR == nil {
+		return nil, 0, errors.New("The PHYPayload does not contain a data payload")
+	}
+	fHdr := phyPayload.DataPayload.FHDR
+
+	// The result of every candidate is kept by index, so that the first
+	// matching candidate is returned, whether the MICs are calculated in
+	// parallel or not. Candidates that are not checked do not match.
+	fCnts := make([]uint32, len(sessions))
+	errs := make([]error, len(sessions))
+	for i := range errs {
+		errs[i] = ErrNoMatchingSession
+	}
+	match := func(i int) bool {
+		if sessions[i].DevAddr != fHdr.DevAddr {
+			return false
+		}
+		fCnts[i], errs[i] = sessions[i].matchUplink(phyPayload, txParams)
+		return errs[i] == nil
+	}
+
+	if len(sessions) < parallelResolveThreshold {
+		for i := range sessions {
+			if match(i) {
+				break
+			}
+		}
+		return resolved(sessions, fCnts, errs)
+	}
+
+	workers := runtime.NumCPU()
+	if workers > len(sessions) {
+		workers = len(sessions)
+	}
+
+	var (
+		wg   sync.WaitGroup
+		next = make(chan int)
+		done = make(chan struct{})
+		stop sync.Once
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if match(i) {
+					stop.Do(func() { close(done) })
+				}
+			}
+		}()
+	}
+
+	// The candidates are fed in order, so when a candidate matches, all
+	// candidates before it are already being checked
+feed:
+	for i := range sessions {
+		select {
+		case next <- i:
+		case <-done:
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	return resolved(sessions, fCnts, errs)
+}
+
+// resolved returns the first candidate session without error. If none
+// matches, it returns the first error that is not caused by an invalid MIC or
+// a replay, or ErrNoMatchingSession.
+func resolved(sessions []*DeviceSession, fCnts []uint32, errs []error) (*DeviceSession, uint32, error) {
+	for i, err := range errs {
+		if err == nil {
+			return sessions[i], fCnts[i], nil
+		}
+	}
+	for _, err := range errs {
+		if err != ErrNoMatchingSession && err != ErrInvalidMIC && err != ErrFCntTooLow {
+			return nil, 0, err
+		}
+	}
+	return nil, 0, ErrNoMatchingSession
+}
@@ -0,0 +1,68 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"testing"
+)
+
+/* ResolveSession Tests */
+
+// testCandidates returns n sessions that share a DevAddr but have other keys
+func testCandidates(n int) []*DeviceSession {
+	sessions := make([]*DeviceSession, n)
+	for i := range sessions {
+		session := testSession(LoRaWAN1_0_2)
+		session.DevEUI += uint64(i)
+		session.FNwkSIntKey = append([]byte{byte(i)}, sessionNwkSKey[1:]...)
+		session.FCntUp = uint32(i) * 0x8000
+		sessions[i] = session
+	}
+	return sessions
+}
+
+func TestResolveSession(t *testing.T) {
+	for _, n := range []int{3, 50} {
+		sessions := testCandidates(n)
+		target := sessions[n-2]
+
+		phyPayload, _ := ParsePHYPayload(testUplink(target, target.FCntUp+3, false, 1, []byte{0x01}))
+		got, fCnt, err := ResolveSession(phyPayload, testTXParams, sessions)
+		if err != nil {
+			t.Fatalf("ResolveSession with %d candidates failed: %s", n, err)
+		}
+		if got != target {
+			t.Errorf("ResolveSession with %d candidates\n   got: %016X\n  want: %016X", n, got.DevEUI, target.DevEUI)
+		}
+		if fCnt != target.FCntUp+3 {
+			t.Errorf("ResolveSession with %d candidates FCnt\n   got: %d\n  want: %d", n, fCnt, target.FCntUp+3)
+		}
+
+		other := testSession(LoRaWAN1_0_2)
+		other.FNwkSIntKey = key
+		phyPayload, _ = ParsePHYPayload(testUplink(other, 1, false, 1, []byte{0x01}))
+		if _, _, err := ResolveSession(phyPayload, testTXParams, sessions); err != ErrNoMatchingSession {
+			t.Errorf("ResolveSession with %d candidates of an unknown device\n   got: %v\n  want: %v", n, err, ErrNoMatchingSession)
+		}
+
+		// The first of multiple matching candidates is returned
+		for _, session := range sessions[n/2:] {
+			session.FNwkSIntKey, session.FCntUp = target.FNwkSIntKey, target.FCntUp
+		}
+		phyPayload, _ = ParsePHYPayload(testUplink(target, target.FCntUp, false, 1, []byte{0x01}))
+		for i := 0; i < 10; i++ {
+			if got, _, _ := ResolveSession(phyPayload, testTXParams, sessions); got != sessions[n/2] {
+				t.Fatalf("ResolveSession with %d matching candidates\n   got: %v\n  want: %016X", n, got, sessions[n/2].DevEUI)
+			}
+		}
+	}
+
+	// Errors other than an invalid MIC are returned
+	session := testSession(LoRaWAN1_1)
+	phyPayload, _ := ParsePHYPayload(testUplink(session, 1, false, 1, []byte{0x01}))
+	if _, _, err := ResolveSession(phyPayload, nil, []*DeviceSession{session}); err != ErrUnknownTXParams {
+		t.Errorf("ResolveSession of LoRaWAN 1.1 without TX params\n   got: %v\n  want: %v", err, ErrUnknownTXParams)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrDeviceNotFound is returned when a device is not provisioned
+	ErrDeviceNotFound = errors.New("The device is not provisioned")
+
+	// ErrDevNonceReused is returned when the DevNonce of a join request was
+	// already used, or is not higher than the last one for LoRaWAN 1.1
+	ErrDevNonceReused = errors.New("The DevNonce was already used")
+
+	// ErrRJCountReused is returned when the RJcount of a rejoin request is not
+	// higher than the last one
+	ErrRJCountReused = errors.New("The RJcount was already used")
+)
+
+// RootKeys contains the root keys of a device for OTAA and the nonces of its
+// join procedures
+type RootKeys struct {
+	DevEUI     uint64     `json:"dev_eui"`
+	JoinEUI    uint64     `json:"join_eui"`
+	MACVersion MACVersion `json:"mac_version"`
+	AppKey     []byte     `json:"app_key"`
+	NwkKey     []byte     `json:"nwk_key"` // LoRaWAN 1.1 only
+
+	UsedDevNonces []uint16 `json:"used_dev_nonces"` // LoRaWAN 1.0, sorted
+	NextDevNonce  uint32   `json:"next_dev_nonce"`  // LoRaWAN 1.1, the lowest DevNonce that is accepted
+	JoinNonce     uint32   `json:"join_nonce"`      // The last JoinNonce that was sent
+	NextRJCount1  uint32   `json:"next_rj_count1"`  // The lowest RJcount1 that is accepted
+}
+
+// Clone returns a deep copy of the RootKeys
+func (keys *RootKeys) Clone() *RootKeys {
+	clone := *keys
+	clone.AppKey = cloneBytes(keys.AppKey)
+	clone.NwkKey = cloneBytes(keys.NwkKey)
+	if keys.UsedDevNonces != nil {
+		clone.UsedDevNonces = append([]uint16{}, keys.UsedDevNonces...)
+	}
+	return &clone
+}
+
+// joinRequestKey returns the key that signs join requests, which is the
+// NwkKey for LoRaWAN 1.1 and the AppKey for LoRaWAN 1.0
+func (keys *RootKeys) joinRequestKey() []byte {
+	if keys.MACVersion.is11() {
+		return keys.NwkKey
+	}
+	return keys.AppKey
+}
+
+// JSIntKey derives the key for the MIC of rejoin requests of type 1 and of
+// join accept messages of LoRaWAN 1.1
+// See Section 6.1.1.3 of the LoRaWan 1.1 Specification
+func (keys *RootKeys) JSIntKey() ([]byte, error) {
+	return deriveJSKey(keys.NwkKey, keyPrefixJSIntKey, keys.DevEUI)
+}
+
+// JSEncKey derives the key that encrypts the join accept messages that
+// answer rejoin requests
+// See Section 6.1.1.3 of the LoRaWan 1.1 Specification
+func (keys *RootKeys) JSEncKey() ([]byte, error) {
+	return deriveJSKey(keys.NwkKey, keyPrefixJSEncKey, keys.DevEUI)
+}
+
+// useRJCount1 records the RJcount1 of a rejoin request of type 1, which must
+// increase
+func (keys *RootKeys) useRJCount1(rjCount1 uint16) error {
+	if uint32(rjCount1) < keys.NextRJCount1 {
+		return ErrRJCountReused
+	}
+	keys.NextRJCount1 = uint32(rjCount1) + 1
+	return nil
+}
+
+// useDevNonce records the DevNonce of a join request. LoRaWAN 1.0 devices use
+// random DevNonces that may never be reused, LoRaWAN 1.1 devices use a
+// counter that must increase.
+func (keys *RootKeys) useDevNonce(devNonce uint16) error {
+	if keys.MACVersion.is11() {
+		if uint32(devNonce) < keys.NextDevNonce {
+			return ErrDevNonceReused
+		}
+		keys.NextDevNonce = uint32(devNonce) + 1
+		return nil
+	}
+
+	used := keys.UsedDevNonces
+	i := sort.Search(len(used), func(i int) bool { return used[i] >= devNonce })
+	if i < len(used) && used[i] == devNonce {
+		return ErrDevNonceReused
+	}
+	keys.UsedDevNonces = append(used[:i:i], append([]uint16{devNonce}, used[i:]...)...)
+	return nil
+}
+
+// RootKeyStore stores the RootKeys of devices
+type RootKeyStore interface {
+	GetRootKeys(devEUI uint64) (*RootKeys, error)
+	SaveRootKeys(keys *RootKeys) error
+}
+
+/* MemoryRootKeyStore Implementations */
+
+// MemoryRootKeyStore is a RootKeyStore that keeps the RootKeys in memory
+type MemoryRootKeyStore struct {
+	mu   sync.RWMutex
+	keys map[uint64]*RootKeys
+}
+
+// NewMemoryRootKeyStore returns a new MemoryRootKeyStore
+func NewMemoryRootKeyStore() *MemoryRootKeyStore {
+	return &MemoryRootKeyStore{keys: make(map[uint64]*RootKeys)}
+}
+
+// GetRootKeys implements RootKeyStore
+func (store *MemoryRootKeyStore) GetRootKeys(devEUI uint64) (*RootKeys, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	keys, ok := store.keys[devEUI]
+	if !ok {
+		return nil, ErrDeviceNotFound
+	}
+	return keys.Clone(), nil
+}
+
+// SaveRootKeys implements RootKeyStore
+func (store *MemoryRootKeyStore) SaveRootKeys(keys *RootKeys) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.keys[keys.DevEUI] = keys.Clone()
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"reflect"
+	"testing"
+)
+
+/* RootKeys Tests */
+
+func TestRootKeysUseDevNonce(t *testing.T) {
+	tests := []struct {
+		version   MACVersion
+		devNonces []uint16
+		want      []error
+	}{
+		{LoRaWAN1_0_2, []uint16{5, 3, 5, 4, 3, 0xFFFF}, []error{nil, nil, ErrDevNonceReused, nil, ErrDevNonceReused, nil}},
+		{LoRaWAN1_1, []uint16{0, 0, 1, 5, 3, 6}, []error{nil, ErrDevNonceReused, nil, nil, ErrDevNonceReused, nil}},
+	}
+	for _, tt := range tests {
+		keys := &RootKeys{MACVersion: tt.version}
+		for i, devNonce := range tt.devNonces {
+			if got := keys.useDevNonce(devNonce); got != tt.want[i] {
+				t.Errorf("%s: useDevNonce(%d)\n   got: %v\n  want: %v", tt.version, devNonce, got, tt.want[i])
+			}
+		}
+	}
+
+	keys := &RootKeys{MACVersion: LoRaWAN1_0_2}
+	for _, devNonce := range []uint16{5, 3, 4} {
+		keys.useDevNonce(devNonce)
+	}
+	if want := []uint16{3, 4, 5}; !reflect.DeepEqual(keys.UsedDevNonces, want) {
+		t.Errorf("UsedDevNonces\n   got: %v\n  want: %v", keys.UsedDevNonces, want)
+	}
+}
+
+/* MemoryRootKeyStore Tests */
+
+func TestMemoryRootKeyStore(t *testing.T) {
+	store := NewMemoryRootKeyStore()
+	if _, err := store.GetRootKeys(1); err != ErrDeviceNotFound {
+		t.Errorf("GetRootKeys of an unknown device\n   got: %v\n  want: %v", err, ErrDeviceNotFound)
+	}
+
+	keys := &RootKeys{DevEUI: 1, AppKey: cloneBytes(key), UsedDevNonces: []uint16{1}}
+	if err := store.SaveRootKeys(keys); err != nil {
+		t.Fatalf("SaveRootKeys failed: %s", err)
+	}
+	keys.AppKey[0] = 0
+	keys.UsedDevNonces[0] = 0
+
+	got, err := store.GetRootKeys(1)
+	if err != nil {
+		t.Fatalf("GetRootKeys failed: %s", err)
+	}
+	if got.AppKey[0] != key[0] || got.UsedDevNonces[0] != 1 {
+		t.Errorf("The store should keep a copy of the RootKeys\n   got: %#v", got)
+	}
+	got.UsedDevNonces[0] = 2
+	if stored, _ := store.GetRootKeys(1); stored.UsedDevNonces[0] != 1 {
+		t.Errorf("GetRootKeys should return a copy of the RootKeys")
+	}
+}
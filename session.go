@@ -0,0 +1,477 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidMIC is returned when the MIC of a message does not match
+	ErrInvalidMIC = errors.New("The MIC is invalid")
+
+	// ErrFCntTooLow is returned when the frame counter of an uplink message is
+	// lower than expected
+	ErrFCntTooLow = errors.New("The frame counter is lower than expected")
+
+	// ErrUnknownTXParams is returned when the MIC of a LoRaWAN 1.1 uplink
+	// message can not be checked, because its data rate and channel are unknown
+	ErrUnknownTXParams = errors.New("The data rate and channel of the uplink are unknown")
+)
+
+/* MACVersion Implementations */
+
+// MACVersion is the version of the LoRaWAN specification that a device implements
+type MACVersion uint8
+
+// Supported versions of the LoRaWAN specification
+const (
+	LoRaWAN1_0 MACVersion = iota + 1
+	LoRaWAN1_0_1
+	LoRaWAN1_0_2
+	LoRaWAN1_0_3
+	LoRaWAN1_0_4
+	LoRaWAN1_1
+)
+
+var macVersionNames = map[MACVersion]string{
+	LoRaWAN1_0:   "1.0",
+	LoRaWAN1_0_1: "1.0.1",
+	LoRaWAN1_0_2: "1.0.2",
+	LoRaWAN1_0_3: "1.0.3",
+	LoRaWAN1_0_4: "1.0.4",
+	LoRaWAN1_1:   "1.1",
+}
+
+// String returns the version number of the MACVersion
+func (version MACVersion) String() string {
+	if name, ok := macVersionNames[version]; ok {
+		return name
+	}
+	return fmt.Sprintf("MACVersion(%d)", uint8(version))
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (version MACVersion) MarshalText() ([]byte, error) {
+	if _, ok := macVersionNames[version]; !ok {
+		return nil, fmt.Errorf("LoRaWAN version %d not supported", uint8(version))
+	}
+	return []byte(version.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (version *MACVersion) UnmarshalText(data []byte) error {
+	for v, name := range macVersionNames {
+		if name == string(data) {
+			*version = v
+			return nil
+		}
+	}
+	return fmt.Errorf("LoRaWAN version %q not supported", data)
+}
+
+// is11 returns true if the MACVersion is LoRaWAN 1.1 or later
+func (version MACVersion) is11() bool {
+	return version >= LoRaWAN1_1
+}
+
+/* DeviceSession Implementations */
+
+// DeviceSession contains the state of an activated device
+//
+// LoRaWAN 1.0 devices have a single NwkSKey, which should be set as
+// FNwkSIntKey, SNwkSIntKey and NwkSEncKey. They also have a single downlink
+// frame counter, which is NFCntDown.
+type DeviceSession struct {
+	DevAddr    uint32     `json:"dev_addr"`
+	DevEUI     uint64     `json:"dev_eui"`
+	MACVersion MACVersion `json:"mac_version"`
+
+	FNwkSIntKey []byte `json:"f_nwk_s_int_key"`
+	SNwkSIntKey []byte `json:"s_nwk_s_int_key"`
+	NwkSEncKey  []byte `json:"nwk_s_enc_key"`
+	AppSKey     []byte `json:"app_s_key"`
+
+	FCntUp     uint32     `json:"f_cnt_up"` // The frame counter expected in the next uplink
+	NFCntDown  uint32     `json:"n_f_cnt_down"`
+	AFCntDown  uint32     `json:"a_f_cnt_down"`
+	FCntPolicy FCntPolicy `json:"f_cnt_policy"`
+
+	// ConfFCntDown is the frame counter of the last confirmed downlink, which
+	// LoRaWAN 1.1 devices include in the MIC of the uplink that acknowledges it
+	ConfFCntDown uint32 `json:"conf_f_cnt_down"`
+
+	// RetransmissionACKs is the number of ACKs that answered retransmissions
+	// of the last uplink message
+	RetransmissionACKs int `json:"retransmission_acks"`
+
+	RXDelay      uint8  `json:"rx_delay"` // Seconds, zero means one second
+	RX1DROffset  int    `json:"rx1_dr_offset"`
+	RX2DataRate  int    `json:"rx2_data_rate"`
+	RX2Frequency uint32 `json:"rx2_frequency"`
+
+	ChannelMask []bool `json:"channel_mask"`
+
+	ADR        bool              `json:"adr"`
+	DataRate   int               `json:"data_rate"`
+	TXPower    int               `json:"tx_power"`
+	NbTrans    int               `json:"nb_trans"`
+	ADRHistory []ADRHistoryEntry `json:"adr_history"`
+	PendingADR *ADRSettings      `json:"pending_adr"` // Sent in a LinkADRReq, not yet answered
+
+	ADRAckLimit int `json:"adr_ack_limit"` // Zero means the default of the region
+	ADRAckDelay int `json:"adr_ack_delay"` // Zero means the default of the region
+
+	RJCount0 uint32 `json:"rj_count0"` // The lowest RJcount0 that is accepted in the next rejoin request
+}
+
+// Clone returns a deep copy of the DeviceSession
+func (session *DeviceSession) Clone() *DeviceSession {
+	clone := *session
+	clone.FNwkSIntKey = cloneBytes(session.FNwkSIntKey)
+	clone.SNwkSIntKey = cloneBytes(session.SNwkSIntKey)
+	clone.NwkSEncKey = cloneBytes(session.NwkSEncKey)
+	clone.AppSKey = cloneBytes(session.AppSKey)
+	if session.ChannelMask != nil {
+		clone.ChannelMask = append([]bool{}, session.ChannelMask...)
+	}
+	if session.ADRHistory != nil {
+		clone.ADRHistory = append([]ADRHistoryEntry{}, session.ADRHistory...)
+	}
+	if session.PendingADR != nil {
+		pending := *session.PendingADR
+		clone.PendingADR = &pending
+	}
+	return &clone
+}
+
+// Uplink contains a decoded uplink data message
+type Uplink struct {
+	FCnt           uint32 // The full 32-bit frame counter
+	Confirmed      bool
+	Retransmission bool // Repeats the last accepted frame counter, because of NbTrans or a missed ACK
+	ADR            bool
+	ADRACKReq      bool
+	ACK            bool
+	FOpts          []byte // Decrypted for LoRaWAN 1.1
+	FPort          uint8
+	FRMPayload     []byte // Decrypted
+}
+
+// MACCommands returns the MAC commands of the uplink message, from FOpts or
+// from FRMPayload with FPort 0
+func (uplink *Uplink) MACCommands() ([]MACCommand, error) {
+	if uplink.FPort == 0 && len(uplink.FRMPayload) > 0 {
+		return ParseMACCommands(uplink.FRMPayload, true)
+	}
+	return ParseMACCommands(uplink.FOpts, true)
+}
+
+// Downlink contains a downlink data message that is to be encoded
+type Downlink struct {
+	Confirmed  bool
+	ACK        bool
+	FPending   bool
+	FOpts      []byte
+	FPort      uint8  // Left out if there is no FRMPayload
+	FRMPayload []byte // Not yet encrypted
+}
+
+// UplinkTXParams contains the data rate and the index of the channel on which
+// an uplink message was transmitted, which are part of the MIC of LoRaWAN 1.1
+// uplink messages
+type UplinkTXParams struct {
+	DataRate uint8
+	Channel  uint8
+}
+
+// matchUplink returns the full frame counter with which the MIC of the
+// uplink message is valid. It returns ErrFCntTooLow for replayed messages,
+// except for retransmissions of the last accepted frame counter.
+func (session *DeviceSession) matchUplink(phyPayload *PHYPayload, txParams *UplinkTXParams) (uint32, error) {
+	policy := session.FCntPolicy
+	fCnt16 := phyPayload.DataPayload.FHDR.FCnt
+
+	fCnt := policy.FullFCnt(session.FCntUp, fCnt16)
+	err := session.validateUplinkMIC(phyPayload, txParams, fCnt)
+	if err == nil {
+		return fCnt, nil
+	}
+
+	// Retransmissions and replays have a valid MIC with the frame counter
+	// before rollover
+	if previous := fCnt - 0x10000; fCnt > 0xFFFF && previous < session.FCntUp && session.validateUplinkMIC(phyPayload, txParams, previous) == nil {
+		if previous == session.FCntUp-1 {
+			return previous, nil
+		}
+		if !policy.Relaxed {
+			return 0, ErrFCntTooLow
+		}
+	}
+
+	// The frame counter of the device was reset
+	if policy.Relaxed && uint32(fCnt16) != fCnt && session.validateUplinkMIC(phyPayload, txParams, uint32(fCnt16)) == nil {
+		return uint32(fCnt16), nil
+	}
+
+	return 0, err
+}
+
+// dataMessage returns MHDR | MACPayload of a PHYPayload, preferring the raw
+// bytes of parsed messages
+func dataMessage(phyPayload *PHYPayload) []byte {
+	if len(phyPayload.RawMACPayload) > 0 {
+		return append([]byte{phyPayload.MHDR.Byte()}, phyPayload.RawMACPayload...)
+	}
+	return append([]byte{phyPayload.MHDR.Byte()}, phyPayload.DataPayload.Bytes()...)
+}
+
+// validateUplinkMIC checks the MIC of an uplink data message with the full
+// frame counter. The MIC of LoRaWAN 1.1 consists of a half that is calculated
+// with the SNwkSIntKey over the data rate, channel and acknowledged downlink
+// frame counter, and a half that is calculated with the FNwkSIntKey. Both are
+// checked, so the txParams are required for LoRaWAN 1.1.
+func (session *DeviceSession) validateUplinkMIC(phyPayload *PHYPayload, txParams *UplinkTXParams, fCnt uint32) error {
+	if len(phyPayload.MIC) != 4 {
+		return ErrInvalidMIC
+	}
+	msg := dataMessage(phyPayload)
+	b0 := dataMICBlock(0, 0, 0, false, session.DevAddr, fCnt, len(msg))
+	cmacF, err := calculateCMAC(session.FNwkSIntKey, b0, msg)
+	if err != nil {
+		return err
+	}
+	if !session.MACVersion.is11() {
+		if !bytes.Equal(phyPayload.MIC, cmacF[0:4]) {
+			return ErrInvalidMIC
+		}
+		return nil
+	}
+
+	if txParams == nil {
+		return ErrUnknownTXParams
+	}
+	var confFCnt uint16
+	if phyPayload.DataPayload.FHDR.FCtrl.ACK {
+		confFCnt = uint16(session.ConfFCntDown)
+	}
+	b1 := dataMICBlock(confFCnt, txParams.DataRate, txParams.Channel, false, session.DevAddr, fCnt, len(msg))
+	cmacS, err := calculateCMAC(session.SNwkSIntKey, b1, msg)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(phyPayload.MIC[0:2], cmacS[0:2]) || !bytes.Equal(phyPayload.MIC[2:4], cmacF[0:2]) {
+		return ErrInvalidMIC
+	}
+	return nil
+}
+
+// DecodeUplink validates an uplink data message of the device with the
+// FCntPolicy, decrypts it and advances FCntUp. A retransmission of the last
+// accepted frame counter is decoded with Retransmission set, without
+// advancing FCntUp. The txParams may only be nil for LoRaWAN 1.0 devices. The
+// session is not changed if the message is invalid.
+func (session *DeviceSession) DecodeUplink(phyPayload *PHYPayload, txParams *UplinkTXParams) (*Uplink, error) {
+	mType := phyPayload.MHDR.MType
+	if mType != macMTypeUnconfirmedDataUp && mType != macMTypeConfirmedDataUp {
+		return nil, fmt.Errorf("MType %d is not an uplink data message", mType)
+	}
+	dataPayload := phyPayload.DataPayload
+	if dataPayload == nil || dataPayload.FHDR == nil {
+		return nil, errors.New("The PHYPayload does not contain a data payload")
+	}
+	fHdr := dataPayload.FHDR
+	if fHdr.DevAddr != session.DevAddr {
+		return nil, fmt.Errorf("DevAddr %08X does not match session DevAddr %08X", fHdr.DevAddr, session.DevAddr)
+	}
+
+	fCnt, err := session.matchUplink(phyPayload, txParams)
+	if err != nil {
+		return nil, err
+	}
+	retransmission := session.FCntUp > 0 && fCnt == session.FCntUp-1
+	if !retransmission {
+		if err := session.FCntPolicy.Validate(session.FCntUp, fCnt); err != nil {
+			return nil, err
+		}
+	}
+
+	uplink := &Uplink{
+		FCnt:           fCnt,
+		Confirmed:      mType == macMTypeConfirmedDataUp,
+		Retransmission: retransmission,
+		ADR:            fHdr.FCtrl.ADR,
+		ADRACKReq:      fHdr.FCtrl.ADRACKReq,
+		ACK:            fHdr.FCtrl.ACK,
+		FOpts:          fHdr.FOpts,
+		FPort:          dataPayload.FPort,
+	}
+
+	if session.MACVersion.is11() && len(fHdr.FOpts) > 0 {
+		fOpts, err := CryptData32(session.NwkSEncKey, fHdr.FOpts, false, session.DevAddr, fCnt)
+		if err != nil {
+			return nil, err
+		}
+		uplink.FOpts = fOpts
+	}
+
+	if len(dataPayload.RawFRMPayload) > 0 {
+		key := session.AppSKey
+		if dataPayload.FPort == 0 {
+			key = session.NwkSEncKey
+		}
+		frmPayload, err := CryptData32(key, dataPayload.RawFRMPayload, false, session.DevAddr, fCnt)
+		if err != nil {
+			return nil, err
+		}
+		uplink.FRMPayload = frmPayload
+	}
+
+	if !retransmission {
+		session.RetransmissionACKs = 0
+	}
+	session.FCntUp = fCnt + 1
+	return uplink, nil
+}
+
+// ValidateRejoinRequest validates a rejoin request of type 0 or 2 with the
+// SNwkSIntKey of the session and advances RJCount0. The session is not
+// changed if the message is invalid.
+// See Section 6.2.4.1 of the LoRaWan 1.1 Specification
+func (session *DeviceSession) ValidateRejoinRequest(phyPayload *PHYPayload) error {
+	rejoinRequest := phyPayload.RejoinRequestPayload
+	if phyPayload.MHDR.MType != macMTypeRejoinRequest || rejoinRequest == nil {
+		return errors.New("The PHYPayload is not a rejoin request message")
+	}
+	if rejoinRequest.RejoinType != RejoinType0 && rejoinRequest.RejoinType != RejoinType2 {
+		return fmt.Errorf("RejoinType %d is not validated by the session", rejoinRequest.RejoinType)
+	}
+	if !session.MACVersion.is11() {
+		return fmt.Errorf("MAC version %s does not support rejoin requests", session.MACVersion)
+	}
+	if rejoinRequest.DevEUI != session.DevEUI {
+		return fmt.Errorf("DevEUI %016X does not match session DevEUI %016X", rejoinRequest.DevEUI, session.DevEUI)
+	}
+
+	mic, err := rejoinRequest.CalculateMIC(phyPayload.MHDR, session.SNwkSIntKey)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(phyPayload.MIC, mic) {
+		return ErrInvalidMIC
+	}
+	if uint32(rejoinRequest.RJCount) < session.RJCount0 {
+		return ErrRJCountReused
+	}
+	session.RJCount0 = uint32(rejoinRequest.RJCount) + 1
+	return nil
+}
+
+// keepRadioParameters copies the radio parameters of the previous session,
+// which a rejoin request of type 2 does not change
+func (session *DeviceSession) keepRadioParameters(previous *DeviceSession) {
+	session.RXDelay = previous.RXDelay
+	session.RX1DROffset = previous.RX1DROffset
+	session.RX2DataRate = previous.RX2DataRate
+	session.RX2Frequency = previous.RX2Frequency
+	if previous.ChannelMask != nil {
+		session.ChannelMask = append([]bool{}, previous.ChannelMask...)
+	}
+	session.ADR = previous.ADR
+	session.DataRate = previous.DataRate
+	session.TXPower = previous.TXPower
+	session.NbTrans = previous.NbTrans
+	session.ADRAckLimit = previous.ADRAckLimit
+	session.ADRAckDelay = previous.ADRAckDelay
+}
+
+// EncodeDownlink encrypts a downlink data message for the device, calculates
+// its MIC and advances the downlink frame counter
+func (session *DeviceSession) EncodeDownlink(downlink *Downlink) (*PHYPayload, error) {
+	if len(downlink.FOpts) > 15 {
+		return nil, fmt.Errorf("FOpts should be at most 15 bytes, not %d", len(downlink.FOpts))
+	}
+	hasFPort := len(downlink.FRMPayload) > 0
+	if hasFPort && downlink.FPort == 0 && len(downlink.FOpts) > 0 {
+		return nil, errors.New("FOpts should be empty when FRMPayload contains MAC commands")
+	}
+
+	fCntDown := &session.NFCntDown
+	if session.MACVersion.is11() && hasFPort && downlink.FPort > 0 {
+		fCntDown = &session.AFCntDown
+	}
+	fCnt := *fCntDown
+
+	fOpts := downlink.FOpts
+	if session.MACVersion.is11() && len(fOpts) > 0 {
+		var err error
+		fOpts, err = CryptData32(session.NwkSEncKey, fOpts, true, session.DevAddr, fCnt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if fOpts == nil {
+		fOpts = []byte{}
+	}
+
+	key := session.AppSKey
+	if downlink.FPort == 0 {
+		key = session.NwkSEncKey
+	}
+	var frmPayload []byte
+	if hasFPort {
+		var err error
+		if frmPayload, err = CryptData32(key, downlink.FRMPayload, true, session.DevAddr, fCnt); err != nil {
+			return nil, err
+		}
+	}
+
+	mhdr := &MHDR{MType: macMTypeUnconfirmedDataDown, Major: macMajorLoRaWANR1}
+	if downlink.Confirmed {
+		mhdr.MType = macMTypeConfirmedDataDown
+	}
+	fHdr := &FHDR{
+		DevAddr: session.DevAddr,
+		FCtrl: &FCtrl{
+			ADR:      session.ADR,
+			ACK:      downlink.ACK,
+			FPending: downlink.FPending,
+			FOptsLen: uint8(len(fOpts)),
+		},
+		FCnt:  uint16(fCnt),
+		FOpts: fOpts,
+	}
+	dataPayload := &DataPayload{
+		FHDR:          fHdr,
+		RawFHDR:       fHdr.Bytes(),
+		FPort:         downlink.FPort,
+		RawFRMPayload: frmPayload,
+	}
+
+	var confFCnt uint16
+	if session.MACVersion.is11() && downlink.ACK && session.FCntUp > 0 {
+		confFCnt = uint16(session.FCntUp - 1)
+	}
+	msg := append([]byte{mhdr.Byte()}, dataPayload.Bytes()...)
+	b0 := dataMICBlock(confFCnt, 0, 0, true, session.DevAddr, fCnt, len(msg))
+	mic, err := calculateCMAC(session.SNwkSIntKey, b0, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	*fCntDown = fCnt + 1
+	if downlink.Confirmed {
+		session.ConfFCntDown = fCnt
+	}
+	return &PHYPayload{
+		MHDR:          mhdr,
+		RawMHDR:       mhdr.Byte(),
+		DataPayload:   dataPayload,
+		RawMACPayload: dataPayload.Bytes(),
+		MIC:           mic[0:4],
+	}, nil
+}
@@ -0,0 +1,411 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrSessionNotFound is returned when a device session does not exist
+	ErrSessionNotFound = errors.New("The device session does not exist")
+
+	// ErrSessionExists is returned when creating a device session that already exists
+	ErrSessionExists = errors.New("The device session already exists")
+
+	// ErrFCntConflict is returned when the frame counters of a device session
+	// were changed since it was retrieved
+	ErrFCntConflict = errors.New("The frame counters of the device session were changed")
+)
+
+/* FrameCounters Implementations */
+
+// FrameCounters contains the frame counters of a DeviceSession
+type FrameCounters struct {
+	FCntUp    uint32
+	NFCntDown uint32
+	AFCntDown uint32
+}
+
+// FrameCounters returns the current frame counters of the DeviceSession
+func (session *DeviceSession) FrameCounters() FrameCounters {
+	return FrameCounters{
+		FCntUp:    session.FCntUp,
+		NFCntDown: session.NFCntDown,
+		AFCntDown: session.AFCntDown,
+	}
+}
+
+/* DeviceSessionStore Implementations */
+
+// DeviceSessionStore stores DeviceSessions between messages. Implementations
+// must be safe for concurrent use and must return copies of the stored
+// sessions.
+type DeviceSessionStore interface {
+	// GetByDevAddr returns all sessions with the DevAddr, as multiple devices
+	// can share a DevAddr. It returns an empty list if there are none.
+	GetByDevAddr(devAddr uint32) ([]*DeviceSession, error)
+
+	// GetByDevEUI returns the session of the device, or ErrSessionNotFound
+	GetByDevEUI(devEUI uint64) (*DeviceSession, error)
+
+	// Save stores the session if the stored frame counters are equal to
+	// expected, and returns ErrFCntConflict otherwise. If expected is nil, the
+	// session is created, or ErrSessionExists is returned.
+	Save(session *DeviceSession, expected *FrameCounters) error
+
+	// Delete deletes the session of the device, or returns ErrSessionNotFound
+	Delete(devEUI uint64) error
+}
+
+/* MemorySessionStore Implementations */
+
+// MemorySessionStore is a DeviceSessionStore that keeps sessions in memory
+type MemorySessionStore struct {
+	mu        sync.RWMutex
+	sessions  map[uint64]*DeviceSession
+	byDevAddr map[uint32]map[uint64]bool
+}
+
+// NewMemorySessionStore returns a new, empty MemorySessionStore
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions:  make(map[uint64]*DeviceSession),
+		byDevAddr: make(map[uint32]map[uint64]bool),
+	}
+}
+
+// GetByDevAddr implements DeviceSessionStore
+func (store *MemorySessionStore) GetByDevAddr(devAddr uint32) ([]*DeviceSession, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	sessions := make([]*DeviceSession, 0, len(store.byDevAddr[devAddr]))
+	for devEUI := range store.byDevAddr[devAddr] {
+		sessions = append(sessions, store.sessions[devEUI].Clone())
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].DevEUI < sessions[j].DevEUI })
+	return sessions, nil
+}
+
+// GetByDevEUI implements DeviceSessionStore
+func (store *MemorySessionStore) GetByDevEUI(devEUI uint64) (*DeviceSession, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	session, ok := store.sessions[devEUI]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return session.Clone(), nil
+}
+
+// Save implements DeviceSessionStore
+func (store *MemorySessionStore) Save(session *DeviceSession, expected *FrameCounters) error {
+	return store.save(session, expected, nil)
+}
+
+// save checks the frame counters and calls commit (if any) before applying
+// the change, while holding the lock
+func (store *MemorySessionStore) save(session *DeviceSession, expected *FrameCounters, commit func() error) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stored, ok := store.sessions[session.DevEUI]
+	switch {
+	case expected == nil && ok:
+		return ErrSessionExists
+	case expected != nil && !ok:
+		return ErrSessionNotFound
+	case expected != nil && stored.FrameCounters() != *expected:
+		return ErrFCntConflict
+	}
+
+	if commit != nil {
+		if err := commit(); err != nil {
+			return err
+		}
+	}
+
+	store.put(session.Clone())
+	return nil
+}
+
+// put stores the session without any checks
+func (store *MemorySessionStore) put(session *DeviceSession) {
+	if stored, ok := store.sessions[session.DevEUI]; ok {
+		store.unindex(stored)
+	}
+	store.sessions[session.DevEUI] = session
+	if store.byDevAddr[session.DevAddr] == nil {
+		store.byDevAddr[session.DevAddr] = make(map[uint64]bool)
+	}
+	store.byDevAddr[session.DevAddr][session.DevEUI] = true
+}
+
+// unindex removes the session from the DevAddr index
+func (store *MemorySessionStore) unindex(session *DeviceSession) {
+	delete(store.byDevAddr[session.DevAddr], session.DevEUI)
+	if len(store.byDevAddr[session.DevAddr]) == 0 {
+		delete(store.byDevAddr, session.DevAddr)
+	}
+}
+
+// Delete implements DeviceSessionStore
+func (store *MemorySessionStore) Delete(devEUI uint64) error {
+	return store.delete(devEUI, nil)
+}
+
+// delete calls commit (if any) before deleting the session, while holding the lock
+func (store *MemorySessionStore) delete(devEUI uint64, commit func() error) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stored, ok := store.sessions[devEUI]
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	if commit != nil {
+		if err := commit(); err != nil {
+			return err
+		}
+	}
+
+	store.unindex(stored)
+	delete(store.sessions, devEUI)
+	return nil
+}
+
+/* FileSessionStore Implementations */
+
+// fileSessionRecord is a line in the log of a FileSessionStore
+type fileSessionRecord struct {
+	Op      string         `json:"op"`
+	Session *DeviceSession `json:"session,omitempty"`
+	DevEUI  uint64         `json:"dev_eui,omitempty"`
+}
+
+// FileSessionStore is a DeviceSessionStore that appends every change to a
+// log of JSON records, which is synced to disk before the change is applied.
+// When the store is opened, the log is replayed. A record that was only
+// partially written before a crash is discarded.
+type FileSessionStore struct {
+	*MemorySessionStore
+
+	path   string
+	mu     sync.Mutex
+	file   *os.File
+	offset int64 // The end of the last complete record
+}
+
+// OpenFileSessionStore opens the FileSessionStore at path, creating it if it
+// does not exist
+func OpenFileSessionStore(path string) (*FileSessionStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open session store: %s", err.Error())
+	}
+
+	store := &FileSessionStore{
+		MemorySessionStore: NewMemorySessionStore(),
+		path:               path,
+		file:               file,
+	}
+
+	if err := store.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// replay applies the records in the log and truncates a partial last record
+func (store *FileSessionStore) replay() error {
+	reader := bufio.NewReader(store.file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A record without newline was not completely written
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to read session store: %s", err.Error())
+		}
+
+		record := &fileSessionRecord{}
+		if err := json.Unmarshal(line, record); err != nil {
+			if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+				// The last record was not completely written
+				break
+			}
+			return fmt.Errorf("Failed to parse session store record at offset %d: %s", offset, err.Error())
+		}
+
+		switch record.Op {
+		case "save":
+			store.MemorySessionStore.put(record.Session)
+		case "delete":
+			if stored, ok := store.MemorySessionStore.sessions[record.DevEUI]; ok {
+				store.MemorySessionStore.unindex(stored)
+				delete(store.MemorySessionStore.sessions, record.DevEUI)
+			}
+		default:
+			return fmt.Errorf("Session store record at offset %d has unknown op %q", offset, record.Op)
+		}
+		offset += int64(len(line))
+	}
+
+	if err := store.file.Truncate(offset); err != nil {
+		return fmt.Errorf("Failed to truncate session store: %s", err.Error())
+	}
+	if _, err := store.file.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("Failed to seek session store: %s", err.Error())
+	}
+	store.offset = offset
+	return nil
+}
+
+// append writes a record to the log and syncs it to disk
+func (store *FileSessionStore) append(record *fileSessionRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal session store record: %s", err.Error())
+	}
+	line = append(line, '\n')
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.file == nil {
+		return errors.New("The session store is closed")
+	}
+	if _, err := store.file.Write(line); err != nil {
+		store.truncate()
+		return fmt.Errorf("Failed to write session store: %s", err.Error())
+	}
+	if err := store.file.Sync(); err != nil {
+		store.truncate()
+		return fmt.Errorf("Failed to sync session store: %s", err.Error())
+	}
+	store.offset += int64(len(line))
+	return nil
+}
+
+// truncate discards a record that failed to be written, by truncating the log
+// to the end of the last complete record. If that fails too, the log is
+// closed, so that no records are appended after the partial record.
+func (store *FileSessionStore) truncate() {
+	if err := store.file.Truncate(store.offset); err == nil {
+		if _, err := store.file.Seek(store.offset, io.SeekStart); err == nil {
+			return
+		}
+	}
+	store.file.Close()
+	store.file = nil
+}
+
+// Save implements DeviceSessionStore
+func (store *FileSessionStore) Save(session *DeviceSession, expected *FrameCounters) error {
+	return store.MemorySessionStore.save(session, expected, func() error {
+		return store.append(&fileSessionRecord{Op: "save", Session: session})
+	})
+}
+
+// Delete implements DeviceSessionStore
+func (store *FileSessionStore) Delete(devEUI uint64) error {
+	return store.MemorySessionStore.delete(devEUI, func() error {
+		return store.append(&fileSessionRecord{Op: "delete", DevEUI: devEUI})
+	})
+}
+
+// Compact rewrites the log with a single record per session. The new log is
+// written to a temporary file that atomically replaces the old log.
+func (store *FileSessionStore) Compact() error {
+	// Block changes to the sessions while compacting
+	store.MemorySessionStore.mu.Lock()
+	defer store.MemorySessionStore.mu.Unlock()
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.file == nil {
+		return errors.New("The session store is closed")
+	}
+
+	buf := new(bytes.Buffer)
+	encoder := json.NewEncoder(buf)
+	devEUIs := make([]uint64, 0, len(store.MemorySessionStore.sessions))
+	for devEUI := range store.MemorySessionStore.sessions {
+		devEUIs = append(devEUIs, devEUI)
+	}
+	sort.Slice(devEUIs, func(i, j int) bool { return devEUIs[i] < devEUIs[j] })
+	for _, devEUI := range devEUIs {
+		if err := encoder.Encode(&fileSessionRecord{Op: "save", Session: store.MemorySessionStore.sessions[devEUI]}); err != nil {
+			return fmt.Errorf("Failed to marshal session store record: %s", err.Error())
+		}
+	}
+
+	tmpPath := store.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to create compacted session store: %s", err.Error())
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Failed to write compacted session store: %s", err.Error())
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Failed to sync compacted session store: %s", err.Error())
+	}
+	if err := os.Rename(tmpPath, store.path); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Failed to replace session store: %s", err.Error())
+	}
+
+	store.file.Close()
+	store.file = tmp
+	store.offset = int64(buf.Len())
+
+	// The rename is only durable once the directory is synced
+	return syncDir(filepath.Dir(store.path))
+}
+
+// syncDir syncs the directory, so that changes to its entries are on disk
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Failed to open session store directory: %s", err.Error())
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("Failed to sync session store directory: %s", err.Error())
+	}
+	return nil
+}
+
+// Close closes the log of the FileSessionStore
+func (store *FileSessionStore) Close() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.file == nil {
+		return nil
+	}
+	err := store.file.Close()
+	store.file = nil
+	return err
+}
@@ -0,0 +1,178 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+/* DeviceSessionStore Tests */
+
+// testDeviceSessionStore runs the tests that every DeviceSessionStore should pass
+func testDeviceSessionStore(t *testing.T, store DeviceSessionStore) {
+	a := testSession(LoRaWAN1_0_2)
+	b := testSession(LoRaWAN1_1)
+	b.DevEUI = a.DevEUI + 1
+
+	if _, err := store.GetByDevEUI(a.DevEUI); err != ErrSessionNotFound {
+		t.Errorf("GetByDevEUI of an unknown device\n   got: %v\n  want: %v", err, ErrSessionNotFound)
+	}
+	if err := store.Save(a, &FrameCounters{}); err != ErrSessionNotFound {
+		t.Errorf("Save of an unknown device\n   got: %v\n  want: %v", err, ErrSessionNotFound)
+	}
+
+	for _, session := range []*DeviceSession{a, b} {
+		if err := store.Save(session, nil); err != nil {
+			t.Fatalf("Save failed: %s", err)
+		}
+	}
+	if err := store.Save(a, nil); err != ErrSessionExists {
+		t.Errorf("Save of an existing device\n   got: %v\n  want: %v", err, ErrSessionExists)
+	}
+
+	sessions, err := store.GetByDevAddr(a.DevAddr)
+	if err != nil {
+		t.Fatalf("GetByDevAddr failed: %s", err)
+	}
+	if len(sessions) != 2 || !reflect.DeepEqual(sessions[0], a) || !reflect.DeepEqual(sessions[1], b) {
+		t.Errorf("GetByDevAddr\n   got: %#v\n  want: %#v", sessions, []*DeviceSession{a, b})
+	}
+
+	// Two copies advance the frame counter, the second must fail
+	first, _ := store.GetByDevEUI(a.DevEUI)
+	second, _ := store.GetByDevEUI(a.DevEUI)
+	expected := first.FrameCounters()
+	first.FCntUp++
+	second.FCntUp++
+	if err := store.Save(first, &expected); err != nil {
+		t.Fatalf("Save failed: %s", err)
+	}
+	if err := store.Save(second, &expected); err != ErrFCntConflict {
+		t.Errorf("Save of a stale session\n   got: %v\n  want: %v", err, ErrFCntConflict)
+	}
+
+	// Changing the DevAddr updates the index
+	moved := first.Clone()
+	moved.DevAddr = 0x26019999
+	expected = first.FrameCounters()
+	if err := store.Save(moved, &expected); err != nil {
+		t.Fatalf("Save failed: %s", err)
+	}
+	if sessions, _ := store.GetByDevAddr(a.DevAddr); len(sessions) != 1 {
+		t.Errorf("GetByDevAddr after changing the DevAddr\n   got: %d sessions\n  want: 1", len(sessions))
+	}
+
+	if err := store.Delete(b.DevEUI); err != nil {
+		t.Fatalf("Delete failed: %s", err)
+	}
+	if err := store.Delete(b.DevEUI); err != ErrSessionNotFound {
+		t.Errorf("Delete of an unknown device\n   got: %v\n  want: %v", err, ErrSessionNotFound)
+	}
+	if sessions, _ := store.GetByDevAddr(a.DevAddr); len(sessions) != 0 {
+		t.Errorf("GetByDevAddr after Delete\n   got: %d sessions\n  want: 0", len(sessions))
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	testDeviceSessionStore(t, NewMemorySessionStore())
+}
+
+func TestMemorySessionStoreConcurrency(t *testing.T) {
+	store := NewMemorySessionStore()
+	store.Save(testSession(LoRaWAN1_0_2), nil)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var saved int
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session, _ := store.GetByDevEUI(0x0004A30B001C0530)
+			expected := session.FrameCounters()
+			session.FCntUp++
+			if store.Save(session, &expected) == nil {
+				mu.Lock()
+				saved++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	session, _ := store.GetByDevEUI(0x0004A30B001C0530)
+	if int(session.FCntUp) != saved {
+		t.Errorf("FCntUp after concurrent saves\n   got: %d\n  want: %d", session.FCntUp, saved)
+	}
+}
+
+func TestFileSessionStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+
+	store, err := OpenFileSessionStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileSessionStore failed: %s", err)
+	}
+	testDeviceSessionStore(t, store)
+	store.Close()
+
+	// Simulate a crash while writing a record
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	file.Write([]byte(`{"op":"delete","dev_eu`))
+	file.Close()
+
+	store, err = OpenFileSessionStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileSessionStore after a crash failed: %s", err)
+	}
+	session, err := store.GetByDevEUI(0x0004A30B001C0530)
+	if err != nil {
+		t.Fatalf("GetByDevEUI after reopening failed: %s", err)
+	}
+	if session.FCntUp != 1 || session.DevAddr != 0x26019999 {
+		t.Errorf("GetByDevEUI after reopening\n   got: %#v", session)
+	}
+
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact failed: %s", err)
+	}
+	expected := session.FrameCounters()
+	session.FCntUp++
+	if err := store.Save(session, &expected); err != nil {
+		t.Fatalf("Save after Compact failed: %s", err)
+	}
+	store.Close()
+
+	store, _ = OpenFileSessionStore(path)
+	defer store.Close()
+	session, _ = store.GetByDevEUI(0x0004A30B001C0530)
+	if session == nil || session.FCntUp != 2 {
+		t.Errorf("GetByDevEUI after Compact\n   got: %#v", session)
+	}
+
+	// A record that failed to be written is truncated before the next append
+	store.file.Write([]byte(`{"op":"save","sess`))
+	store.truncate()
+	expected = session.FrameCounters()
+	session.FCntUp++
+	if err := store.Save(session, &expected); err != nil {
+		t.Fatalf("Save after a failed write failed: %s", err)
+	}
+	store.Close()
+
+	store, err = OpenFileSessionStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileSessionStore after a failed write failed: %s", err)
+	}
+	defer store.Close()
+	session, _ = store.GetByDevEUI(0x0004A30B001C0530)
+	if session == nil || session.FCntUp != 3 {
+		t.Errorf("GetByDevEUI after a failed write\n   got: %#v", session)
+	}
+}
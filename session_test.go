@@ -0,0 +1,254 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"bytes"
+	"testing"
+)
+
+/* DeviceSession Tests */
+
+var (
+	sessionNwkSKey = []byte{0x2B, 0x7E, 0x15, 0x16, 0x28, 0xAE, 0xD2, 0xA6, 0xAB, 0xF7, 0x15, 0x88, 0x09, 0xCF, 0x4F, 0x3C}
+	sessionAppSKey = []byte{0x3C, 0x4F, 0xCF, 0x09, 0x88, 0x15, 0xF7, 0xAB, 0xA6, 0xD2, 0xAE, 0x28, 0x16, 0x15, 0x7E, 0x2B}
+)
+
+func testSession(version MACVersion) *DeviceSession {
+	session := &DeviceSession{
+		DevAddr:     0x26011234,
+		DevEUI:      0x0004A30B001C0530,
+		MACVersion:  version,
+		FNwkSIntKey: sessionNwkSKey,
+		SNwkSIntKey: sessionNwkSKey,
+		NwkSEncKey:  sessionNwkSKey,
+		AppSKey:     sessionAppSKey,
+		NbTrans:     1,
+	}
+	if version.is11() {
+		session.SNwkSIntKey = sessionAppSKey
+		session.NwkSEncKey = key
+	}
+	return session
+}
+
+// testTXParams are the data rate and channel of the messages of testUplink
+var testTXParams = &UplinkTXParams{DataRate: 5, Channel: 2}
+
+// testUplink encodes an uplink data message the way the device would
+func testUplink(session *DeviceSession, fCnt uint32, confirmed bool, fPort uint8, payload []byte) []byte {
+	mhdr := &MHDR{MType: macMTypeUnconfirmedDataUp, Major: macMajorLoRaWANR1}
+	if confirmed {
+		mhdr.MType = macMTypeConfirmedDataUp
+	}
+	fHdr := &FHDR{DevAddr: session.DevAddr, FCtrl: &FCtrl{ADR: true}, FCnt: uint16(fCnt), FOpts: []byte{}}
+	appKey := session.AppSKey
+	if fPort == 0 {
+		appKey = session.NwkSEncKey
+	}
+	encrypted, _ := CryptData32(appKey, payload, false, session.DevAddr, fCnt)
+	dataPayload := &DataPayload{FHDR: fHdr, RawFHDR: fHdr.Bytes(), FPort: fPort, RawFRMPayload: encrypted}
+
+	msg := append([]byte{mhdr.Byte()}, dataPayload.Bytes()...)
+	cmacF, _ := calculateCMAC(session.FNwkSIntKey, dataMICBlock(0, 0, 0, false, session.DevAddr, fCnt, len(msg)), msg)
+	mic := cmacF[0:4]
+	if session.MACVersion.is11() {
+		cmacS, _ := calculateCMAC(session.SNwkSIntKey, dataMICBlock(0, testTXParams.DataRate, testTXParams.Channel, false, session.DevAddr, fCnt, len(msg)), msg)
+		mic = append(cmacS[0:2:2], cmacF[0:2]...)
+	}
+	return append(msg, mic...)
+}
+
+func TestDeviceSessionDecodeUplink(t *testing.T) {
+	for _, version := range []MACVersion{LoRaWAN1_0_2, LoRaWAN1_1} {
+		session := testSession(version)
+		session.FCntUp = 0x1FFFE
+
+		phyPayload, err := ParsePHYPayload(testUplink(session, 0x20001, true, 10, []byte("hello")))
+		if err != nil {
+			t.Fatalf("ParsePHYPayload failed: %s", err)
+		}
+		uplink, err := session.DecodeUplink(phyPayload, testTXParams)
+		if err != nil {
+			t.Fatalf("LoRaWAN %s DecodeUplink failed: %s", version, err)
+		}
+		if uplink.FCnt != 0x20001 || !uplink.Confirmed || !uplink.ADR || uplink.FPort != 10 {
+			t.Errorf("LoRaWAN %s DecodeUplink\n   got: %#v", version, uplink)
+		}
+		if !bytes.Equal(uplink.FRMPayload, []byte("hello")) {
+			t.Errorf("LoRaWAN %s DecodeUplink.FRMPayload\n   got: %q\n  want: %q", version, uplink.FRMPayload, "hello")
+		}
+		if session.FCntUp != 0x20002 {
+			t.Errorf("LoRaWAN %s FCntUp\n   got: %d\n  want: %d", version, session.FCntUp, 0x20002)
+		}
+
+		// A retransmission of the same frame counter is accepted once more
+		uplink, err = session.DecodeUplink(phyPayload, testTXParams)
+		if err != nil || !uplink.Retransmission || !bytes.Equal(uplink.FRMPayload, []byte("hello")) {
+			t.Errorf("LoRaWAN %s DecodeUplink of a retransmission\n   got: %#v, %v", version, uplink, err)
+		}
+		if session.FCntUp != 0x20002 {
+			t.Errorf("LoRaWAN %s DecodeUplink of a retransmission should not change FCntUp", version)
+		}
+
+		next, _ := ParsePHYPayload(testUplink(session, 0x20002, false, 10, []byte("hello")))
+		if uplink, err := session.DecodeUplink(next, testTXParams); err != nil || uplink.Retransmission {
+			t.Fatalf("LoRaWAN %s DecodeUplink of the next message\n   got: %#v, %v", version, uplink, err)
+		}
+		if _, err := session.DecodeUplink(phyPayload, testTXParams); err != ErrFCntTooLow {
+			t.Errorf("LoRaWAN %s DecodeUplink of a replay\n   got: %v\n  want: %v", version, err, ErrFCntTooLow)
+		}
+	}
+
+	session := testSession(LoRaWAN1_0_2)
+	data := testUplink(session, 1, false, 1, []byte{0x01})
+	data[len(data)-1] ^= 0xFF
+	phyPayload, _ := ParsePHYPayload(data)
+	if _, err := session.DecodeUplink(phyPayload, testTXParams); err != ErrInvalidMIC {
+		t.Errorf("DecodeUplink with an invalid MIC\n   got: %v\n  want: %v", err, ErrInvalidMIC)
+	}
+	if session.FCntUp != 0 {
+		t.Errorf("DecodeUplink with an invalid MIC should not change FCntUp")
+	}
+
+	other := testSession(LoRaWAN1_0_2)
+	other.DevAddr = 0x26015678
+	phyPayload, _ = ParsePHYPayload(testUplink(other, 1, false, 1, []byte{0x01}))
+	if _, err := session.DecodeUplink(phyPayload, testTXParams); err == nil {
+		t.Errorf("DecodeUplink should error on messages for other devices")
+	}
+}
+
+func TestDeviceSessionValidateUplinkMIC11(t *testing.T) {
+	session := testSession(LoRaWAN1_1)
+	data := testUplink(session, 1, false, 1, []byte{0x01})
+	phyPayload, _ := ParsePHYPayload(data)
+
+	tests := []struct {
+		txParams *UplinkTXParams
+		want     error
+	}{
+		{testTXParams, nil},
+		{nil, ErrUnknownTXParams},
+		{&UplinkTXParams{DataRate: 4, Channel: 2}, ErrInvalidMIC},
+		{&UplinkTXParams{DataRate: 5, Channel: 1}, ErrInvalidMIC},
+	}
+	for _, tt := range tests {
+		if got := session.validateUplinkMIC(phyPayload, tt.txParams, 1); got != tt.want {
+			t.Errorf("validateUplinkMIC with %#v\n   got: %v\n  want: %v", tt.txParams, got, tt.want)
+		}
+	}
+
+	// The half of the MIC that is calculated with the SNwkSIntKey is checked too
+	data[len(data)-4] ^= 0xFF
+	phyPayload, _ = ParsePHYPayload(data)
+	if err := session.validateUplinkMIC(phyPayload, testTXParams, 1); err != ErrInvalidMIC {
+		t.Errorf("validateUplinkMIC with an invalid SNwkSIntKey half\n   got: %v\n  want: %v", err, ErrInvalidMIC)
+	}
+}
+
+func TestDeviceSessionEncodeDownlink(t *testing.T) {
+	session := testSession(LoRaWAN1_0_2)
+	session.NFCntDown = 7
+
+	phyPayload, err := session.EncodeDownlink(&Downlink{Confirmed: true, ACK: true, FPort: 2, FRMPayload: []byte("world")})
+	if err != nil {
+		t.Fatalf("EncodeDownlink failed: %s", err)
+	}
+	if session.NFCntDown != 8 {
+		t.Errorf("NFCntDown\n   got: %d\n  want: %d", session.NFCntDown, 8)
+	}
+
+	parsed, err := ParsePHYPayload(phyPayload.Bytes())
+	if err != nil {
+		t.Fatalf("ParsePHYPayload failed: %s", err)
+	}
+	if parsed.MHDR.MType != macMTypeConfirmedDataDown || !parsed.DataPayload.FHDR.FCtrl.ACK || parsed.DataPayload.FHDR.FCnt != 7 {
+		t.Errorf("EncodeDownlink\n   got: %#v", parsed.DataPayload.FHDR)
+	}
+	mic, _ := parsed.DataPayload.CalculateMIC(parsed.MHDR, sessionNwkSKey)
+	if !bytes.Equal(mic, parsed.MIC) {
+		t.Errorf("EncodeDownlink MIC\n   got: %#v\n  want: %#v", parsed.MIC, mic)
+	}
+	plaintext, _ := parsed.DataPayload.Crypt(sessionAppSKey, true)
+	if !bytes.Equal(plaintext, []byte("world")) {
+		t.Errorf("EncodeDownlink FRMPayload\n   got: %q\n  want: %q", plaintext, "world")
+	}
+
+	session11 := testSession(LoRaWAN1_1)
+	session11.EncodeDownlink(&Downlink{FPort: 2, FRMPayload: []byte{0x01}})
+	session11.EncodeDownlink(&Downlink{FOpts: []byte{0x06}})
+	session11.EncodeDownlink(&Downlink{FPort: 2, FOpts: []byte{0x06}})
+	if session11.AFCntDown != 1 || session11.NFCntDown != 2 {
+		t.Errorf("LoRaWAN 1.1 frame counters\n   got: AFCntDown %d, NFCntDown %d\n  want: 1, 2", session11.AFCntDown, session11.NFCntDown)
+	}
+
+	// Without FRMPayload there is no FPort: MHDR, FHDR with FOpts and MIC
+	phyPayload, err = session.EncodeDownlink(&Downlink{FPort: 2, FOpts: []byte{0x06}})
+	if err != nil {
+		t.Fatalf("EncodeDownlink failed: %s", err)
+	}
+	if got := len(phyPayload.Bytes()); got != 1+7+1+4 {
+		t.Errorf("Length of a downlink without FRMPayload\n   got: %d\n  want: %d", got, 1+7+1+4)
+	}
+	parsed, _ = ParsePHYPayload(phyPayload.Bytes())
+	if mic, _ := parsed.DataPayload.CalculateMIC(parsed.MHDR, sessionNwkSKey); !bytes.Equal(mic, parsed.MIC) {
+		t.Errorf("MIC of a downlink without FRMPayload\n   got: %#v\n  want: %#v", parsed.MIC, mic)
+	}
+	if _, err := session.EncodeDownlink(&Downlink{FOpts: []byte{0x06}, FRMPayload: []byte{0x06}}); err == nil {
+		t.Errorf("EncodeDownlink should error on FOpts with MAC commands in FRMPayload")
+	}
+
+	if _, err := session.EncodeDownlink(&Downlink{FOpts: make([]byte, 16)}); err == nil {
+		t.Errorf("EncodeDownlink should error on too many FOpts")
+	}
+}
+
+func TestDeviceSessionClone(t *testing.T) {
+	session := testSession(LoRaWAN1_0_2)
+	session.ChannelMask = []bool{true, true, true}
+	clone := session.Clone()
+	clone.AppSKey[0] = 0x00
+	clone.ChannelMask[0] = false
+	if session.AppSKey[0] == 0x00 || !session.ChannelMask[0] {
+		t.Errorf("Clone should not share keys or channel masks")
+	}
+}
+
+func TestDeviceSessionValidateRejoinRequest(t *testing.T) {
+	session := testSession(LoRaWAN1_1)
+	mhdr := &MHDR{MType: macMTypeRejoinRequest, Major: macMajorLoRaWANR1}
+	rejoinRequest := func(rejoinType uint8, rjCount uint16, key []byte) *PHYPayload {
+		rejoinRequest := &RejoinRequestPayload{RejoinType: rejoinType, NetID: 0x000013, DevEUI: session.DevEUI, RJCount: rjCount}
+		mic, _ := rejoinRequest.CalculateMIC(mhdr, key)
+		return &PHYPayload{MHDR: mhdr, RejoinRequestPayload: rejoinRequest, MIC: mic}
+	}
+
+	tests := []struct {
+		phyPayload *PHYPayload
+		want       error
+		rjCount0   uint32
+	}{
+		{rejoinRequest(RejoinType0, 3, session.SNwkSIntKey), nil, 4},
+		{rejoinRequest(RejoinType2, 3, session.SNwkSIntKey), ErrRJCountReused, 4},
+		{rejoinRequest(RejoinType2, 4, session.SNwkSIntKey), nil, 5},
+		{rejoinRequest(RejoinType0, 5, session.FNwkSIntKey), ErrInvalidMIC, 5},
+	}
+	for i, tt := range tests {
+		if got := session.ValidateRejoinRequest(tt.phyPayload); got != tt.want {
+			t.Errorf("%d: ValidateRejoinRequest\n   got: %v\n  want: %v", i, got, tt.want)
+		}
+		if session.RJCount0 != tt.rjCount0 {
+			t.Errorf("%d: RJCount0\n   got: %d\n  want: %d", i, session.RJCount0, tt.rjCount0)
+		}
+	}
+
+	if err := session.ValidateRejoinRequest(rejoinRequest(RejoinType1, 10, session.SNwkSIntKey)); err == nil {
+		t.Errorf("ValidateRejoinRequest should error on rejoin request type 1")
+	}
+	if err := testSession(LoRaWAN1_0_2).ValidateRejoinRequest(rejoinRequest(RejoinType0, 10, session.SNwkSIntKey)); err == nil {
+		t.Errorf("ValidateRejoinRequest should error for LoRaWAN 1.0 sessions")
+	}
+}
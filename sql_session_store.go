@@ -0,0 +1,234 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// sqlSessionStoreMigrations are applied in order, each in a transaction.
+// Existing migrations must never be changed, only appended to.
+var sqlSessionStoreMigrations = []string{
+	`CREATE TABLE device_sessions (
+		dev_eui      TEXT PRIMARY KEY,
+		dev_addr     BIGINT NOT NULL,
+		f_cnt_up     BIGINT NOT NULL,
+		n_f_cnt_down BIGINT NOT NULL,
+		a_f_cnt_down BIGINT NOT NULL,
+		session      BYTEA NOT NULL
+	)`,
+	`CREATE INDEX device_sessions_dev_addr ON device_sessions (dev_addr)`,
+}
+
+// Queries of the SQLSessionStore, using PostgreSQL placeholders
+const (
+	sqlCreateMigrationsTable  = `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL)`
+	sqlSelectMigrationVersion = `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`
+	sqlInsertMigrationVersion = `INSERT INTO schema_migrations (version) VALUES ($1)`
+
+	sqlSelectSessionsByDevAddr = `SELECT dev_eui, session FROM device_sessions WHERE dev_addr = $1 ORDER BY dev_eui`
+	sqlSelectSessionByDevEUI   = `SELECT dev_eui, session FROM device_sessions WHERE dev_eui = $1`
+	sqlInsertSession           = `INSERT INTO device_sessions (dev_eui, dev_addr, f_cnt_up, n_f_cnt_down, a_f_cnt_down, session) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (dev_eui) DO NOTHING`
+	sqlUpdateSession           = `UPDATE device_sessions SET dev_addr = $2, f_cnt_up = $3, n_f_cnt_down = $4, a_f_cnt_down = $5, session = $6 WHERE dev_eui = $1 AND f_cnt_up = $7 AND n_f_cnt_down = $8 AND a_f_cnt_down = $9`
+	sqlDeleteSession           = `DELETE FROM device_sessions WHERE dev_eui = $1`
+)
+
+/* SQLSessionStore Implementations */
+
+// SQLSessionStore is a DeviceSessionStore that uses a database/sql database.
+// The frame counters are stored in separate columns for optimistic locking,
+// the sessions themselves are stored encrypted with AES-GCM, so that the
+// session keys are encrypted at rest.
+type SQLSessionStore struct {
+	db   *sql.DB
+	aead cipher.AEAD
+}
+
+// NewSQLSessionStore returns a new SQLSessionStore that encrypts sessions with
+// the encryption key (16, 24 or 32 bytes). Call Migrate before using it.
+func NewSQLSessionStore(db *sql.DB, encryptionKey []byte) (*SQLSessionStore, error) {
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create AES cipher: %s", err.Error())
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create GCM: %s", err.Error())
+	}
+	return &SQLSessionStore{db: db, aead: aead}, nil
+}
+
+// Migrate applies the schema migrations that were not yet applied
+func (store *SQLSessionStore) Migrate() error {
+	if _, err := store.db.Exec(sqlCreateMigrationsTable); err != nil {
+		return fmt.Errorf("Failed to create migrations table: %s", err.Error())
+	}
+
+	var version int
+	if err := store.db.QueryRow(sqlSelectMigrationVersion).Scan(&version); err != nil {
+		return fmt.Errorf("Failed to read schema version: %s", err.Error())
+	}
+
+	for i := version; i < len(sqlSessionStoreMigrations); i++ {
+		tx, err := store.db.Begin()
+		if err != nil {
+			return fmt.Errorf("Failed to start migration %d: %s", i+1, err.Error())
+		}
+		if _, err := tx.Exec(sqlSessionStoreMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Failed to apply migration %d: %s", i+1, err.Error())
+		}
+		if _, err := tx.Exec(sqlInsertMigrationVersion, i+1); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Failed to record migration %d: %s", i+1, err.Error())
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("Failed to commit migration %d: %s", i+1, err.Error())
+		}
+	}
+	return nil
+}
+
+// devEUIKey returns the primary key of a device
+func devEUIKey(devEUI uint64) string {
+	return fmt.Sprintf("%016X", devEUI)
+}
+
+// seal encrypts the session, bound to the DevEUI
+func (store *SQLSessionStore) seal(session *DeviceSession) ([]byte, error) {
+	plaintext, err := json.Marshal(session)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal session: %s", err.Error())
+	}
+	nonce := make([]byte, store.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("Failed to generate nonce: %s", err.Error())
+	}
+	return store.aead.Seal(nonce, nonce, plaintext, []byte(devEUIKey(session.DevEUI))), nil
+}
+
+// open decrypts a session that was encrypted with seal
+func (store *SQLSessionStore) open(devEUI string, ciphertext []byte) (*DeviceSession, error) {
+	nonceSize := store.aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, errors.New("The stored session is too short")
+	}
+	plaintext, err := store.aead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], []byte(devEUI))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt session %s: %s", devEUI, err.Error())
+	}
+	session := &DeviceSession{}
+	if err := json.Unmarshal(plaintext, session); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal session %s: %s", devEUI, err.Error())
+	}
+	return session, nil
+}
+
+// GetByDevAddr implements DeviceSessionStore
+func (store *SQLSessionStore) GetByDevAddr(devAddr uint32) ([]*DeviceSession, error) {
+	rows, err := store.db.Query(sqlSelectSessionsByDevAddr, int64(devAddr))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query sessions: %s", err.Error())
+	}
+	defer rows.Close()
+
+	sessions := []*DeviceSession{}
+	for rows.Next() {
+		var devEUI string
+		var ciphertext []byte
+		if err := rows.Scan(&devEUI, &ciphertext); err != nil {
+			return nil, fmt.Errorf("Failed to read session: %s", err.Error())
+		}
+		session, err := store.open(devEUI, ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read sessions: %s", err.Error())
+	}
+	return sessions, nil
+}
+
+// GetByDevEUI implements DeviceSessionStore
+func (store *SQLSessionStore) GetByDevEUI(devEUI uint64) (*DeviceSession, error) {
+	var key string
+	var ciphertext []byte
+	err := store.db.QueryRow(sqlSelectSessionByDevEUI, devEUIKey(devEUI)).Scan(&key, &ciphertext)
+	if err == sql.ErrNoRows {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query session: %s", err.Error())
+	}
+	return store.open(key, ciphertext)
+}
+
+// Save implements DeviceSessionStore
+func (store *SQLSessionStore) Save(session *DeviceSession, expected *FrameCounters) error {
+	ciphertext, err := store.seal(session)
+	if err != nil {
+		return err
+	}
+
+	key := devEUIKey(session.DevEUI)
+	var result sql.Result
+	if expected == nil {
+		result, err = store.db.Exec(sqlInsertSession,
+			key, int64(session.DevAddr),
+			int64(session.FCntUp), int64(session.NFCntDown), int64(session.AFCntDown),
+			ciphertext,
+		)
+	} else {
+		result, err = store.db.Exec(sqlUpdateSession,
+			key, int64(session.DevAddr),
+			int64(session.FCntUp), int64(session.NFCntDown), int64(session.AFCntDown),
+			ciphertext,
+			int64(expected.FCntUp), int64(expected.NFCntDown), int64(expected.AFCntDown),
+		)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to save session: %s", err.Error())
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("Failed to save session: %s", err.Error())
+	}
+	if affected > 0 {
+		return nil
+	}
+	if expected == nil {
+		return ErrSessionExists
+	}
+	if _, err := store.GetByDevEUI(session.DevEUI); err != nil {
+		return err
+	}
+	return ErrFCntConflict
+}
+
+// Delete implements DeviceSessionStore
+func (store *SQLSessionStore) Delete(devEUI uint64) error {
+	result, err := store.db.Exec(sqlDeleteSession, devEUIKey(devEUI))
+	if err != nil {
+		return fmt.Errorf("Failed to delete session: %s", err.Error())
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("Failed to delete session: %s", err.Error())
+	}
+	if affected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package lorawan
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+/* Fake SQL driver */
+
+// fakeSQLDriver is a database/sql driver that only understands the queries of
+// the SQLSessionStore, so that it can be tested without a database server
+type fakeSQLDriver struct {
+	mu     sync.Mutex
+	dbs    map[string]*fakeSQLDB
+	nextID int
+}
+
+type fakeSQLRow struct {
+	devAddr, fCntUp, nFCntDown, aFCntDown int64
+	session                               []byte
+}
+
+type fakeSQLDB struct {
+	mu         sync.Mutex
+	migrations []int64
+	schema     []string
+	rows       map[string]fakeSQLRow
+}
+
+var fakeSQL = &fakeSQLDriver{dbs: make(map[string]*fakeSQLDB)}
+
+func init() {
+	sql.Register("lorawan-fake", fakeSQL)
+}
+
+func (d *fakeSQLDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	db, ok := d.dbs[name]
+	if !ok {
+		db = &fakeSQLDB{rows: make(map[string]fakeSQLRow)}
+		d.dbs[name] = db
+	}
+	return &fakeSQLConn{db: db}, nil
+}
+
+// dsn returns a new data source name for the test, of which the database is
+// removed when the test finishes
+func (d *fakeSQLDriver) dsn(t *testing.T) string {
+	d.mu.Lock()
+	d.nextID++
+	name := fmt.Sprintf("%s-%d", t.Name(), d.nextID)
+	d.mu.Unlock()
+	t.Cleanup(func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.dbs, name)
+	})
+	return name
+}
+
+// db returns the database of the data source name
+func (d *fakeSQLDriver) db(name string) *fakeSQLDB {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dbs[name]
+}
+
+type fakeSQLConn struct{ db *fakeSQLDB }
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLStmt{db: c.db, query: query}, nil
+}
+func (c *fakeSQLConn) Close() error              { return nil }
+func (c *fakeSQLConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *fakeSQLConn) Commit() error             { return nil }
+func (c *fakeSQLConn) Rollback() error           { return nil }
+
+type fakeSQLStmt struct {
+	db    *fakeSQLDB
+	query string
+}
+
+func (s *fakeSQLStmt) Close() error  { return nil }
+func (s *fakeSQLStmt) NumInput() int { return -1 }
+
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := s.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	switch s.query {
+	case sqlCreateMigrationsTable:
+		return driver.RowsAffected(0), nil
+	case sqlInsertMigrationVersion:
+		db.migrations = append(db.migrations, args[0].(int64))
+		return driver.RowsAffected(1), nil
+	case sqlInsertSession:
+		key := args[0].(string)
+		if _, ok := db.rows[key]; ok {
+			return driver.RowsAffected(0), nil
+		}
+		db.rows[key] = fakeSQLRow{args[1].(int64), args[2].(int64), args[3].(int64), args[4].(int64), args[5].([]byte)}
+		return driver.RowsAffected(1), nil
+	case sqlUpdateSession:
+		key := args[0].(string)
+		row, ok := db.rows[key]
+		if !ok || row.fCntUp != args[6].(int64) || row.nFCntDown != args[7].(int64) || row.aFCntDown != args[8].(int64) {
+			return driver.RowsAffected(0), nil
+		}
+		db.rows[key] = fakeSQLRow{args[1].(int64), args[2].(int64), args[3].(int64), args[4].(int64), args[5].([]byte)}
+		return driver.RowsAffected(1), nil
+	case sqlDeleteSession:
+		key := args[0].(string)
+		if _, ok := db.rows[key]; !ok {
+			return driver.RowsAffected(0), nil
+		}
+		delete(db.rows, key)
+		return driver.RowsAffected(1), nil
+	}
+	if strings.HasPrefix(s.query, "CREATE") {
+		db.schema = append(db.schema, s.query)
+		return driver.RowsAffected(0), nil
+	}
+	return nil, fmt.Errorf("fake driver does not support %q", s.query)
+}
+
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := s.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	rows := &fakeSQLRows{columns: []string{"dev_eui", "session"}}
+	switch s.query {
+	case sqlSelectMigrationVersion:
+		rows.columns = []string{"version"}
+		var version int64
+		for _, v := range db.migrations {
+			if v > version {
+				version = v
+			}
+		}
+		rows.values = [][]driver.Value{{version}}
+	case sqlSelectSessionsByDevAddr:
+		for key, row := range db.rows {
+			if row.devAddr == args[0].(int64) {
+				rows.values = append(rows.values, []driver.Value{key, row.session})
+			}
+		}
+		sort.Slice(rows.values, func(i, j int) bool { return rows.values[i][0].(string) < rows.values[j][0].(string) })
+	case sqlSelectSessionByDevEUI:
+		if row, ok := db.rows[args[0].(string)]; ok {
+			rows.values = [][]driver.Value{{args[0], row.session}}
+		}
+	default:
+		return nil, fmt.Errorf("fake driver does not support %q", s.query)
+	}
+	return rows, nil
+}
+
+type fakeSQLRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeSQLRows) Columns() []string { return r.columns }
+func (r *fakeSQLRows) Close() error      { return nil }
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+/* SQLSessionStore Tests */
+
+var sqlEncryptionKey = []byte("0123456789abcdef0123456789abcdef")
+
+func openSQLSessionStore(t *testing.T, name string) *SQLSessionStore {
+	db, err := sql.Open("lorawan-fake", name)
+	if err != nil {
+		t.Fatalf("sql.Open failed: %s", err)
+	}
+	store, err := NewSQLSessionStore(db, sqlEncryptionKey)
+	if err != nil {
+		t.Fatalf("NewSQLSessionStore failed: %s", err)
+	}
+	if err := store.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %s", err)
+	}
+	return store
+}
+
+func TestSQLSessionStore(t *testing.T) {
+	testDeviceSessionStore(t, openSQLSessionStore(t, fakeSQL.dsn(t)))
+}
+
+func TestSQLSessionStoreMigrate(t *testing.T) {
+	name := fakeSQL.dsn(t)
+	openSQLSessionStore(t, name)
+	openSQLSessionStore(t, name)
+
+	db := fakeSQL.db(name)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if len(db.schema) != len(sqlSessionStoreMigrations) {
+		t.Errorf("Migrate should apply every migration once\n   got: %d\n  want: %d", len(db.schema), len(sqlSessionStoreMigrations))
+	}
+}
+
+func TestSQLSessionStoreEncryption(t *testing.T) {
+	name := fakeSQL.dsn(t)
+	store := openSQLSessionStore(t, name)
+	session := testSession(LoRaWAN1_0_2)
+	if err := store.Save(session, nil); err != nil {
+		t.Fatalf("Save failed: %s", err)
+	}
+
+	db := fakeSQL.db(name)
+	db.mu.Lock()
+	row := db.rows[devEUIKey(session.DevEUI)]
+	db.mu.Unlock()
+	if bytes.Contains(row.session, session.AppSKey) || bytes.Contains(row.session, []byte("app_s_key")) {
+		t.Errorf("Sessions should be encrypted at rest")
+	}
+
+	// A store with another key can not read the session
+	other, _ := NewSQLSessionStore(store.db, []byte("fedcba9876543210fedcba9876543210"))
+	if _, err := other.GetByDevEUI(session.DevEUI); err == nil {
+		t.Errorf("GetByDevEUI should error with the wrong encryption key")
+	}
+
+	if _, err := NewSQLSessionStore(store.db, []byte("short")); err == nil {
+		t.Errorf("NewSQLSessionStore should error on invalid keys")
+	}
+}
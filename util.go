@@ -10,3 +10,10 @@ func boolToByte(b bool) byte {
 	}
 	return 0x0
 }
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}